@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"github.com/dghubble/go-twitter/twitter"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// reconcilePrefix recomputes the cached counts of a RootHandle.
+const reconcilePrefix = "/admin/reconcile"
+
+// reconcileAllPrefix is run by cron to reconcile the counts of every unfinished job.
+const reconcileAllPrefix = "/cron/reconcile"
+
+// replayTickPrefix runs one tick of a job and reports the full outcome.
+const replayTickPrefix = "/admin/replayTick"
+
+// isBootstrapAdmin reports whether loginID is one of the AdminLoginIDs compiled into the
+// deployment, who remain admins however the Admin collection is edited.
+func isBootstrapAdmin(loginID string) bool {
+	for _, adminID := range AdminLoginIDs {
+		if adminID == loginID {
+			return true
+		}
+	}
+	return false
+}
+
+// adminCacheKey is the context key holding the admin lookups already made for a request.
+type adminCacheKey struct{}
+
+// withAdminCache returns a context in which isAdminCtx reads the Admin collection at most once
+// per LoginID.
+func withAdminCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, adminCacheKey{}, &sync.Map{})
+}
+
+// getAdminRef returns the document whose presence grants loginID admin rights.  Admins are
+// promoted at runtime by creating it, with any content.
+func getAdminRef(client *firestore.Client, loginID string) *firestore.DocumentRef {
+	return client.Collection(collectionName("Admin")).Doc(loginID)
+}
+
+// isAdminCtx reports whether loginID may use the admin endpoints, either as a bootstrap admin
+// or through a document in the Admin collection.
+func isAdminCtx(ctx context.Context, client *firestore.Client, loginID string) (bool, error) {
+	if loginID == "" {
+		return false, nil
+	}
+	if isBootstrapAdmin(loginID) {
+		return true, nil
+	}
+	cache, _ := ctx.Value(adminCacheKey{}).(*sync.Map)
+	if cache != nil {
+		if admin, ok := cache.Load(loginID); ok {
+			return admin.(bool), nil
+		}
+	}
+	_, err := getAdminRef(client, loginID).Get(ctx)
+	if err != nil && grpc.Code(err) != codes.NotFound {
+		return false, err
+	}
+	admin := err == nil
+	if cache != nil {
+		cache.Store(loginID, admin)
+	}
+	return admin, nil
+}
+
+// requireAdmin reports whether the signed in user is an admin, answering the request itself
+// when they are not or the lookup fails.
+func requireAdmin(ctx context.Context, w http.ResponseWriter, client *firestore.Client) bool {
+	admin, err := isAdminCtx(ctx, client, loginIDFromContext(ctx))
+	if err != nil {
+		writeHandlerError(w, "failed to check admin rights", err)
+		return false
+	}
+	if !admin {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// countsReport describes the cached counts of a RootHandle before and after reconciliation.
+type countsReport struct {
+	LoginID         string
+	TwitterID       string
+	EnqueuedBefore  int
+	RemainingBefore int
+	EnqueuedAfter   int
+	RemainingAfter  int
+}
+
+// drifted reports whether reconciliation changed any count.
+func (c *countsReport) drifted() bool {
+	return c.EnqueuedBefore != c.EnqueuedAfter || c.RemainingBefore != c.RemainingAfter
+}
+
+// reconcileCounts recounts the FetchedHandles of a RootHandle and corrects its cached
+// EnqueuedCount and Remaining if they drifted.  The recount and the correction share a
+// transaction, so a tick hydrating handles meanwhile cannot be overwritten with stale counts.
+func reconcileCounts(ctx context.Context, dataClient *firestore.Client, rootHandle *RootHandle) (*countsReport, error) {
+	var report *countsReport
+	err := runTransactionWithRetry(ctx, dataClient, func(ctx context.Context, tx *firestore.Transaction) error {
+		current, err := getRootHandleTransaction(ctx, dataClient, tx, rootHandle)
+		if err != nil {
+			return err
+		}
+		enqueued, remaining, err := countFetchedHandlesTransaction(ctx, dataClient, tx, current)
+		if err != nil {
+			return err
+		}
+		// Remaining stays -1 until the job has enqueued all of its handles.
+		if current.Remaining < 0 {
+			remaining = current.Remaining
+		}
+		report = &countsReport{
+			LoginID:         current.LoginID,
+			TwitterID:       current.Node.TwitterID,
+			EnqueuedBefore:  current.EnqueuedCount,
+			RemainingBefore: current.Remaining,
+			EnqueuedAfter:   enqueued,
+			RemainingAfter:  remaining,
+		}
+		if !report.drifted() {
+			return nil
+		}
+		return updateRootHandleCountsTransaction(ctx, dataClient, tx, current, enqueued, remaining)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// reconcileHandler recounts the FetchedHandles of a RootHandle and corrects its cached
+// EnqueuedCount and Remaining if they drifted.  The report is returned as JSON.  Its POST
+// body should include:
+// auth - the Firebase token of an admin
+// user - the LoginID owning the handle
+// id - the TwitterID of the handle.
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	if !requireAdmin(ctx, w, dataClient) {
+		return
+	}
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, r.FormValue("user"), r.FormValue("id"))
+	if err != nil {
+		writeHandlerError(w, "could not find identified user", err)
+		return
+	}
+	if rootHandle.Remaining == -1 {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "handle has not finished collecting IDs")
+		return
+	}
+	report, err := reconcileCounts(ctx, dataClient, rootHandle)
+	if err != nil {
+		writeHandlerError(w, "failed to reconcile counts", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// tickReplay describes the outcome of a single replayed tick.
+type tickReplay struct {
+	LoginID   string
+	TwitterID string
+	Status    string
+	// Error is the complete error message, which the job's Status may only summarize.
+	Error string `json:",omitempty"`
+	// TwitterErrors holds the codes and messages of a Twitter API error.
+	TwitterErrors []twitter.ErrorDetail `json:",omitempty"`
+	// RateLimit holds the x-rate-limit-* headers of the last Twitter response.
+	RateLimit map[string]string `json:",omitempty"`
+	Calls     int
+}
+
+// replayTickHandler runs a single tick of a job synchronously, exactly as the worker would,
+// and returns its full outcome as JSON to help debug stuck jobs.  Its POST body should include:
+// auth - the Firebase token of an admin
+// user - the LoginID owning the handle
+// id - the TwitterID of the handle.
+func replayTickHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	if !requireAdmin(ctx, w, dataClient) {
+		return
+	}
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, r.FormValue("user"), r.FormValue("id"))
+	if err != nil {
+		writeHandlerError(w, "could not find identified user", err)
+		return
+	}
+	client, counter, err := newUserTwitterClient(ctx, dataClient, rootHandle.LoginID)
+	if err != nil {
+		writeHandlerError(w, "failed to connect Twitter", err)
+		return
+	}
+	status, err := runTick(ctx, client, dataClient, rootHandle.LoginID, rootHandle)
+	auditCredentialUse(ctx, dataClient, rootHandle.LoginID, "replayTick", rootHandle.Node.TwitterID, counter)
+	replay := &tickReplay{
+		LoginID:   rootHandle.LoginID,
+		TwitterID: rootHandle.Node.TwitterID,
+		Status:    status,
+		RateLimit: counter.RateLimit(),
+		Calls:     counter.Calls(),
+	}
+	if err != nil {
+		replay.Error = err.Error()
+		var apiErr twitter.APIError
+		if errors.As(err, &apiErr) {
+			replay.TwitterErrors = apiErr.Errors
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(replay)
+}
+
+// reconcileAllHandler is run by cron to reconcile the counts of every unfinished job that has
+// finished collecting IDs, logging each discrepancy it corrects.
+func reconcileAllHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !isCronRequest(r) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		logError(ctx, w, "", err)
+		return
+	}
+	defer dataClient.Close()
+	iter := getUserCollection(dataClient).Documents(ctx)
+	defer iter.Stop()
+	checked, corrected := 0, 0
+	for {
+		userDoc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			logError(ctx, w, "", err)
+			return
+		}
+		rootHandles, err := getUnfinishedRootHandles(ctx, dataClient, userDoc.Ref.ID)
+		if err != nil {
+			logErrorf("reconcile error: (%v) %v", userDoc.Ref.ID, err)
+			continue
+		}
+		for _, rootHandle := range rootHandles {
+			if rootHandle.Remaining == -1 {
+				continue
+			}
+			report, err := reconcileCounts(ctx, dataClient, rootHandle)
+			if err != nil {
+				logErrorf("reconcile error: (%v) %v: %v", rootHandle.LoginID, rootHandle.Node.TwitterID, err)
+				continue
+			}
+			checked++
+			if report.drifted() {
+				corrected++
+				logInfof("reconciled counts: (%v) %v: enqueued %v -> %v, remaining %v -> %v", report.LoginID, report.TwitterID,
+					report.EnqueuedBefore, report.EnqueuedAfter, report.RemainingBefore, report.RemainingAfter)
+			}
+		}
+	}
+	fmt.Fprintf(w, "Reconciled %v jobs, corrected %v", checked, corrected)
+}
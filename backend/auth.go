@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"firebase.google.com/go/auth"
+)
+
+// authPolicy chooses how a route answers requests that fail authentication.
+type authPolicy int
+
+const (
+	// authAPI answers with a 401 and a JSON error body.
+	authAPI authPolicy = iota
+	// authPage redirects the browser to the frontend so the user can log in.
+	authPage
+)
+
+// firebaseTokenKey is the context key holding the verified Firebase token of a request.
+type firebaseTokenKey struct{}
+
+// withAuth wraps a handler so that it only runs for requests carrying a valid Firebase token,
+// taken from an "Authorization: Bearer" header or the auth form value.  The verified token is
+// available to the handler through loginIDFromContext and firebaseTokenFromContext.  Every
+// response allows cross-origin requests from the frontend.  CORS preflight requests carry no
+// token, so they are answered before it is checked.
+func withAuth(policy authPolicy, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		authToken := r.FormValue("auth")
+		if bearer := r.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+			authToken = strings.TrimPrefix(bearer, "Bearer ")
+		}
+		token, err := verifyFirebaseToken(r.Context(), authToken)
+		if err != nil {
+			if policy == authPage {
+				indexHandler(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to validate firebase token: " + err.Error()})
+			return
+		}
+		h(w, r.WithContext(withAdminCache(context.WithValue(r.Context(), firebaseTokenKey{}, token))))
+	}
+}
+
+// firebaseTokenFromContext returns the verified Firebase token stored by withAuth.
+func firebaseTokenFromContext(ctx context.Context) *auth.Token {
+	token, _ := ctx.Value(firebaseTokenKey{}).(*auth.Token)
+	return token
+}
+
+// loginIDFromContext returns the user ID of the logged in user as verified by withAuth.
+func loginIDFromContext(ctx context.Context) string {
+	if token := firebaseTokenFromContext(ctx); token != nil {
+		return token.UID
+	}
+	return ""
+}
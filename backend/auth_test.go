@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithAuthAnswersPreflight(t *testing.T) {
+	called := false
+	h := withAuth(authAPI, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodOptions, graphStatsPrefix, nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status = %v, want %v", w.Code, http.StatusNoContent)
+	}
+	if called {
+		t.Error("preflight reached the handler")
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type",
+		"Access-Control-Allow-Methods": "GET, POST, OPTIONS",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%v = %q, want %q", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// exportJobsPrefix streams a backup of all of a user's jobs.
+const exportJobsPrefix = "/exportJobs"
+
+// importJobsPrefix restores a backup produced by exportJobsPrefix.
+const importJobsPrefix = "/importJobs"
+
+// backupRecord is a single line of a newline delimited JSON backup.  Exactly one
+// of its fields is set.  A RootHandle line always precedes the FetchedHandle
+// lines that belong to it.
+type backupRecord struct {
+	RootHandle    *RootHandle    `json:",omitempty"`
+	FetchedHandle *FetchedHandle `json:",omitempty"`
+}
+
+// exportUserJobs writes every RootHandle owned by userID, each followed by its
+// FetchedHandles, to enc.  Documents are streamed one at a time.
+func exportUserJobs(ctx context.Context, client *firestore.Client, userID string, enc *json.Encoder) error {
+	rootIter := getRootHandleCollection(client, userID).Documents(ctx)
+	defer rootIter.Stop()
+	for {
+		rootDoc, err := rootIter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var rootHandle RootHandle
+		if err := rootDoc.DataTo(&rootHandle); err != nil {
+			return err
+		}
+		if err := enc.Encode(&backupRecord{RootHandle: &rootHandle}); err != nil {
+			return err
+		}
+		if err := exportFetchedHandles(ctx, client, userID, rootDoc.Ref.ID, enc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportFetchedHandles writes every FetchedHandle below the given root to enc.
+func exportFetchedHandles(ctx context.Context, client *firestore.Client, userID string, rootID string, enc *json.Encoder) error {
+	iter := getFetchedHandleCollection(client, userID, rootID).Documents(ctx)
+	defer iter.Stop()
+	for {
+		fetchedDoc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var fetchedHandle FetchedHandle
+		if err := fetchedDoc.DataTo(&fetchedHandle); err != nil {
+			return err
+		}
+		if err := enc.Encode(&backupRecord{FetchedHandle: &fetchedHandle}); err != nil {
+			return err
+		}
+	}
+}
+
+// importUserJobs reads records written by exportUserJobs from dec and saves them
+// under userID, overwriting any documents with the same IDs.  RootHandles are
+// reassigned to userID regardless of who exported them.  Each RootHandle is
+// written after its FetchedHandles, so the worker never picks up a job whose
+// handles are still arriving, and an import that fails part way can simply be
+// repeated.  Records that cannot be read fail with ErrInvalidBackup.  The number
+// of restored RootHandles is returned.
+func importUserJobs(ctx context.Context, client *firestore.Client, userID string, dec *json.Decoder) (int, error) {
+	batch := client.Batch()
+	numBatched := 0
+	numRoots := 0
+	var pending *RootHandle
+	// add queues a write, committing the batch once it is full.
+	add := func(ref *firestore.DocumentRef, data interface{}) error {
+		batch.Set(ref, data)
+		numBatched++
+		// Firestore only handles writes up to 500 documents.
+		if numBatched < 500 {
+			return nil
+		}
+		if err := throttleWrites(ctx, numBatched); err != nil {
+			return err
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return err
+		}
+		batch = client.Batch()
+		numBatched = 0
+		return nil
+	}
+	// flush queues the pending RootHandle once all of its FetchedHandles are queued.
+	flush := func() error {
+		if pending == nil {
+			return nil
+		}
+		if err := add(getRootHandleRef(client, userID, pending.Node.TwitterID), pending); err != nil {
+			return err
+		}
+		numRoots++
+		pending = nil
+		return nil
+	}
+	rootID := ""
+	for {
+		var record backupRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return numRoots, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		switch {
+		case record.RootHandle != nil:
+			if err := flush(); err != nil {
+				return numRoots, err
+			}
+			record.RootHandle.LoginID = userID
+			rootID = record.RootHandle.Node.TwitterID
+			if rootID == "" {
+				return numRoots, fmt.Errorf("%w: root handle without a TwitterID", ErrInvalidBackup)
+			}
+			pending = record.RootHandle
+		case record.FetchedHandle != nil:
+			if record.FetchedHandle.ParentID != rootID || rootID == "" {
+				return numRoots, fmt.Errorf("%w: fetched handle %v does not follow its root handle %v", ErrInvalidBackup, record.FetchedHandle.Node.TwitterID, record.FetchedHandle.ParentID)
+			}
+			if err := add(getFetchedHandleCollection(client, userID, rootID).Doc(record.FetchedHandle.Node.TwitterID), record.FetchedHandle); err != nil {
+				return numRoots, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return numRoots, err
+	}
+	if numBatched > 0 {
+		if err := throttleWrites(ctx, numBatched); err != nil {
+			return numRoots, err
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return numRoots, err
+		}
+	}
+	return numRoots, nil
+}
+
+// exportJobsHandler streams a newline delimited JSON backup of all of the user's
+// jobs.  Its POST body should include:
+// auth - the Firebase token.
+func exportJobsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "Attachment; filename=twitterweb-backup.ndjson")
+	if err := exportUserJobs(ctx, dataClient, loginID, json.NewEncoder(w)); err != nil {
+		// The response has likely started streaming, so the error can only be logged.
+		logErrorf("export error: (%v) %v", loginID, err)
+	}
+}
+
+// importJobsHandler restores a backup produced by exportJobsHandler.  A backup
+// that fails to import may be posted again.  The POST body is the newline
+// delimited JSON backup itself, so the Firebase token is passed in the URL:
+// auth - the Firebase token.
+func importJobsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	numRoots, err := importUserJobs(ctx, dataClient, loginID, json.NewDecoder(r.Body))
+	if err != nil {
+		writeHandlerError(w, fmt.Sprintf("failed to import jobs after %v handles", numRoots), err)
+		return
+	}
+	fmt.Fprintf(w, "Imported %v handles", numRoots)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// globalBlocklist holds the TwitterIDs or screen names, separated by commas, that are excluded
+// from every crawl.  It is read from the BLOCKLIST environment variable.
+var globalBlocklist = parseBlocklist(os.Getenv("BLOCKLIST"))
+
+// parseBlocklist splits a comma separated list of TwitterIDs or screen names, dropping
+// blanks and leading @ signs.
+func parseBlocklist(s string) []string {
+	var entries []string
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), "@")
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// isTwitterID reports whether s is made up only of digits and so names an account by ID.
+func isTwitterID(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveBlocklist converts the entries to TwitterIDs, looking up screen names on Twitter.
+// Screen names that no longer exist are skipped since they cannot appear in a crawl.
+func resolveBlocklist(ctx context.Context, client *twitter.Client, entries []string) ([]string, error) {
+	var ids []string
+	for _, entry := range entries {
+		if isTwitterID(entry) {
+			ids = append(ids, entry)
+			continue
+		}
+		user, err := getTwitterUserByName(ctx, client, entry)
+		if err != nil {
+			return nil, err
+		}
+		// Missing accounts come back as placeholders without an ID.
+		if user.IDStr == "" {
+			continue
+		}
+		ids = append(ids, user.IDStr)
+	}
+	return ids, nil
+}
+
+// blockedSet returns the set of TwitterIDs excluded from the crawl of rootHandle.
+func blockedSet(rootHandle *RootHandle) map[string]bool {
+	blocked := make(map[string]bool)
+	for _, id := range rootHandle.Blocklist {
+		blocked[id] = true
+	}
+	return blocked
+}
+
+// filterBlocked returns the IDs that are not in the blocked set.
+func filterBlocked(ids []string, blocked map[string]bool) []string {
+	if len(blocked) == 0 {
+		return ids
+	}
+	var kept []string
+	for _, id := range ids {
+		if !blocked[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// breakerThreshold is how many consecutive failed calls open an app's circuit breaker.
+var breakerThreshold = envInt("BREAKER_THRESHOLD", 5)
+
+// breakerCooldown is how long an open circuit breaker short-circuits calls.
+var breakerCooldown = time.Duration(envInt("BREAKER_COOLDOWN_SECONDS", 300)) * time.Second
+
+// circuitBreaker tracks consecutive failures of calls made with one Twitter app's credentials.
+// It is closed while calls succeed, opens after threshold consecutive failures, and after the
+// cooldown lets a single trial call through, closing again if it succeeds.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether a call may proceed at now.  Once the cooldown has passed one trial call
+// is allowed and the breaker stays open for another cooldown unless that call succeeds.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// record notes the outcome of a call made at now.
+func (b *circuitBreaker) record(failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures == b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// appBreakers holds one circuitBreaker per Twitter consumer key.
+var appBreakers = struct {
+	sync.Mutex
+	m map[string]*circuitBreaker
+}{m: make(map[string]*circuitBreaker)}
+
+// breakerForApp returns the circuitBreaker of the Twitter app identified by consumerKey.
+func breakerForApp(consumerKey string) *circuitBreaker {
+	appBreakers.Lock()
+	defer appBreakers.Unlock()
+	b, ok := appBreakers.m[consumerKey]
+	if !ok {
+		b = &circuitBreaker{threshold: breakerThreshold, cooldown: breakerCooldown}
+		appBreakers.m[consumerKey] = b
+	}
+	return b
+}
+
+// breakerTransport is an http.RoundTripper that refuses requests while its breaker is open.
+// Server errors, transport failures and 401s refusing the app's credentials count as failures.
+// Other client errors, such as protected or missing accounts, concern single users rather than
+// the app, and requests ended by their own context say nothing about the app either.  Rate limit
+// responses, even with no calls remaining, are left out on purpose: limits apply to each user's
+// tokens rather than the app, they already carry their reset time to the job, and opening the
+// breaker on them would stall every job of the app for the cooldown instead.
+type breakerTransport struct {
+	base    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+// RoundTrip forwards the request unless the breaker is open, recording the outcome.
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow(time.Now()) {
+		return nil, fmt.Errorf("%w: too many consecutive failures", ErrAppUnavailable)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || req.Context().Err() != nil {
+			return resp, err
+		}
+		t.breaker.record(true, time.Now())
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return resp, nil
+	}
+	failed := resp.StatusCode >= 500 || isCredentialsRejected(resp)
+	t.breaker.record(failed, time.Now())
+	return resp, nil
+}
+
+// maxErrorBodyBytes bounds how much of a 401 body is read for its error code.
+const maxErrorBodyBytes = 64 << 10
+
+// isCredentialsRejected reports whether resp is a 401 refusing the credentials themselves, as
+// opposed to access to a protected account.  The body is read and put back for the caller.
+func isCredentialsRejected(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusUnauthorized || resp.Body == nil {
+		return false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	var apiErr twitter.APIError
+	if json.Unmarshal(body, &apiErr) != nil || len(apiErr.Errors) == 0 {
+		return false
+	}
+	code := apiErr.Errors[0].Code
+	return code == twitterBadAuthCode || code == twitterInvalidTokenCode
+}
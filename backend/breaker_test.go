@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &circuitBreaker{threshold: 3, cooldown: time.Minute}
+	for i := 0; i < 2; i++ {
+		b.record(true, now)
+		if !b.allow(now) {
+			t.Fatalf("breaker opened after %v failures, want 3", i+1)
+		}
+	}
+	b.record(false, now)
+	for i := 0; i < 2; i++ {
+		b.record(true, now)
+	}
+	if !b.allow(now) {
+		t.Fatal("a success did not reset the failure count")
+	}
+	b.record(true, now)
+	if b.allow(now) {
+		t.Fatal("breaker still closed after 3 consecutive failures")
+	}
+	if b.allow(now.Add(59 * time.Second)) {
+		t.Fatal("breaker allowed a call during the cooldown")
+	}
+	trial := now.Add(time.Minute)
+	if !b.allow(trial) {
+		t.Fatal("breaker refused the trial call after the cooldown")
+	}
+	if b.allow(trial) {
+		t.Fatal("breaker allowed a second call while the trial is outstanding")
+	}
+	b.record(true, trial)
+	if b.allow(trial.Add(59 * time.Second)) {
+		t.Fatal("breaker closed after a failed trial call")
+	}
+	retrial := trial.Add(time.Minute)
+	if !b.allow(retrial) {
+		t.Fatal("breaker refused the next trial call")
+	}
+	b.record(false, retrial)
+	if !b.allow(retrial) {
+		t.Fatal("breaker stayed open after a successful trial call")
+	}
+}
+
+// fakeRoundTripper answers every request with status, header and body, or fails with err when
+// it is set.
+type fakeRoundTripper struct {
+	status int
+	header http.Header
+	body   string
+	err    error
+	calls  int
+}
+
+func (f *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &http.Response{StatusCode: f.status, Header: f.header, Body: ioutil.NopCloser(strings.NewReader(f.body)), Request: req}, nil
+}
+
+func TestBreakerTransportCountsFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		body   string
+		err    error
+		opens  bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "not found", status: http.StatusNotFound},
+		{name: "rate limited", status: http.StatusTooManyRequests},
+		{name: "rate limited with none remaining", status: http.StatusTooManyRequests, header: http.Header{"X-Rate-Limit-Remaining": {"0"}}},
+		{name: "protected account", status: http.StatusUnauthorized, body: `{"errors": [{"code": 179, "message": "Not authorized."}]}`},
+		{name: "401 without code", status: http.StatusUnauthorized},
+		{name: "bad app credentials", status: http.StatusUnauthorized, body: `{"errors": [{"code": 32, "message": "Could not authenticate you."}]}`, opens: true},
+		{name: "invalid token", status: http.StatusUnauthorized, body: `{"errors": [{"code": 89, "message": "Invalid or expired token."}]}`, opens: true},
+		{name: "server error", status: http.StatusServiceUnavailable, opens: true},
+		{name: "transport error", err: errors.New("connection reset"), opens: true},
+		{name: "canceled", err: context.Canceled},
+		{name: "deadline", err: fmt.Errorf("net/http: request canceled: %w", context.DeadlineExceeded)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := &fakeRoundTripper{status: test.status, header: test.header, body: test.body, err: test.err}
+			transport := &breakerTransport{base: base, breaker: &circuitBreaker{threshold: 2, cooldown: time.Hour}}
+			req, err := http.NewRequest(http.MethodGet, "https://api.twitter.com/1.1/users/show.json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				transport.RoundTrip(req)
+			}
+			_, err = transport.RoundTrip(req)
+			if opened := errors.Is(err, ErrAppUnavailable); opened != test.opens {
+				t.Errorf("breaker opened = %v, want %v", opened, test.opens)
+			}
+			if test.opens && base.calls != 2 {
+				t.Errorf("open breaker forwarded the request, %v calls made", base.calls)
+			}
+		})
+	}
+}
+
+func TestBreakerTransportKeepsTheBodyOfA401(t *testing.T) {
+	body := `{"errors": [{"code": 32, "message": "Could not authenticate you."}]}`
+	base := &fakeRoundTripper{status: http.StatusUnauthorized, body: body}
+	transport := &breakerTransport{base: base, breaker: &circuitBreaker{threshold: 5, cooldown: time.Hour}}
+	req, err := http.NewRequest(http.MethodGet, "https://api.twitter.com/1.1/users/show.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(got) != body {
+		t.Errorf("response body = %q (%v), want %q", got, err, body)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import "strings"
+
+// unionFind is a disjoint-set forest over TwitterIDs with union by size and path halving.
+type unionFind struct {
+	parent map[string]string
+	size   map[string]int
+}
+
+func newUnionFind() *unionFind {
+	return &unionFind{parent: make(map[string]string), size: make(map[string]int)}
+}
+
+// add makes id a singleton set unless it is already known.
+func (u *unionFind) add(id string) {
+	if _, ok := u.parent[id]; !ok {
+		u.parent[id] = id
+		u.size[id] = 1
+	}
+}
+
+// find returns the representative of the set holding id.
+func (u *unionFind) find(id string) string {
+	for u.parent[id] != id {
+		u.parent[id] = u.parent[u.parent[id]]
+		id = u.parent[id]
+	}
+	return id
+}
+
+// union merges the sets holding a and b.
+func (u *unionFind) union(a, b string) {
+	ra, rb := u.find(a), u.find(b)
+	if ra == rb {
+		return
+	}
+	if u.size[ra] < u.size[rb] {
+		ra, rb = rb, ra
+	}
+	u.parent[rb] = ra
+	u.size[ra] += u.size[rb]
+}
+
+// largestComponent finds the connected components of the graph on the IDs in m, treating edges
+// as undirected.  The root is left out because it is linked to every other node, which would
+// make the whole graph a single component.  It returns the IDs of the largest component and the
+// number of components found.  Ties go to the component with the smallest representative ID so
+// the result is reproducible.
+func largestComponent(m map[string]bool, rootID string, edgeSet map[string]bool) (map[string]bool, int) {
+	u := newUnionFind()
+	for id := range m {
+		if id != rootID {
+			u.add(id)
+		}
+	}
+	for edge := range edgeSet {
+		splits := strings.Split(edge, " ")
+		if splits[0] == rootID || splits[1] == rootID {
+			continue
+		}
+		u.union(splits[0], splits[1])
+	}
+	components := 0
+	largest := ""
+	for id := range u.parent {
+		r := u.find(id)
+		if r != id {
+			continue
+		}
+		components++
+		if largest == "" || u.size[r] > u.size[largest] || (u.size[r] == u.size[largest] && r < largest) {
+			largest = r
+		}
+	}
+	kept := make(map[string]bool, u.size[largest])
+	for id := range u.parent {
+		if u.find(id) == largest {
+			kept[id] = true
+		}
+	}
+	return kept, components
+}
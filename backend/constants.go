@@ -8,3 +8,7 @@ const TwitterConsumerKey = "KEY"
 
 // The Twitter Consumer Secret of the developer application to use.
 const TwitterConsumerSecret = "SECRET"
+
+// AdminLoginIDs lists the Firebase user IDs that are always permitted to use the admin
+// endpoints.  Further admins are promoted at runtime through the Admin collection.
+var AdminLoginIDs = []string{}
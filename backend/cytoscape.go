@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// cytoscapeElement is a node or edge in the Cytoscape.js elements schema.  Data holds the
+// attributes that styling mappers read, keyed like the GraphML attributes.
+type cytoscapeElement struct {
+	Data     map[string]interface{} `json:"data"`
+	Position *nodePosition          `json:"position,omitempty"`
+}
+
+// cytoscapeGraph is the top level document read by cytoscape({elements: ...}).
+type cytoscapeGraph struct {
+	Elements struct {
+		Nodes []cytoscapeElement `json:"nodes"`
+		Edges []cytoscapeElement `json:"edges"`
+	} `json:"elements"`
+}
+
+// buildCytoscapeJSON returns a Cytoscape.js JSON document describing the same graph as
+// buildGephiFile.
+func buildCytoscapeJSON(rootHandle *RootHandle, fetchedHandles []*FetchedHandle, opts *ExportOptions) ([]byte, error) {
+	g := collectGraph(rootHandle, fetchedHandles, opts)
+	doc := &cytoscapeGraph{}
+	doc.Elements.Nodes = make([]cytoscapeElement, 0, len(g.Nodes))
+	doc.Elements.Edges = make([]cytoscapeElement, 0, len(g.Edges))
+	for _, n := range g.Nodes {
+		data := map[string]interface{}{
+			"id":                    g.nodeID(n.TwitterID),
+			"user_id":               n.TwitterID,
+			"label":                 n.ScreenName,
+			"type":                  n.Relationship,
+			"friends":               n.FriendsCount,
+			"followers":             n.FollowersCount,
+			"is_self":               n.IsSelf,
+			"default_profile":       n.DefaultProfile,
+			"default_profile_image": n.DefaultProfileImage,
+			"verified":              n.Verified,
+			"statuses":              n.StatusesCount,
+			"protected":             n.Protected,
+		}
+		if createdAt := exportedCreatedAt(n); createdAt != "" {
+			data["created_at"] = createdAt
+		}
+		if !opts.Compact {
+			data["profile_url"] = n.ProfileURL
+			data["description"] = normalizeText(n.Description)
+			if image := profileImageURL(n, opts); image != "" {
+				data["profile_image_url"] = image
+			}
+			if n.ProfileBannerURL != "" {
+				data["profile_banner_url"] = n.ProfileBannerURL
+			}
+			if len(n.RecentTweets) > 0 {
+				data["recent_tweets"] = normalizeText(strings.Join(n.RecentTweets, " | "))
+			}
+		}
+		element := cytoscapeElement{Data: data}
+		if p, ok := g.Positions[n.TwitterID]; ok {
+			element.Position = &p
+		}
+		doc.Elements.Nodes = append(doc.Elements.Nodes, element)
+	}
+	for _, edge := range g.Edges {
+		data := map[string]interface{}{
+			"id":     g.nodeID(edge.Source) + "-" + g.nodeID(edge.Target),
+			"source": g.nodeID(edge.Source),
+			"target": g.nodeID(edge.Target),
+		}
+		if opts.WeightEdges {
+			data["weight"] = opts.edgeWeight(edge, rootHandle.Node.TwitterID)
+		}
+		if opts.TagSelfLoops && edge.Source == edge.Target {
+			data["self_loop"] = true
+		}
+		if edge.Mutual {
+			data["mutual"] = true
+		}
+		doc.Elements.Edges = append(doc.Elements.Edges, cytoscapeElement{Data: data})
+	}
+	return json.Marshal(doc)
+}
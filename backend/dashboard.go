@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// adminDashboardPrefix shows every user and their unfinished jobs.
+const adminDashboardPrefix = "/admin/"
+
+// dashboardJob is an unfinished RootHandle as listed on the admin dashboard.
+type dashboardJob struct {
+	TwitterID       string
+	ScreenName      string
+	Status          string
+	Paused          bool
+	PercentComplete int
+}
+
+// dashboardUser is one row of the admin dashboard.
+type dashboardUser struct {
+	LoginID     string
+	ScreenName  string
+	RootHandles int
+	InProgress  []*dashboardJob
+}
+
+// adminDashboardTemplate renders the admin dashboard.  Each unfinished job can be advanced by
+// one tick through replayTickPrefix, since the worker itself only answers cron.
+var adminDashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><title>twitterweb admin</title></head>
+<body>
+<h1>Users</h1>
+<table border="1">
+<tr><th>Login ID</th><th>Screen name</th><th>Root handles</th><th>In progress</th></tr>
+{{range .Users}}<tr>
+<td>{{.LoginID}}</td>
+<td>{{.ScreenName}}</td>
+<td>{{.RootHandles}}</td>
+<td>{{$user := .}}{{range .InProgress}}<div>
+@{{.ScreenName}}: {{.Status}}{{if .Paused}} (paused){{end}}{{if ge .PercentComplete 0}} {{.PercentComplete}}%{{end}}
+<form method="POST" action="{{$.ReplayTickURL}}" style="display:inline">
+<input type="hidden" name="auth" value="{{$.Auth}}">
+<input type="hidden" name="user" value="{{$user.LoginID}}">
+<input type="hidden" name="id" value="{{.TwitterID}}">
+<input type="submit" value="Debug tick">
+</form>
+</div>{{end}}</td>
+</tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+// getDashboardUsers lists every user with the number of RootHandles they own and the state of
+// those still in progress.  Unlike the worker sweep it leaves the sweep marker untouched.
+func getDashboardUsers(ctx context.Context, client *firestore.Client) ([]*dashboardUser, error) {
+	iter := getUserCollection(client).OrderBy(firestore.DocumentID, firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	var users []*dashboardUser
+	for {
+		userDoc, err := iter.Next()
+		if err == iterator.Done {
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var appUser User
+		if err := userDoc.DataTo(&appUser); err != nil {
+			return nil, err
+		}
+		user := &dashboardUser{LoginID: userDoc.Ref.ID, ScreenName: appUser.ScreenName}
+		if err := addDashboardJobs(ctx, client, user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+}
+
+// addDashboardJobs counts the RootHandles of user and records the unfinished ones.
+func addDashboardJobs(ctx context.Context, client *firestore.Client, user *dashboardUser) error {
+	iter := getRootHandleCollection(client, user.LoginID).Documents(ctx)
+	defer iter.Stop()
+	for {
+		handleDoc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rootHandle RootHandle
+		if err := handleDoc.DataTo(&rootHandle); err != nil {
+			return err
+		}
+		user.RootHandles++
+		if rootHandle.Node.Done {
+			continue
+		}
+		user.InProgress = append(user.InProgress, &dashboardJob{
+			TwitterID:       rootHandle.Node.TwitterID,
+			ScreenName:      rootHandle.Node.ScreenName,
+			Status:          rootHandle.Status,
+			Paused:          rootHandle.Paused,
+			PercentComplete: percentComplete(&rootHandle),
+		})
+	}
+}
+
+// adminDashboardHandler renders a table of every user, how many handles they have and the
+// status of each unfinished one.  The page is opened in the browser with:
+// auth - the Firebase token of an admin.
+func adminDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.URL.Path != adminDashboardPrefix {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	if !requireAdmin(ctx, w, dataClient) {
+		return
+	}
+	users, err := getDashboardUsers(ctx, dataClient)
+	if err != nil {
+		writeHandlerError(w, "failed to list users", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = adminDashboardTemplate.Execute(w, map[string]interface{}{
+		"Users":         users,
+		"Auth":          r.FormValue("auth"),
+		"ReplayTickURL": replayTickPrefix,
+	})
+	if err != nil {
+		logErrorf("dashboard error: %v", err)
+	}
+}
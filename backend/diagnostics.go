@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	firebase "firebase.google.com/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// diagnosticsPrefix reports whether each subsystem the deployment depends on is reachable.
+const diagnosticsPrefix = "/admin/diagnostics"
+
+// twitterAppTokenURL issues app-only bearer tokens, which validates the consumer credentials
+// without involving any user.
+const twitterAppTokenURL = "https://api.twitter.com/oauth2/token"
+
+// diagnosticTimeout bounds each check so that one hung subsystem does not stall the report.
+const diagnosticTimeout = 10 * time.Second
+
+// subsystemStatus is the outcome of one diagnostic check.
+type subsystemStatus struct {
+	OK    bool
+	Error string `json:",omitempty"`
+}
+
+// diagnosticChecks lists the checks run by diagnosticsHandler, by subsystem name.
+var diagnosticChecks = map[string]func(context.Context) error{
+	"constants": checkConstants,
+	"firestore": checkFirestore,
+	"auth":      checkFirebaseAuth,
+	"storage":   checkStorage,
+	"twitter":   checkTwitterApp,
+}
+
+// checkConstants catches deployments that still carry the placeholder values of constants.go.
+func checkConstants(ctx context.Context) error {
+	var placeholders []string
+	for _, constant := range []struct{ name, value string }{
+		{"ProjectID", ProjectID},
+		{"TwitterConsumerKey", TwitterConsumerKey},
+		{"TwitterConsumerSecret", TwitterConsumerSecret},
+	} {
+		if v := constant.value; v == "" || v == "PROJECTID" || v == "KEY" || v == "SECRET" {
+			placeholders = append(placeholders, constant.name)
+		}
+	}
+	if len(placeholders) > 0 {
+		return fmt.Errorf("placeholder values in constants.go: %v", strings.Join(placeholders, ", "))
+	}
+	return nil
+}
+
+// checkFirestore connects to the firestore and reads a single document.
+func checkFirestore(ctx context.Context) error {
+	client, err := newFirestoreClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if _, err := getSweepMarkerRef(client).Get(ctx); err != nil && grpc.Code(err) != codes.NotFound {
+		return err
+	}
+	return nil
+}
+
+// checkFirebaseAuth initializes the Firebase auth client used to verify tokens.
+func checkFirebaseAuth(ctx context.Context) error {
+	app, err := firebase.NewApp(ctx, &firebase.Config{ProjectID: ProjectID})
+	if err != nil {
+		return err
+	}
+	_, err = app.Auth(ctx)
+	return err
+}
+
+// checkStorage reads the attributes of the bucket graphs are stored in.
+func checkStorage(ctx context.Context) error {
+	bucket, err := newGraphBucket(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = bucket.Attrs(ctx)
+	return err
+}
+
+// checkTwitterApp requests an app-only bearer token, which Twitter only issues for a valid
+// consumer key and secret.
+func checkTwitterApp(ctx context.Context) error {
+	req, err := http.NewRequest("POST", twitterAppTokenURL, strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(url.QueryEscape(TwitterConsumerKey), url.QueryEscape(TwitterConsumerSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("twitter rejected the app credentials: %v", resp.Status)
+	}
+	return nil
+}
+
+// diagnosticsHandler runs every diagnostic check and returns a JSON report of each subsystem,
+// surfacing misconfiguration immediately.  Its POST body should include:
+// auth - the Firebase token of an admin.
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	if !requireAdmin(ctx, w, dataClient) {
+		return
+	}
+	report := make(map[string]*subsystemStatus)
+	for name, check := range diagnosticChecks {
+		checkCtx, cancel := context.WithTimeout(ctx, diagnosticTimeout)
+		err := check(checkCtx)
+		cancel()
+		status := &subsystemStatus{OK: err == nil}
+		if err != nil {
+			status.Error = err.Error()
+		}
+		report[name] = status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
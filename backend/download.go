@@ -0,0 +1,463 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// downloadPrefix builds a completed graph on demand with caller-chosen options.
+const downloadPrefix = "/download"
+
+// exportOptionNames lists the request parameters read by parseExportOptions.
+var exportOptionNames = []string{"compact", "images", "maxEdges", "layout", "createdAfter", "createdBefore", "largestComponentOnly", "relationship", "minDegree", "degreeExcludesRoot", "minFollowers", "weightEdges", "rootEdgeWeight", "edgeWeight", "suppressSelf", "tagSelfLoops", "sequentialIDs", "mode"}
+
+// hasExportOptions reports whether the request sets any export option.
+func hasExportOptions(r *http.Request) bool {
+	for _, name := range exportOptionNames {
+		if r.FormValue(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// maxEdgeWeight and minEdgeWeight bound the edge weights a request may set; weights outside
+// them are clamped.
+const maxEdgeWeight = 1000.0
+const minEdgeWeight = 0.001
+
+// parseBoolParam sets *field from the named request parameter, if present.
+func parseBoolParam(r *http.Request, name string, field *bool) error {
+	if v := r.FormValue(name); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%v must be true or false", name)
+		}
+		*field = b
+	}
+	return nil
+}
+
+// parseCountParam sets *field from the named request parameter, if present, which must be a
+// non-negative integer.
+func parseCountParam(r *http.Request, name string, field *int) error {
+	if v := r.FormValue(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%v must be a non-negative integer", name)
+		}
+		*field = n
+	}
+	return nil
+}
+
+// parseWeightParam sets *field from the named request parameter, if present, which must be a
+// positive number.  It is clamped between minEdgeWeight and maxEdgeWeight.
+func parseWeightParam(r *http.Request, name string, field *float64) (bool, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return false, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(f > 0) {
+		return false, fmt.Errorf("%v must be a positive number", name)
+	}
+	*field = math.Max(minEdgeWeight, math.Min(maxEdgeWeight, f))
+	return true, nil
+}
+
+// parseExportOptions overrides base with the optional export settings in the request:
+// compact - "true" to omit descriptions and profile URLs
+// images - "false" to omit profile image URLs, which are otherwise the 400x400 variant
+// maxEdges - the most edges to write, or 0 for all of them
+// layout - "true" to include initial node positions
+// createdAfter, createdBefore - a date (2006-01-02) or RFC 3339 time bounding account creation
+// largestComponentOnly - "true" to keep only the root and the largest connected component
+// relationship - "friends" or "followers" to keep only that side of the root's network
+// minDegree - the fewest edges an account needs to be kept
+// degreeExcludesRoot - "true" to leave edges to the root out of minDegree
+// minFollowers - the fewest followers a fetched account needs to be kept; the root always is
+// weightEdges - "true" to weight edges, by default 0.1 for edges touching the root and 1 otherwise
+// rootEdgeWeight, edgeWeight - positive weights overriding those defaults; either one implies weightEdges
+// tagSelfLoops - "true" to tag edges from an account to itself with self_loop; false by default
+// suppressSelf - the former name of tagSelfLoops, still accepted
+// sequentialIDs - "true" to write node IDs as integers from 0 rather than TwitterIDs
+// mode - "mutual" for an undirected graph of only the reciprocated follows, or "directed",
+// the default.
+// The request's own values are checked by validateExportOptions apart from base, so a bad
+// value cannot hide behind a valid one in base, and then combined with base and checked again.
+func parseExportOptions(r *http.Request, base ExportOptions) (*ExportOptions, error) {
+	requested := &ExportOptions{}
+	if err := applyExportParams(r, requested); err != nil {
+		return nil, err
+	}
+	if err := validateExportOptions(requested); err != nil {
+		return nil, err
+	}
+	opts := &base
+	if err := applyExportParams(r, opts); err != nil {
+		return nil, err
+	}
+	if err := validateExportOptions(opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// applyExportParams overrides opts with the export settings present in the request, as
+// listed for parseExportOptions.  The parameters are read in a fixed order, so the first
+// invalid one is always the one reported.
+func applyExportParams(r *http.Request, opts *ExportOptions) error {
+	for _, param := range []struct {
+		name  string
+		field *bool
+	}{
+		{"compact", &opts.Compact},
+		{"degreeExcludesRoot", &opts.DegreeExcludesRoot},
+		{"largestComponentOnly", &opts.LargestComponentOnly},
+		{"layout", &opts.Layout},
+		{"sequentialIDs", &opts.SequentialIDs},
+		{"suppressSelf", &opts.TagSelfLoops},
+		{"tagSelfLoops", &opts.TagSelfLoops},
+		{"weightEdges", &opts.WeightEdges},
+	} {
+		if err := parseBoolParam(r, param.name, param.field); err != nil {
+			return err
+		}
+	}
+	images := !opts.OmitImages
+	if err := parseBoolParam(r, "images", &images); err != nil {
+		return err
+	}
+	opts.OmitImages = !images
+	for _, param := range []struct {
+		name  string
+		field *int
+	}{
+		{"maxEdges", &opts.MaxEdges},
+		{"minDegree", &opts.MinDegree},
+		{"minFollowers", &opts.MinFollowers},
+	} {
+		if err := parseCountParam(r, param.name, param.field); err != nil {
+			return err
+		}
+	}
+	for _, param := range []struct {
+		name  string
+		field *float64
+	}{
+		{"edgeWeight", &opts.EdgeWeight},
+		{"rootEdgeWeight", &opts.RootEdgeWeight},
+	} {
+		set, err := parseWeightParam(r, param.name, param.field)
+		if err != nil {
+			return err
+		}
+		if set {
+			opts.WeightEdges = true
+		}
+	}
+	switch relationship := r.FormValue("relationship"); relationship {
+	case "":
+	case relationshipFriends, relationshipFollowers:
+		opts.Relationship = relationship
+	default:
+		return fmt.Errorf("relationship must be %v or %v", relationshipFriends, relationshipFollowers)
+	}
+	switch mode := r.FormValue("mode"); mode {
+	case "":
+	case "directed":
+		opts.Mode = ""
+	case exportModeMutual:
+		opts.Mode = mode
+	default:
+		return fmt.Errorf("mode must be directed or %v", exportModeMutual)
+	}
+	for _, param := range []struct {
+		name  string
+		field *time.Time
+	}{
+		{"createdAfter", &opts.CreatedAfter},
+		{"createdBefore", &opts.CreatedBefore},
+	} {
+		if v := r.FormValue(param.name); v != "" {
+			t, err := parseDateParam(v)
+			if err != nil {
+				return fmt.Errorf("%v must be a date like 2006-01-02 or an RFC 3339 time", param.name)
+			}
+			*param.field = t
+		}
+	}
+	return nil
+}
+
+// validateExportOptions rejects combinations of options that cannot be honored together.
+func validateExportOptions(opts *ExportOptions) error {
+	if opts.DegreeExcludesRoot && opts.MinDegree == 0 {
+		return fmt.Errorf("degreeExcludesRoot requires minDegree")
+	}
+	if !opts.CreatedAfter.IsZero() && !opts.CreatedBefore.IsZero() && !opts.CreatedAfter.Before(opts.CreatedBefore) {
+		return fmt.Errorf("createdAfter must be before createdBefore")
+	}
+	return nil
+}
+
+// parseExportFormat reads the format of the request, or base when it sets none, checking it
+// suits the export options.  An empty base means GML.
+func parseExportFormat(r *http.Request, base string, opts *ExportOptions) (string, error) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = base
+	}
+	switch format {
+	case "":
+		return "gml", nil
+	case "zip":
+		if opts.Relationship != "" {
+			return "", fmt.Errorf("format zip already splits by relationship")
+		}
+		return format, nil
+	case "gml", "graphml", "gexf", "matrix.csv", "csv", "cytoscape":
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format %v", format)
+	}
+}
+
+// buildSplitArchive returns a zip archive holding GML files of the full graph and of its
+// friends and followers subgraphs, each built with opts.
+func buildSplitArchive(rootHandle *RootHandle, fetchedHandles []*FetchedHandle, opts *ExportOptions) ([]byte, error) {
+	b := new(bytes.Buffer)
+	archive := zip.NewWriter(b)
+	for _, relationship := range []string{"", relationshipFriends, relationshipFollowers} {
+		name := rootHandle.Node.ScreenName + ".gml"
+		if relationship != "" {
+			name = rootHandle.Node.ScreenName + "-" + relationship + ".gml"
+		}
+		memberOpts := *opts
+		memberOpts.Relationship = relationship
+		f, err := archive.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(buildGephiFile(rootHandle, fetchedHandles, &memberOpts)); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// parseDateParam parses a query parameter holding either a date, taken as midnight UTC, or
+// an RFC 3339 time.
+func parseDateParam(v string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of the request allows gzip, that is
+// names it without a q value of zero.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipContent returns content compressed with gzip.
+func gzipContent(content []byte) ([]byte, error) {
+	b := new(bytes.Buffer)
+	writer := gzip.NewWriter(b)
+	if _, err := writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// writeDownload writes content as the response body, gzip encoded when the client accepts it.
+// The encoding is transparent to browsers, which save the decoded file under its own name.
+func writeDownload(w http.ResponseWriter, r *http.Request, content []byte) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := gzip.NewWriter(w)
+		defer writer.Close()
+		writer.Write(content)
+		return
+	}
+	w.Write(content)
+}
+
+// graphOwner returns the LoginID whose graph the request reads: the signed in user's own, or
+// the one named by the user parameter when an admin asks.  On failure it writes the response
+// and returns false.
+func graphOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ctx := r.Context()
+	loginID := loginIDFromContext(ctx)
+	user := r.FormValue("user")
+	if user == "" || user == loginID {
+		return loginID, true
+	}
+	// Admins may be listed in the firestore, so only this check needs a client.
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return "", false
+	}
+	defer dataClient.Close()
+	if !requireAdmin(ctx, w, dataClient) {
+		return "", false
+	}
+	return user, true
+}
+
+// downloadHandler builds the graph file of a completed handle from the firestore, applying
+// the export options in the query over those saved with the job.  Unlike the file stored when
+// the fetch completes, this reflects the options of each request.  Jobs saved without export
+// options take the owner's preferences instead, as does the format.  Text formats are UTF-8
+// without a byte order mark and use LF line endings, and are gzip encoded for clients that
+// accept it.  The request should include:
+// auth - the Firebase token
+// id - the TwitterID of the handle
+// format - optionally, "gml" (the default), "graphml", "gexf", "cytoscape" for Cytoscape.js JSON,
+// "matrix.csv" for small graphs, "csv" for an edge list or "zip" for GML files of the full
+// graph, the friends subgraph and the followers subgraph
+// user - optionally, the owning LoginID when an admin downloads another user's graph.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ownerID, ok := graphOwner(w, r)
+	if !ok {
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, ownerID, r.FormValue("id"))
+	if err != nil {
+		writeHandlerError(w, "could not find identified user", err)
+		return
+	}
+	if !rootHandle.Node.Done {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "graph is not ready")
+		return
+	}
+	// The owner's preferences apply to jobs saved without export options of their own.
+	owner, err := getApplicationUser(ctx, dataClient, ownerID)
+	if err != nil {
+		writeHandlerError(w, "failed to load user", err)
+		return
+	}
+	base := rootHandle.ExportOptions
+	baseFormat := ""
+	if owner != nil {
+		if base == (ExportOptions{}) {
+			base = owner.ExportOptions
+		}
+		baseFormat = owner.ExportFormat
+	}
+	opts, err := parseExportOptions(r, base)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid options: %v", err)
+		return
+	}
+	format, err := parseExportFormat(r, baseFormat, opts)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid options: %v", err)
+		return
+	}
+	fetchedHandles, err := getDoneJobs(ctx, dataClient, rootHandle)
+	if err != nil {
+		writeHandlerError(w, "error getting handles", err)
+		return
+	}
+	var content []byte
+	switch format {
+	case "gml":
+		content = buildGephiFile(rootHandle, fetchedHandles, opts)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	case "graphml":
+		content = buildGraphMLFile(rootHandle, fetchedHandles, opts)
+		w.Header().Set("Content-Type", "application/graphml+xml; charset=utf-8")
+	case "gexf":
+		content = buildGEXFFile(rootHandle, fetchedHandles, opts)
+		w.Header().Set("Content-Type", "application/gexf+xml; charset=utf-8")
+	case "cytoscape":
+		content, err = buildCytoscapeJSON(rootHandle, fetchedHandles, opts)
+		if err != nil {
+			writeHandlerError(w, "failed to build graph", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	case "matrix.csv":
+		content, err = buildMatrixCSV(rootHandle, fetchedHandles, opts)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid options: %v; choose another format or filter the graph", err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case "csv":
+		content, err = buildCSVFile(rootHandle, fetchedHandles, opts)
+		if err != nil {
+			writeHandlerError(w, "failed to build edge list", err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case "zip":
+		content, err = buildSplitArchive(rootHandle, fetchedHandles, opts)
+		if err != nil {
+			writeHandlerError(w, "failed to build archive", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+	}
+	extension := format
+	if format == "cytoscape" {
+		extension = "cyjs.json"
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(rootHandle.Node.ScreenName+"."+extension))
+	if format == "zip" {
+		// The archive is already compressed.
+		w.Write(content)
+		return
+	}
+	writeDownload(w, r, content)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseExportOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		base    ExportOptions
+		want    ExportOptions
+		wantErr bool
+	}{
+		{name: "empty", query: "", want: ExportOptions{}},
+		{name: "base kept", query: "", base: ExportOptions{Compact: true, MinDegree: 2}, want: ExportOptions{Compact: true, MinDegree: 2}},
+		{name: "request overrides base", query: "compact=false&minDegree=3", base: ExportOptions{Compact: true, MinDegree: 2}, want: ExportOptions{MinDegree: 3}},
+		{name: "bools", query: "layout=true&largestComponentOnly=1&sequentialIDs=true", want: ExportOptions{Layout: true, LargestComponentOnly: true, SequentialIDs: true}},
+		{name: "bad bool", query: "compact=yes", wantErr: true},
+		{name: "images off", query: "images=false", want: ExportOptions{OmitImages: true}},
+		{name: "images on over base", query: "images=true", base: ExportOptions{OmitImages: true}, want: ExportOptions{}},
+		{name: "counts", query: "maxEdges=10&minFollowers=5", want: ExportOptions{MaxEdges: 10, MinFollowers: 5}},
+		{name: "count not a number", query: "minDegree=abc", wantErr: true},
+		{name: "negative count", query: "minDegree=-5", wantErr: true},
+		{name: "weight implies weightEdges", query: "edgeWeight=2", want: ExportOptions{EdgeWeight: 2, WeightEdges: true}},
+		{name: "weight clamped high", query: "rootEdgeWeight=5000", want: ExportOptions{RootEdgeWeight: maxEdgeWeight, WeightEdges: true}},
+		{name: "weight clamped low", query: "rootEdgeWeight=0.00001", want: ExportOptions{RootEdgeWeight: minEdgeWeight, WeightEdges: true}},
+		{name: "zero weight", query: "edgeWeight=0", wantErr: true},
+		{name: "weight not a number", query: "edgeWeight=heavy", wantErr: true},
+		{name: "relationship", query: "relationship=friends", want: ExportOptions{Relationship: relationshipFriends}},
+		{name: "bad relationship", query: "relationship=cousins", wantErr: true},
+		{name: "mutual mode", query: "mode=mutual", want: ExportOptions{Mode: exportModeMutual}},
+		{name: "directed mode over base", query: "mode=directed", base: ExportOptions{Mode: exportModeMutual}, want: ExportOptions{}},
+		{name: "bad mode", query: "mode=sideways", wantErr: true},
+		{name: "dates", query: "createdAfter=2010-01-01&createdBefore=2012-06-01T12:00:00Z", want: ExportOptions{
+			CreatedAfter:  time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC),
+			CreatedBefore: time.Date(2012, 6, 1, 12, 0, 0, 0, time.UTC),
+		}},
+		{name: "bad date", query: "createdAfter=last+year", wantErr: true},
+		{name: "dates out of order", query: "createdAfter=2012-01-01&createdBefore=2010-01-01", wantErr: true},
+		{name: "request dates out of order with base", query: "createdAfter=2012-01-01", base: ExportOptions{CreatedBefore: time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)}, wantErr: true},
+		{name: "degreeExcludesRoot with minDegree", query: "degreeExcludesRoot=true&minDegree=2", want: ExportOptions{DegreeExcludesRoot: true, MinDegree: 2}},
+		{name: "degreeExcludesRoot alone", query: "degreeExcludesRoot=true", wantErr: true},
+		{name: "degreeExcludesRoot behind base minDegree", query: "degreeExcludesRoot=true", base: ExportOptions{MinDegree: 2}, wantErr: true},
+		{name: "minDegree cleared under base degreeExcludesRoot", query: "minDegree=0", base: ExportOptions{DegreeExcludesRoot: true, MinDegree: 2}, wantErr: true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/download?"+tt.query, nil)
+		got, err := parseExportOptions(r, tt.base)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: parseExportOptions(%q) error = %v, want error %v", tt.name, tt.query, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%v: parseExportOptions(%q) = %+v, want %+v", tt.name, tt.query, *got, tt.want)
+		}
+	}
+}
+
+func TestParseExportFormat(t *testing.T) {
+	tests := []struct {
+		query   string
+		base    string
+		opts    ExportOptions
+		want    string
+		wantErr bool
+	}{
+		{query: "", want: "gml"},
+		{query: "", base: "gexf", want: "gexf"},
+		{query: "format=graphml", base: "gexf", want: "graphml"},
+		{query: "format=matrix.csv", want: "matrix.csv"},
+		{query: "format=zip", want: "zip"},
+		{query: "format=zip", opts: ExportOptions{Relationship: relationshipFollowers}, wantErr: true},
+		{query: "format=pdf", wantErr: true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/download?"+tt.query, nil)
+		got, err := parseExportFormat(r, tt.base, &tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseExportFormat(%q, %q) error = %v, want error %v", tt.query, tt.base, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseExportFormat(%q, %q) = %q, want %q", tt.query, tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestBuildMatrixCSVRejectsLargeGraphs(t *testing.T) {
+	var ids []string
+	var fetchedHandles []*FetchedHandle
+	for i := 0; i < maxMatrixNodes; i++ {
+		id := strconv.Itoa(i + 2)
+		ids = append(ids, id)
+		fetchedHandles = append(fetchedHandles, testHandle(id, 10))
+	}
+	root := testRoot("1", ids...)
+	if _, err := buildMatrixCSV(root, fetchedHandles, &ExportOptions{}); err == nil {
+		t.Errorf("buildMatrixCSV() of %v nodes succeeded, want an error", maxMatrixNodes+1)
+	}
+	if _, err := buildMatrixCSV(root, fetchedHandles[:maxMatrixNodes-1], &ExportOptions{}); err != nil {
+		t.Errorf("buildMatrixCSV() of %v nodes error = %v", maxMatrixNodes, err)
+	}
+}
+
+func TestParseExportOptionsReportsTheFirstInvalidParameter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/download?minFollowers=x&minDegree=y&maxEdges=z", nil)
+	for i := 0; i < 20; i++ {
+		_, err := parseExportOptions(r, ExportOptions{})
+		if err == nil || err.Error() != "maxEdges must be a non-negative integer" {
+			t.Fatalf("parseExportOptions() error = %v, want the maxEdges error", err)
+		}
+	}
+}
+
+func TestTagSelfLoopsParameters(t *testing.T) {
+	for _, query := range []string{"tagSelfLoops=true", "suppressSelf=true"} {
+		r := httptest.NewRequest("GET", "/download?"+query, nil)
+		opts, err := parseExportOptions(r, ExportOptions{})
+		if err != nil || !opts.TagSelfLoops {
+			t.Errorf("parseExportOptions(%q) = %+v, %v, want TagSelfLoops", query, opts, err)
+		}
+		if !hasExportOptions(r) {
+			t.Errorf("hasExportOptions(%q) = false, want true", query)
+		}
+	}
+}
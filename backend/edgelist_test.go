@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBuildCSVFileEscapesScreenNames(t *testing.T) {
+	root := testRoot("1", "2")
+	root.Node.ScreenName = "root"
+	handle := testHandle("2", 10)
+	handle.Node.ScreenName = `comma, "quoted"`
+	content, err := buildCSVFile(root, []*FetchedHandle{handle}, &ExportOptions{})
+	if err != nil {
+		t.Fatalf("buildCSVFile() error = %v", err)
+	}
+	if !strings.Contains(string(content), `"comma, ""quoted"""`) {
+		t.Errorf("buildCSVFile() = %q, want the screen name quoted with its quotes doubled", content)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the CSV back: %v", err)
+	}
+	if len(rows) < 2 {
+		t.Fatalf("buildCSVFile() wrote %v rows, want a header and edges", len(rows))
+	}
+	if got := strings.Join(rows[0], ","); got != "source,target,source_screenname,target_screenname" {
+		t.Errorf("header = %q", got)
+	}
+	for _, row := range rows[1:] {
+		if len(row) != 4 {
+			t.Fatalf("row %q has %v fields, want 4", row, len(row))
+		}
+		names := map[string]string{row[0]: row[2], row[1]: row[3]}
+		if names["2"] != handle.Node.ScreenName || names["1"] != "root" {
+			t.Errorf("row %q does not read back the screen names", row)
+		}
+	}
+}
+
+func TestBuildCSVFileLeavesIDsUnquoted(t *testing.T) {
+	root := testRoot("1", "2", "3")
+	content, err := buildCSVFile(root, []*FetchedHandle{testHandle("2", 10), testHandle("3", 10)}, &ExportOptions{})
+	if err != nil {
+		t.Fatalf("buildCSVFile() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.SplitN(line, ",", 3)
+		for _, id := range fields[:2] {
+			if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+				t.Errorf("line %q has ID column %q, want an unquoted number", line, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// ErrNotConnected is returned when a user has not stored any Twitter credentials.
+var ErrNotConnected = errors.New("twitter account not connected")
+
+// ErrRateLimited is returned when Twitter refuses a call because the rate limit was exceeded.
+var ErrRateLimited = errors.New("rate limited by twitter")
+
+// ErrHandleNotFound is returned when a handle does not exist on Twitter or in the firestore.
+var ErrHandleNotFound = errors.New("handle not found")
+
+// ErrAlreadyExists is returned when a handle is already being fetched.
+var ErrAlreadyExists = errors.New("handle already being fetched")
+
+// ErrAppUnavailable is returned while the Twitter app's circuit breaker is open.
+var ErrAppUnavailable = errors.New("twitter app temporarily unavailable")
+
+// ErrProtected is returned when the ID lists of a protected account cannot be read with the
+// user's credentials.
+var ErrProtected = errors.New("account is protected")
+
+// ErrInvalidHandle is returned for a handle that cannot name any Twitter account.
+var ErrInvalidHandle = errors.New("invalid handle")
+
+// ErrSettingLocked is returned when a job setting can no longer change without corrupting
+// the state of the crawl.
+var ErrSettingLocked = errors.New("setting can no longer be changed")
+
+// ErrInvalidBackup is returned for a backup that cannot be decoded or whose records are out
+// of order.
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// twitterRateLimitCode is the Twitter API error code for an exceeded rate limit.
+const twitterRateLimitCode = 88
+
+// twitterNotAuthorizedCode is the Twitter API error code for content of a protected account.
+const twitterNotAuthorizedCode = 179
+
+// twitterBadAuthCode and twitterInvalidTokenCode are the Twitter API error codes of a 401 for
+// credentials that Twitter does not accept.
+const (
+	twitterBadAuthCode      = 32
+	twitterInvalidTokenCode = 89
+)
+
+// isProtectedError reports whether a call was refused because the account is protected.
+// Twitter answers those with a 401 carrying no error code, or code 179, unlike the 401s for
+// bad credentials, which carry twitterBadAuthCode or twitterInvalidTokenCode.
+func isProtectedError(resp *http.Response, err error) bool {
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	e, ok := err.(twitter.APIError)
+	return !ok || len(e.Errors) == 0 || e.Errors[0].Code == twitterNotAuthorizedCode
+}
+
+// transientError marks a failed Twitter call worth retrying: a network failure or a 5xx
+// status, such as Twitter's over capacity response.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+// isTransientError reports whether err was marked transient by wrapTwitterError.
+func isTransientError(err error) bool {
+	var t *transientError
+	return errors.As(err, &t)
+}
+
+// RateLimitError is an ErrRateLimited that carries when the rate limit window resets, as
+// reported by the x-rate-limit-reset header of the refused call.
+type RateLimitError struct {
+	Reset time.Time
+	Err   error
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrRateLimited, e.Err)
+}
+
+// Is makes errors.Is(err, ErrRateLimited) hold for a RateLimitError.
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// rateLimited reports whether resp refused a call for exceeding the rate limit, either with a
+// 429 status or by having no calls remaining, and when the limit resets.  The reset is zero
+// when the response does not carry it.  resp may be nil.
+func rateLimited(resp *http.Response) (bool, time.Time) {
+	if resp == nil {
+		return false, time.Time{}
+	}
+	var reset time.Time
+	if v, err := strconv.ParseInt(resp.Header.Get("x-rate-limit-reset"), 10, 64); err == nil {
+		reset = time.Unix(v, 0)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true, reset
+	}
+	if resp.StatusCode >= 400 && resp.Header.Get("x-rate-limit-remaining") == "0" {
+		return true, reset
+	}
+	return false, time.Time{}
+}
+
+// wrapTwitterError classifies an error returned by the Twitter client along with its
+// response, wrapping it in a RateLimitError, ErrProtected or a transientError when
+// appropriate.  Other errors, including the permanent ones, are returned as they are.  resp
+// may be nil.
+func wrapTwitterError(resp *http.Response, err error) error {
+	limited, reset := rateLimited(resp)
+	e, ok := err.(twitter.APIError)
+	if ok && len(e.Errors) > 0 && e.Errors[0].Code == twitterRateLimitCode {
+		limited = true
+	}
+	if limited {
+		return &RateLimitError{Reset: reset, Err: err}
+	}
+	if isProtectedError(resp, err) {
+		return fmt.Errorf("%w: %v", ErrProtected, err)
+	}
+	// An open circuit breaker fails calls without a response too, but retrying cannot help.
+	if (resp == nil && !errors.Is(err, ErrAppUnavailable)) || (resp != nil && resp.StatusCode >= 500) {
+		return &transientError{err: err}
+	}
+	return err
+}
+
+// retryAfterSeconds returns the whole seconds until a rate limited err may be retried, and
+// false when err carries no reset time.
+func retryAfterSeconds(err error, now time.Time) (int, bool) {
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) || rateLimitErr.Reset.IsZero() {
+		return 0, false
+	}
+	seconds := int(math.Ceil(rateLimitErr.Reset.Sub(now).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds, true
+}
+
+// wrapFirestoreError classifies an error returned by the firestore, wrapping it in
+// ErrHandleNotFound or ErrAlreadyExists when appropriate.
+func wrapFirestoreError(err error) error {
+	switch grpc.Code(err) {
+	case codes.NotFound:
+		return fmt.Errorf("%w: %v", ErrHandleNotFound, err)
+	case codes.AlreadyExists:
+		return fmt.Errorf("%w: %v", ErrAlreadyExists, err)
+	}
+	return err
+}
+
+// httpStatusForError picks the HTTP status a handler should respond with for err.
+func httpStatusForError(err error) int {
+	switch {
+	case errors.Is(err, ErrNotConnected):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrInvalidHandle), errors.Is(err, ErrInvalidBackup):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrHandleNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAlreadyExists), errors.Is(err, ErrSettingLocked):
+		return http.StatusConflict
+	case errors.Is(err, ErrProtected):
+		return http.StatusForbidden
+	case errors.Is(err, ErrAppUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// rateLimitStatus returns the job status shown while err, a rate limited error, holds the
+// job back.
+func rateLimitStatus(err error) string {
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) && !rateLimitErr.Reset.IsZero() {
+		return fmt.Sprintf("Rate limited, resuming at %v", rateLimitErr.Reset.UTC().Format("15:04 MST"))
+	}
+	return "Rate limited, resuming shortly"
+}
+
+// writeHandlerError responds to the request with the status matching err, prefixing
+// the message with what was being attempted.  Rate limited responses say when to retry.
+func writeHandlerError(w http.ResponseWriter, attempted string, err error) {
+	if seconds, ok := retryAfterSeconds(err, time.Now()); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	w.WriteHeader(httpStatusForError(err))
+	fmt.Fprintf(w, "%v: %v", attempted, err)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// apiError returns a Twitter API error carrying the given code.
+func apiError(code int) error {
+	return twitter.APIError{Errors: []twitter.ErrorDetail{{Code: code, Message: "error"}}}
+}
+
+func TestIsProtectedError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   bool
+	}{
+		{name: "401 without code", status: http.StatusUnauthorized, err: twitter.APIError{}, want: true},
+		{name: "401 without API error", status: http.StatusUnauthorized, err: errors.New("unauthorized"), want: true},
+		{name: "401 not authorized", status: http.StatusUnauthorized, err: apiError(twitterNotAuthorizedCode), want: true},
+		{name: "401 bad credentials", status: http.StatusUnauthorized, err: apiError(32)},
+		{name: "401 invalid token", status: http.StatusUnauthorized, err: apiError(89)},
+		{name: "404", status: http.StatusNotFound, err: apiError(50)},
+		{name: "no response", err: errors.New("connection reset")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var resp *http.Response
+			if test.status != 0 {
+				resp = &http.Response{StatusCode: test.status}
+			}
+			if got := isProtectedError(resp, test.err); got != test.want {
+				t.Errorf("isProtectedError() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	reset := time.Date(2020, 1, 2, 15, 4, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		status      int
+		remaining   string
+		reset       string
+		wantLimited bool
+		wantReset   time.Time
+	}{
+		{name: "429 with reset", status: http.StatusTooManyRequests, reset: strconv.FormatInt(reset.Unix(), 10), wantLimited: true, wantReset: reset},
+		{name: "429 without reset", status: http.StatusTooManyRequests, wantLimited: true},
+		{name: "error with none remaining", status: http.StatusBadRequest, remaining: "0", reset: strconv.FormatInt(reset.Unix(), 10), wantLimited: true, wantReset: reset},
+		{name: "success with none remaining", status: http.StatusOK, remaining: "0", reset: strconv.FormatInt(reset.Unix(), 10)},
+		{name: "error with some remaining", status: http.StatusBadRequest, remaining: "3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: test.status, Header: http.Header{}}
+			if test.remaining != "" {
+				resp.Header.Set("x-rate-limit-remaining", test.remaining)
+			}
+			if test.reset != "" {
+				resp.Header.Set("x-rate-limit-reset", test.reset)
+			}
+			limited, gotReset := rateLimited(resp)
+			if limited != test.wantLimited || !gotReset.Equal(test.wantReset) {
+				t.Errorf("rateLimited() = %v, %v, want %v, %v", limited, gotReset, test.wantLimited, test.wantReset)
+			}
+		})
+	}
+	if limited, _ := rateLimited(nil); limited {
+		t.Errorf("rateLimited(nil) = true, want false")
+	}
+}
+
+func TestRateLimitStatus(t *testing.T) {
+	reset := time.Date(2020, 1, 2, 15, 4, 0, 0, time.FixedZone("EST", -5*60*60))
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"reset known", &RateLimitError{Reset: reset, Err: errors.New("429")}, "Rate limited, resuming at 20:04 UTC"},
+		{"reset wrapped", fmt.Errorf("fetching followers: %w", &RateLimitError{Reset: reset, Err: errors.New("429")}), "Rate limited, resuming at 20:04 UTC"},
+		{"reset unknown", &RateLimitError{Err: errors.New("429")}, "Rate limited, resuming shortly"},
+	}
+	for _, test := range tests {
+		if got := rateLimitStatus(test.err); got != test.want {
+			t.Errorf("%v: rateLimitStatus() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// estimatePrefix estimates the Twitter API calls a crawl of a handle would make.  It is also
+// served with a trailing slash, as estimateSlashPrefix.
+const estimatePrefix = "/estimate"
+
+// estimateSlashPrefix is estimatePrefix with a trailing slash.
+const estimateSlashPrefix = estimatePrefix + "/"
+
+// idsPageSize is the number of IDs returned per page of friends/ids and followers/ids.
+const idsPageSize = 5000
+
+// lookupBatchSize is the number of users a single users/lookup call hydrates.
+const lookupBatchSize = 100
+
+// CallEstimate is the expected number of Twitter API calls of a crawl, by endpoint.  Counts of
+// handles are upper bounds, since accounts that are both friends and followers are only
+// crawled once but the overlap is unknown until the IDs are collected.
+type CallEstimate struct {
+	TwitterID      string `json:"twitter_id"`
+	ScreenName     string `json:"screen_name"`
+	FriendsCount   int    `json:"friends_count"`
+	FollowersCount int    `json:"followers_count"`
+	// Handles is the most handles the crawl would hydrate.
+	Handles int `json:"handles"`
+	// SecondHopHandles is how many of them a two hop crawl would enqueue from the lists of the
+	// first hop.  Those lists are unknown in advance, so the second hop is assumed to fill the
+	// room maxExpandedNodes leaves, as it does for all but the smallest networks.
+	SecondHopHandles int `json:"second_hop_handles,omitempty"`
+	// Calls breaks estimated_api_calls down by endpoint.
+	Calls             map[string]int `json:"calls"`
+	EstimatedAPICalls int            `json:"estimated_api_calls"`
+	// LookupHydrationCalls is how many users/lookup calls hydration takes, lookupBatchSize
+	// handles at a time.  It is kept for clients that read it; calls carries the same count.
+	LookupHydrationCalls int `json:"lookup_hydration_calls"`
+	// Ticks is the fewest worker ticks the crawl takes, and EstimatedMinutes the least time
+	// those take at the cron cadence.  Both are minimums: they assume the job is the user's
+	// only one, is never rate limited and that the worker reaches its user on every tick,
+	// which USERS_PER_TICK does not promise, and they leave out the extra pages of hubs.
+	Ticks            int `json:"ticks"`
+	EstimatedMinutes int `json:"estimated_minutes"`
+}
+
+// tickMinutes and tickedMinutes describe the worker cadence: cron ticks each job once a
+// minute, but workerHandler skips the tick on minutes divisible by ten, so only tickedMinutes
+// of every tickMinutes advance a job.
+const (
+	tickMinutes   = 10
+	tickedMinutes = 9
+)
+
+// pagesFor returns the pages of IDs needed to list count accounts, at most maxPages if set.
+func pagesFor(count int, maxPages int) int {
+	pages := (count + idsPageSize - 1) / idsPageSize
+	if maxPages > 0 && pages > maxPages {
+		pages = maxPages
+	}
+	return pages
+}
+
+// estimateCalls computes the calls a crawl of user with opts would make.  Handles are hydrated
+// lookupBatchSize at a time by users/lookup, and since their counts are unknown in advance each
+// is counted as one page each of friends/ids and followers/ids, plus a timeline call when
+// tweets are sampled.  A two hop crawl adds the second hop, which is only looked up.  Hubs with
+// more than idsPageSize IDs take further pages, and suspended and deleted accounts an extra
+// users/show call each, neither of which is counted.
+func estimateCalls(user *twitter.User, opts *jobOptions) *CallEstimate {
+	friendPages := pagesFor(user.FriendsCount, opts.MaxFriendPages)
+	followerPages := pagesFor(user.FollowersCount, opts.MaxFollowerPages)
+	friends := user.FriendsCount
+	if friends > friendPages*idsPageSize {
+		friends = friendPages * idsPageSize
+	}
+	followers := user.FollowersCount
+	if followers > followerPages*idsPageSize {
+		followers = followerPages * idsPageSize
+	}
+	handles := friends + followers
+	if opts.MutualOnly {
+		handles = friends
+		if followers < handles {
+			handles = followers
+		}
+	}
+	secondHop := 0
+	if opts.Depth >= 2 && maxExpandedNodes > handles {
+		secondHop = maxExpandedNodes - handles
+	}
+	lookups := (handles + secondHop + lookupBatchSize - 1) / lookupBatchSize
+	e := &CallEstimate{
+		TwitterID:        user.IDStr,
+		ScreenName:       user.ScreenName,
+		FriendsCount:     user.FriendsCount,
+		FollowersCount:   user.FollowersCount,
+		Handles:          handles + secondHop,
+		SecondHopHandles: secondHop,
+		Calls: map[string]int{
+			"users/show":    1,
+			"users/lookup":  lookups,
+			"friends/ids":   friendPages + handles,
+			"followers/ids": followerPages + handles,
+		},
+		LookupHydrationCalls: lookups,
+	}
+	if opts.TweetSampleSize > 0 {
+		e.Calls["statuses/user_timeline"] = 1 + handles + secondHop
+	}
+	for _, calls := range e.Calls {
+		e.EstimatedAPICalls += calls
+	}
+	// A tick collects one page of the root's IDs, or hydrates a batch in which only one handle
+	// pages its own ID lists, so every handle takes a tick.  Second hop handles page no lists and
+	// are hydrated a batch per tick.  One more tick enqueues the handles and another builds the
+	// graph.
+	e.Ticks = friendPages + followerPages + 1 + handles + (secondHop+lookupBatchSize-1)/lookupBatchSize + 1
+	e.EstimatedMinutes = (e.Ticks*tickMinutes + tickedMinutes - 1) / tickedMinutes
+	return e
+}
+
+// estimateHandler resolves a handle and returns a CallEstimate for crawling it with the given
+// options as JSON, including the least time the crawl would take, without enqueuing anything.
+// Its POST body should include:
+// auth - the Firebase token
+// handle - the screen name or numeric ID to estimate
+// tweets, order, exclude, maxFollowerPages, maxFriendPages, mutual, depth - optionally, the job
+// options the crawl would use.
+func estimateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	opts, err := parseJobOptions(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid options: %v", err)
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	client, counter, err := newUserTwitterClient(ctx, dataClient, loginID)
+	if err != nil {
+		writeHandlerError(w, "failed to connect Twitter", err)
+		return
+	}
+	user, err := getTwitterUserByHandle(ctx, client, r.FormValue("handle"))
+	auditCredentialUse(ctx, dataClient, loginID, "estimate", r.FormValue("handle"), counter)
+	if err != nil {
+		writeHandlerError(w, "failed to load handle", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimateCalls(user, opts))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Jobs with IncrementalBuild set write one fragment per hydrated handle to Cloud Storage as the
+// crawl progresses, so the final build only has to stitch fragments together and a failed final
+// build can be retried without losing what was assembled.  A fragment is the JSON encoding of a
+// hydrated FetchedHandle stored at graphs/{LoginID}/{TwitterID}.fragments/{FetchedTwitterID}.json.
+// Fragments are deleted once the finished graph is written.
+
+// getFragmentPrefix returns the object name prefix shared by all fragments of rootHandle.
+func getFragmentPrefix(rootHandle *RootHandle) string {
+	return "graphs/" + rootHandle.LoginID + "/" + rootHandle.Node.TwitterID + ".fragments/"
+}
+
+// writeFragment stores the hydrated handle as a fragment of rootHandle's graph, replacing any
+// earlier fragment of the same handle.
+func writeFragment(ctx context.Context, bucket *storage.BucketHandle, rootHandle *RootHandle, fetchedHandle *FetchedHandle) error {
+	content, err := json.Marshal(fetchedHandle)
+	if err != nil {
+		return err
+	}
+	writer := bucket.Object(getFragmentPrefix(rootHandle) + fetchedHandle.Node.TwitterID + ".json").NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(content); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// readFragments loads every fragment of rootHandle's graph.
+func readFragments(ctx context.Context, bucket *storage.BucketHandle, rootHandle *RootHandle) ([]*FetchedHandle, error) {
+	var fetchedHandles []*FetchedHandle
+	iter := bucket.Objects(ctx, &storage.Query{Prefix: getFragmentPrefix(rootHandle)})
+	for {
+		attrs, err := iter.Next()
+		if err == iterator.Done {
+			return fetchedHandles, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		reader, err := bucket.Object(attrs.Name).NewReader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var fetchedHandle FetchedHandle
+		err = json.NewDecoder(reader).Decode(&fetchedHandle)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		fetchedHandles = append(fetchedHandles, &fetchedHandle)
+	}
+}
+
+// readGraphHandles loads the hydrated handles of rootHandle's graph from its fragments.  A
+// fragment is written only after its handle is committed as done, so a failed write leaves the
+// fragments short of the done handles; the handles are then read from the firestore instead.
+func readGraphHandles(ctx context.Context, bucket *storage.BucketHandle, client *firestore.Client, rootHandle *RootHandle) ([]*FetchedHandle, error) {
+	fragments, err := readFragments(ctx, bucket, rootHandle)
+	if err != nil {
+		return nil, err
+	}
+	doneIDs, err := getDoneJobIDs(ctx, client, rootHandle)
+	if err != nil {
+		return nil, err
+	}
+	if fragmentsMatch(fragments, doneIDs) {
+		return fragments, nil
+	}
+	logInfof("fragments of %v do not match its %v done handles, reading the firestore", rootHandle.Node.TwitterID, len(doneIDs))
+	return getDoneJobs(ctx, client, rootHandle)
+}
+
+// fragmentsMatch reports whether fragments hold exactly the handles with the given IDs.
+func fragmentsMatch(fragments []*FetchedHandle, ids []string) bool {
+	if len(fragments) != len(ids) {
+		return false
+	}
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	for _, fragment := range fragments {
+		if !want[fragment.Node.TwitterID] {
+			return false
+		}
+		delete(want, fragment.Node.TwitterID)
+	}
+	return len(want) == 0
+}
+
+// deleteFragments removes every fragment of rootHandle's graph.
+func deleteFragments(ctx context.Context, bucket *storage.BucketHandle, rootHandle *RootHandle) error {
+	iter := bucket.Objects(ctx, &storage.Query{Prefix: getFragmentPrefix(rootHandle)})
+	for {
+		attrs, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := bucket.Object(attrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+}
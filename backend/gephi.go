@@ -4,57 +4,643 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
-// buildGephiFile walks the datastore and returns a byte array containing a GML file
-// describing the graph it found.
-func buildGephiFile(rootHandle *RootHandle, fetchedHandles []*FetchedHandle) []byte {
-	m := make(map[string]bool)
-	m[rootHandle.Node.TwitterID] = true
-	for _, friendID := range rootHandle.Node.FriendIDs {
-		m[friendID] = true
+// ExportOptions tunes how a graph is rendered.  The zero value renders every attribute.
+type ExportOptions struct {
+	// Compact drops the description and profile URLs from each node, keeping only
+	// what structural analysis needs.
+	Compact bool
+	// OmitImages leaves the profile image out of every node, for exports that should not
+	// point at anyone's picture.
+	OmitImages bool
+	// MaxEdges caps the number of edges written.  Edges touching the root are kept
+	// first, then the rest in order of source and target ID.  Zero means no cap.
+	MaxEdges int
+	// Layout assigns initial positions, with the root at the center and its network on a
+	// ring around it, so the graph opens with a sensible shape before a layout algorithm runs.
+	Layout bool
+	// CreatedAfter and CreatedBefore, when set, leave out accounts created outside that range,
+	// along with their edges.  Accounts without a known creation date are left out too.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// LargestComponentOnly keeps the root and the largest connected component of the rest of
+	// the graph, dropping scattered accounts that connect to nothing but the root.
+	LargestComponentOnly bool
+	// MinDegree leaves out accounts with fewer edges than this, counting edges in either
+	// direction.  DegreeExcludesRoot leaves the edge to the root out of the count, since every
+	// account has one, so the filter reflects how embedded an account is in the wider network.
+	MinDegree          int
+	DegreeExcludesRoot bool
+	// MinFollowers leaves out fetched accounts with fewer followers than this, along with
+	// their edges, trimming the long tail of a large network.  The root is always kept.
+	MinFollowers int
+	// Relationship limits the graph to the root's friends (relationshipFriends) or its
+	// followers (relationshipFollowers).  Empty keeps both.
+	Relationship string
+	// WeightEdges gives each edge a weight, RootEdgeWeight for edges touching the root and
+	// EdgeWeight for the rest, so force-directed layouts are pulled by community structure
+	// rather than by the root.  Zero weights take defaultRootEdgeWeight and defaultEdgeWeight.
+	WeightEdges    bool
+	RootEdgeWeight float64
+	EdgeWeight     float64
+	// SequentialIDs writes node IDs as integers counting from 0, the root first and the rest in
+	// ascending TwitterID order, for tools that mishandle 64-bit IDs.  user_id still holds the
+	// TwitterID.
+	SequentialIDs bool
+	// TagSelfLoops tags edges from an account to itself with self_loop; nothing is left out.
+	// It is off by default, which writes the edges exactly as they were fetched.  The root is
+	// written once either way, even when its own account was fetched again as one of its
+	// friends or followers.  It is stored under SuppressSelf, its former name, so saved jobs
+	// keep it.
+	TagSelfLoops bool `firestore:"SuppressSelf"`
+	// Mode is exportModeMutual to write an undirected graph of only the reciprocated follows,
+	// one edge per pair.  Empty keeps every follow as a directed edge, tagging those whose
+	// reverse is also in the graph as mutual.
+	Mode string
+}
+
+// relationshipFriends and relationshipFollowers are the values of ExportOptions.Relationship.
+const relationshipFriends = "friends"
+const relationshipFollowers = "followers"
+
+// exportModeMutual is the value of ExportOptions.Mode for graphs of reciprocated follows.
+const exportModeMutual = "mutual"
+
+// defaultRootEdgeWeight and defaultEdgeWeight are the edge weights used when WeightEdges is
+// set without explicit weights.
+const defaultRootEdgeWeight = 0.1
+const defaultEdgeWeight = 1.0
+
+// edgeWeight returns the weight of edge in a graph rooted at rootID.
+func (opts *ExportOptions) edgeWeight(edge graphEdge, rootID string) float64 {
+	if edge.Source == rootID || edge.Target == rootID {
+		if opts.RootEdgeWeight > 0 {
+			return opts.RootEdgeWeight
+		}
+		return defaultRootEdgeWeight
+	}
+	if opts.EdgeWeight > 0 {
+		return opts.EdgeWeight
+	}
+	return defaultEdgeWeight
+}
+
+// createdInRange reports whether n was created within the range set in opts.  The root is
+// never filtered.
+func (opts *ExportOptions) createdInRange(n *GephiNode) bool {
+	if opts.CreatedAfter.IsZero() && opts.CreatedBefore.IsZero() {
+		return true
+	}
+	created, err := parseTwitterTime(n.CreatedAt)
+	if err != nil {
+		return false
+	}
+	if !opts.CreatedAfter.IsZero() && created.Before(opts.CreatedAfter) {
+		return false
+	}
+	if !opts.CreatedBefore.IsZero() && !created.Before(opts.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// textNormalizer rewrites CR and CRLF line endings as LF and drops byte order marks.
+var textNormalizer = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\ufeff", "")
+
+// normalizeText prepares free text fetched from Twitter, such as descriptions and tweets, for
+// an export.  Exports are UTF-8 without a byte order mark and end lines with LF alone, since
+// some tools misread the CRLF endings or stray BOMs pasted into profiles.
+func normalizeText(s string) string {
+	return textNormalizer.Replace(s)
+}
+
+// defaultProfileImageURL replaces an empty profile image, which suspended and deleted
+// placeholders always have.  When DEFAULT_PROFILE_IMAGE_URL is unset the attribute is omitted.
+var defaultProfileImageURL = os.Getenv("DEFAULT_PROFILE_IMAGE_URL")
+
+// profileImageURL returns the image to export for n, or "" if the attribute should be omitted.
+func profileImageURL(n *GephiNode, opts *ExportOptions) string {
+	if opts.OmitImages {
+		return ""
+	}
+	if n.ProfileImageURL == "" {
+		return defaultProfileImageURL
+	}
+	return largeProfileImageURL(n.ProfileImageURL)
+}
+
+// largeProfileImageURL rewrites the 48px "_normal" variant Twitter reports for a profile image
+// to the "_400x400" variant of the same image, which renders legibly as a node.  Other URLs are
+// returned unchanged.
+func largeProfileImageURL(url string) string {
+	i := strings.LastIndex(url, "_normal")
+	if i < 0 || i < strings.LastIndex(url, "/") {
+		return url
+	}
+	rest := url[i+len("_normal"):]
+	if rest != "" && (rest[0] != '.' || strings.Contains(rest, "/")) {
+		return url
+	}
+	return url[:i] + "_400x400" + rest
+}
+
+// layoutSpacing is the distance between neighbouring nodes on the layout ring.
+const layoutSpacing = 20.0
+
+// nodePosition is an initial x/y coordinate for a node.
+type nodePosition struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// graphEdge is a directed edge between two TwitterIDs.  Mutual marks a follow that is
+// reciprocated; in an undirected graph every edge is.
+type graphEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Mutual bool   `json:"mutual,omitempty"`
+}
+
+// graphData holds the nodes and edges an exporter writes, after export options are applied.
+type graphData struct {
+	Root         *RootHandle
+	Nodes        []*GephiNode
+	Edges        []graphEdge
+	EdgesDropped int
+	// NodesDropped counts the accounts removed by ExportOptions.MinFollowers, MinDegree and
+	// LargestComponentOnly, and ComponentsDropped the components removed by the latter.
+	NodesDropped      int
+	ComponentsDropped int
+	// Positions holds the initial coordinates by TwitterID when ExportOptions.Layout is set.
+	Positions map[string]nodePosition
+	// Seeds holds the root handles of the graphs combined by mergeGraphs, and Root is nil.
+	Seeds []*RootHandle
+	// IDs maps each TwitterID to the ID written for it when ExportOptions.SequentialIDs is set.
+	IDs map[string]string
+	// Undirected is set for the graphs of ExportOptions.Mode exportModeMutual.
+	Undirected bool
+}
+
+// nodeID returns the ID an exporter writes for the node with the given TwitterID.
+func (g *graphData) nodeID(twitterID string) string {
+	if id, ok := g.IDs[twitterID]; ok {
+		return id
+	}
+	return twitterID
+}
+
+// sequentialIDs numbers the nodes from 0, keeping the first node, the root, at 0 and
+// ordering the rest by numeric TwitterID so the mapping is the same on every export.
+func sequentialIDs(nodes []*GephiNode) map[string]string {
+	ids := make(map[string]string, len(nodes))
+	if len(nodes) == 0 {
+		return ids
+	}
+	rest := make([]*GephiNode, len(nodes)-1)
+	copy(rest, nodes[1:])
+	sort.Slice(rest, func(i, j int) bool {
+		a, b := rest[i].TwitterID, rest[j].TwitterID
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	ids[nodes[0].TwitterID] = "0"
+	for i, n := range rest {
+		if _, ok := ids[n.TwitterID]; !ok {
+			ids[n.TwitterID] = strconv.Itoa(i + 1)
+		}
+	}
+	return ids
+}
+
+// roots returns the root handles the graph was collected from.
+func (g *graphData) roots() []*RootHandle {
+	if g.Root != nil {
+		return []*RootHandle{g.Root}
+	}
+	return g.Seeds
+}
+
+// rootID returns the TwitterID of the root, or "" for a merged graph.
+func (g *graphData) rootID() string {
+	if g.Root == nil {
+		return ""
+	}
+	return g.Root.Node.TwitterID
+}
+
+// seedNames maps the TwitterID of each seed of a merged graph to its screen name.
+func (g *graphData) seedNames() map[string]string {
+	seeds := make(map[string]string, len(g.Seeds))
+	for _, seed := range g.Seeds {
+		seeds[seed.Node.TwitterID] = seed.Node.ScreenName
+	}
+	return seeds
+}
+
+// collectGraph gathers the root and fetched handles into the nodes and edges of a graph,
+// applying the export options.  Every exporter renders the result of collectGraph so that
+// all formats describe the same graph.
+func collectGraph(rootHandle *RootHandle, fetchedHandles []*FetchedHandle, opts *ExportOptions) *graphData {
+	m := validIDs(rootHandle)
+	for _, fetchedHandle := range fetchedHandles {
+		// Second hop handles reach the graph through the lists of the first hop.
+		if fetchedHandle.Hop >= 2 {
+			m[fetchedHandle.Node.TwitterID] = true
+		}
+	}
+	if opts.Relationship != "" {
+		ids := rootHandle.Node.FriendIDs
+		if opts.Relationship == relationshipFollowers {
+			ids = rootHandle.Node.FollowerIDs
+		}
+		related := map[string]bool{rootHandle.Node.TwitterID: true}
+		for _, id := range ids {
+			related[id] = true
+		}
+		for id := range m {
+			if !related[id] {
+				delete(m, id)
+			}
+		}
+	}
+	for _, fetchedHandle := range fetchedHandles {
+		if !opts.createdInRange(&fetchedHandle.Node) {
+			delete(m, fetchedHandle.Node.TwitterID)
+		}
 	}
-	for _, followerID := range rootHandle.Node.FollowerIDs {
-		m[followerID] = true
+	rootID := rootHandle.Node.TwitterID
+	followersDropped := 0
+	if opts.MinFollowers > 0 {
+		kept := filterHandles(fetchedHandles, opts.MinFollowers)
+		keptIDs := make(map[string]bool, len(kept))
+		for _, fetchedHandle := range kept {
+			keptIDs[fetchedHandle.Node.TwitterID] = true
+		}
+		for _, fetchedHandle := range fetchedHandles {
+			id := fetchedHandle.Node.TwitterID
+			if id != rootID && !keptIDs[id] && m[id] {
+				delete(m, id)
+				followersDropped++
+			}
+		}
+		fetchedHandles = kept
+	}
+	e := computeEdgeSet(m, rootHandle, fetchedHandles)
+	g := &graphData{Root: rootHandle, Undirected: opts.Mode == exportModeMutual, NodesDropped: followersDropped}
+	if g.Undirected {
+		keepMutualEdges(e)
+	}
+	if opts.MinDegree > 0 {
+		degrees := computeDegrees(e, rootID, opts.DegreeExcludesRoot)
+		for id := range m {
+			if id != rootID && degrees[id] < opts.MinDegree {
+				delete(m, id)
+				g.NodesDropped++
+			}
+		}
+		filterEdgeSet(e, m)
+	}
+	if opts.LargestComponentOnly {
+		kept, components := largestComponent(m, rootID, e)
+		if components > 1 {
+			g.ComponentsDropped = components - 1
+		}
+		for id := range m {
+			if id != rootID && !kept[id] {
+				delete(m, id)
+				g.NodesDropped++
+			}
+		}
+		filterEdgeSet(e, m)
+	}
+	g.Edges, g.EdgesDropped = capEdges(e, rootHandle.Node.TwitterID, opts.MaxEdges, g.Undirected)
+	g.Nodes = append(g.Nodes, &rootHandle.Node)
+	// The root may also appear among its own fetched handles, and a handle may be
+	// saved twice when it is both followed and following.  Gephi rejects
+	// duplicate node ids, so each user is written once.
+	emitted := map[string]bool{rootID: true}
+	for _, fetchedHandle := range fetchedHandles {
+		id := fetchedHandle.Node.TwitterID
+		if !m[id] || emitted[id] {
+			continue
+		}
+		emitted[id] = true
+		g.Nodes = append(g.Nodes, &fetchedHandle.Node)
+	}
+	if opts.Layout {
+		g.Positions = circularLayout(g.Nodes)
+	}
+	if opts.SequentialIDs {
+		g.IDs = sequentialIDs(g.Nodes)
+	}
+	return g
+}
+
+// filterHandles returns the handles with at least minFollowers followers, in their original
+// order.  A minFollowers of zero keeps them all.
+func filterHandles(handles []*FetchedHandle, minFollowers int) []*FetchedHandle {
+	if minFollowers <= 0 {
+		return handles
 	}
+	kept := make([]*FetchedHandle, 0, len(handles))
+	for _, handle := range handles {
+		if handle.Node.FollowersCount >= minFollowers {
+			kept = append(kept, handle)
+		}
+	}
+	return kept
+}
+
+// computeDegrees counts the edges of each node in either direction, leaving out edges touching
+// the root when excludeRoot is set.
+func computeDegrees(edgeSet map[string]bool, rootID string, excludeRoot bool) map[string]int {
+	degrees := make(map[string]int)
+	for edge := range edgeSet {
+		splits := strings.Split(edge, " ")
+		if excludeRoot && (splits[0] == rootID || splits[1] == rootID) {
+			continue
+		}
+		degrees[splits[0]]++
+		degrees[splits[1]]++
+	}
+	return degrees
+}
+
+// keepMutualEdges reduces the edge set to the reciprocated follows, keeping each pair once
+// under the key whose source sorts first.
+func keepMutualEdges(edgeSet map[string]bool) {
+	mutual := make(map[string]bool)
+	for edge := range edgeSet {
+		splits := strings.Split(edge, " ")
+		if splits[0] < splits[1] && edgeSet[splits[1]+" "+splits[0]] {
+			mutual[edge] = true
+		}
+	}
+	for edge := range edgeSet {
+		if !mutual[edge] {
+			delete(edgeSet, edge)
+		}
+	}
+}
+
+// filterEdgeSet removes the edges whose endpoints are no longer in m.
+func filterEdgeSet(edgeSet map[string]bool, m map[string]bool) {
+	for edge := range edgeSet {
+		splits := strings.Split(edge, " ")
+		if !m[splits[0]] || !m[splits[1]] {
+			delete(edgeSet, edge)
+		}
+	}
+}
+
+// circularLayout places the first node, the root, at the origin and spaces the others evenly
+// on rings whose radius grows with their number.  The root's own friends and followers form
+// the inner ring and the second hop of a two hop crawl, which only neighbours the first, an
+// outer ring around it.
+func circularLayout(nodes []*GephiNode) map[string]nodePosition {
+	positions := make(map[string]nodePosition, len(nodes))
+	if len(nodes) == 0 {
+		return positions
+	}
+	positions[nodes[0].TwitterID] = nodePosition{}
+	var inner, outer []*GephiNode
+	for _, n := range nodes[1:] {
+		if n.Relationship == "SecondHop" {
+			outer = append(outer, n)
+		} else {
+			inner = append(inner, n)
+		}
+	}
+	radius := placeRing(positions, inner, layoutSpacing)
+	placeRing(positions, outer, radius+layoutSpacing)
+	return positions
+}
+
+// placeRing spaces the nodes evenly on a ring of at least minRadius, returning its radius.
+func placeRing(positions map[string]nodePosition, ring []*GephiNode, minRadius float64) float64 {
+	radius := math.Max(minRadius, layoutSpacing*float64(len(ring))/(2*math.Pi))
+	for i, n := range ring {
+		angle := 2 * math.Pi * float64(i) / float64(len(ring))
+		positions[n.TwitterID] = nodePosition{X: radius * math.Cos(angle), Y: radius * math.Sin(angle)}
+	}
+	return radius
+}
+
+// buildGephiFile walks the datastore and returns a byte array containing a GML file
+// describing the graph it found.
+func buildGephiFile(rootHandle *RootHandle, fetchedHandles []*FetchedHandle, opts *ExportOptions) []byte {
+	return writeGephiGraph(collectGraph(rootHandle, fetchedHandles, opts), opts)
+}
+
+// writeGephiGraph renders a collected graph as a GML file.
+func writeGephiGraph(g *graphData, opts *ExportOptions) []byte {
 	w := new(bytes.Buffer)
 	fmt.Fprintf(w, `graph [
-  directed 1`)
-	writeNode(w, &rootHandle.Node)
-	for _, fetchedHandle := range fetchedHandles {
-		writeNode(w, &fetchedHandle.Node)
+  directed %v`, gmlBool(!g.Undirected))
+	if g.EdgesDropped > 0 {
+		fmt.Fprintf(w, `
+  edges_dropped %v`, g.EdgesDropped)
+	}
+	if g.NodesDropped > 0 {
+		fmt.Fprintf(w, `
+  nodes_dropped %v`, g.NodesDropped)
+	}
+	if g.ComponentsDropped > 0 {
+		fmt.Fprintf(w, `
+  components_dropped %v`, g.ComponentsDropped)
+	}
+	// Sampled collections are flagged so the graph is not mistaken for the full network.
+	followersTruncated, friendsTruncated := false, false
+	for _, root := range g.roots() {
+		followersTruncated = followersTruncated || root.FollowersTruncated
+		friendsTruncated = friendsTruncated || root.FriendsTruncated
 	}
+	if followersTruncated {
+		fmt.Fprintf(w, `
+  followers_truncated 1`)
+	}
+	if friendsTruncated {
+		fmt.Fprintf(w, `
+  friends_truncated 1`)
+	}
+	for _, root := range g.roots() {
+		if root.ExpansionTruncated {
+			fmt.Fprintf(w, `
+  expansion_truncated 1`)
+			break
+		}
+	}
+	seeds := g.seedNames()
+	for _, n := range g.Nodes {
+		writeNode(w, g, n, opts, seeds)
+	}
+	writeEdges(w, g, opts)
+	fmt.Fprintf(w, "\n]")
+	return w.Bytes()
+}
+
+// validIDs returns the set of TwitterIDs that may appear in the graph of rootHandle: the root
+// itself and its friends and followers, or only its mutual follows for a MutualOnly job, less any
+// blocked accounts.
+func validIDs(rootHandle *RootHandle) map[string]bool {
+	m := make(map[string]bool)
+	if rootHandle.MutualOnly {
+		for _, mutualID := range mutualIDs(&rootHandle.Node) {
+			m[mutualID] = true
+		}
+	} else {
+		for _, friendID := range rootHandle.Node.FriendIDs {
+			m[friendID] = true
+		}
+		for _, followerID := range rootHandle.Node.FollowerIDs {
+			m[followerID] = true
+		}
+	}
+	// Blocked accounts are dropped along with any edges to them.
+	for _, blockedID := range rootHandle.Blocklist {
+		delete(m, blockedID)
+	}
+	m[rootHandle.Node.TwitterID] = true
+	return m
+}
+
+// computeEdgeSet returns the "source target" set of edges between valid IDs.
+func computeEdgeSet(m map[string]bool, rootHandle *RootHandle, fetchedHandles []*FetchedHandle) map[string]bool {
 	e := make(map[string]bool)
 	appendEdgeSet(e, m, &rootHandle.Node)
 	for _, fetchedHandle := range fetchedHandles {
 		appendEdgeSet(e, m, &fetchedHandle.Node)
 	}
-	writeEdges(w, e)
-	fmt.Fprintf(w, "\n]")
-	return w.Bytes()
+	return e
+}
+
+// GraphStats summarizes the size of a graph.
+type GraphStats struct {
+	Nodes int
+	Edges int
+}
+
+// computeGraphStats counts the nodes and edges of the graph stored for rootHandle when the
+// fetch completes, collected from the given handles with its ExportOptions.
+func computeGraphStats(rootHandle *RootHandle, fetchedHandles []*FetchedHandle) *GraphStats {
+	g := collectGraph(rootHandle, fetchedHandles, &rootHandle.ExportOptions)
+	return &GraphStats{Nodes: len(g.Nodes), Edges: len(g.Edges)}
+}
+
+// gmlEscaper escapes the characters that would end or corrupt a double-quoted GML string.
+var gmlEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// escapeGML prepares a value for a double-quoted GML string.  Backslashes and
+// double quotes are escaped with a backslash, which Gephi's parser decodes
+// back to the original text.  Line breaks, tabs and other control characters,
+// which end or corrupt a string there, become spaces or are dropped, as is
+// invalid UTF-8.
+func escapeGML(s string) string {
+	s = strings.ToValidUTF8(normalizeText(s), "")
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t' || r == '\u2028' || r == '\u2029':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+	return gmlEscaper.Replace(s)
 }
 
 // writeNode appends the node labels in the current GephiNode to the writer.
-// Literal double quotes are converted to single quotes because Gephi does
-// not appear to recognize escape sequences.
-func writeNode(w io.Writer, n *GephiNode) {
+// Every string passes through escapeGML.  Compact exports omit the free
+// text and URL attributes.  Nodes named in seeds are tagged as seeds of a merged graph.
+func writeNode(w io.Writer, g *graphData, n *GephiNode, opts *ExportOptions, seeds map[string]string) {
 	fmt.Fprintf(w, ` 
   node [ 
     id %v 
     user_id "%v" 
     label "%s" 
     type "%s" 
-    profile_url "%s"
-    description "%s"
-    profile_image_url "%s"
     friends %v 
-    followers %v 
-  ]`,
-		n.TwitterID, n.TwitterID, n.ScreenName, n.Relationship,
-		strings.Replace(n.ProfileURL, `"`, `'`, -1),
-		strings.Replace(n.Description, `"`, `'`, -1),
-		strings.Replace(n.ProfileImageURL, `"`, `'`, -1), n.FriendsCount, n.FollowersCount)
+    followers %v`,
+		g.nodeID(n.TwitterID), n.TwitterID, escapeGML(n.ScreenName), escapeGML(n.Relationship), n.FriendsCount, n.FollowersCount)
+	fmt.Fprintf(w, `
+    default_profile %v
+    default_profile_image %v
+    verified %v
+    statuses %v`, gmlBool(n.DefaultProfile), gmlBool(n.DefaultProfileImage), gmlBool(n.Verified), n.StatusesCount)
+	if createdAt := exportedCreatedAt(n); createdAt != "" {
+		fmt.Fprintf(w, `
+    created_at "%s"`, escapeGML(createdAt))
+	}
+	if n.Protected {
+		fmt.Fprintf(w, `
+    protected 1`)
+	}
+	if n.IsSelf {
+		fmt.Fprintf(w, `
+    is_self 1`)
+	}
+	if screenName, ok := seeds[n.TwitterID]; ok {
+		fmt.Fprintf(w, `
+    seed 1
+    seed_screen_name "%s"`, escapeGML(screenName))
+	}
+	if !opts.Compact {
+		fmt.Fprintf(w, `
+    profile_url "%s"
+    description "%s"`,
+			escapeGML(n.ProfileURL),
+			escapeGML(n.Description))
+		if image := profileImageURL(n, opts); image != "" {
+			fmt.Fprintf(w, `
+    profile_image_url "%s"`, escapeGML(image))
+		}
+		if n.ProfileBannerURL != "" {
+			fmt.Fprintf(w, `
+    profile_banner_url "%s"`, escapeGML(n.ProfileBannerURL))
+		}
+		if len(n.RecentTweets) > 0 {
+			// Sampled tweets are joined into a single attribute since GML has no lists of strings.
+			fmt.Fprintf(w, `
+    recent_tweets "%s"`, escapeGML(strings.Join(n.RecentTweets, " | ")))
+		}
+	}
+	if p, ok := g.Positions[n.TwitterID]; ok {
+		fmt.Fprintf(w, `
+    graphics [
+      x %.2f
+      y %.2f
+    ]`, p.X, p.Y)
+	}
+	fmt.Fprintf(w, `
+  ]`)
+}
+
+// exportedCreatedAt returns the creation time of n in RFC 3339, which sorts as text, or the
+// stored value if it cannot be parsed.
+func exportedCreatedAt(n *GephiNode) string {
+	created, err := parseTwitterTime(n.CreatedAt)
+	if err != nil {
+		return n.CreatedAt
+	}
+	return created.UTC().Format(time.RFC3339)
+}
+
+// gmlBool writes a boolean attribute as GML's 1 or 0.
+func gmlBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 // appendEdgeSet appends edges from the given GephiNode to the passed in set.
@@ -74,15 +660,61 @@ func appendEdgeSet(edgeSet map[string]bool, validIDs map[string]bool, n *GephiNo
 	}
 }
 
-// writeEdges appends the edges from the given edge set to the writer.
-func writeEdges(w io.Writer, edgeSet map[string]bool) {
-	for edge, _ := range edgeSet {
+// capEdges orders the edge set and trims it to at most maxEdges edges, returning the kept
+// edges and how many were dropped.  Edges incident to the root are kept before any others,
+// and each group is ordered by its "source target" key so the result is reproducible.
+// A maxEdges of zero keeps every edge.  Edges whose reverse is in the set are marked mutual,
+// as is every edge of an undirected set.
+func capEdges(edgeSet map[string]bool, rootID string, maxEdges int, undirected bool) ([]graphEdge, int) {
+	var rootEdges, otherEdges []string
+	for edge := range edgeSet {
 		splits := strings.Split(edge, " ")
+		if splits[0] == rootID || splits[1] == rootID {
+			rootEdges = append(rootEdges, edge)
+		} else {
+			otherEdges = append(otherEdges, edge)
+		}
+	}
+	sort.Strings(rootEdges)
+	sort.Strings(otherEdges)
+	keys := append(rootEdges, otherEdges...)
+	dropped := 0
+	if maxEdges > 0 && len(keys) > maxEdges {
+		dropped = len(keys) - maxEdges
+		keys = keys[:maxEdges]
+	}
+	edges := make([]graphEdge, 0, len(keys))
+	for _, key := range keys {
+		splits := strings.Split(key, " ")
+		mutual := undirected || edgeSet[splits[1]+" "+splits[0]]
+		edges = append(edges, graphEdge{Source: splits[0], Target: splits[1], Mutual: mutual})
+	}
+	return edges, dropped
+}
+
+// writeEdges appends the edges of g to the writer, weighted when opts.WeightEdges is set.
+// Reciprocated follows of a directed graph are tagged mutual.
+func writeEdges(w io.Writer, g *graphData, opts *ExportOptions) {
+	rootID := g.rootID()
+	for _, edge := range g.Edges {
 		fmt.Fprintf(w, ` 
   edge [ 
     source %v 
-    target %v 
-  ]`,
-			splits[0], splits[1])
+    target %v `,
+			g.nodeID(edge.Source), g.nodeID(edge.Target))
+		if opts.WeightEdges {
+			fmt.Fprintf(w, `
+    weight %v `, opts.edgeWeight(edge, rootID))
+		}
+		if opts.TagSelfLoops && edge.Source == edge.Target {
+			fmt.Fprintf(w, `
+    self_loop 1 `)
+		}
+		if edge.Mutual && !g.Undirected {
+			fmt.Fprintf(w, `
+    mutual 1 `)
+		}
+		fmt.Fprintf(w, `
+  ]`)
 	}
 }
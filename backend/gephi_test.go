@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testRoot returns a root handle followed by and following the given IDs.
+func testRoot(twitterID string, ids ...string) *RootHandle {
+	return &RootHandle{
+		Node: GephiNode{
+			TwitterID:   twitterID,
+			ScreenName:  "root",
+			FriendIDs:   ids,
+			FollowerIDs: ids,
+			Done:        true,
+		},
+	}
+}
+
+// testHandle returns a hydrated handle of the given ID.
+func testHandle(twitterID string, followers int) *FetchedHandle {
+	return &FetchedHandle{
+		Node: GephiNode{
+			TwitterID:      twitterID,
+			ScreenName:     "user" + twitterID,
+			FollowersCount: followers,
+			Done:           true,
+		},
+	}
+}
+
+func TestCollectGraphWritesRootOnce(t *testing.T) {
+	root := testRoot("1", "2", "3")
+	duplicate := testHandle("1", 10)
+	g := collectGraph(root, []*FetchedHandle{testHandle("2", 10), duplicate, testHandle("3", 10)}, &ExportOptions{})
+	count := 0
+	for _, n := range g.Nodes {
+		if n.TwitterID == "1" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("root appears %v times among the nodes, want 1", count)
+	}
+	if len(g.Nodes) != 3 {
+		t.Errorf("graph has %v nodes, want 3", len(g.Nodes))
+	}
+}
+
+// readGMLString decodes a double-quoted GML string body as Gephi's parser does, reporting
+// false if an unescaped quote or a line break would end or split it early.
+func readGMLString(s string) (string, bool) {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 == len(s) {
+				return "", false
+			}
+			i++
+			out = append(out, s[i])
+		case '"', '\n', '\r':
+			return "", false
+		default:
+			out = append(out, s[i])
+		}
+	}
+	return string(out), true
+}
+
+func TestEscapeGMLRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "plain", in: "hello", want: "hello"},
+		{name: "quote", in: `say "hi"`, want: `say "hi"`},
+		{name: "backslash", in: `C:\path\`, want: `C:\path\`},
+		{name: "escaped quote", in: `\"`, want: `\"`},
+		{name: "newline", in: "one\ntwo\r\nthree", want: "one two three"},
+		{name: "control", in: "bell\a", want: "bell"},
+		{name: "multibyte", in: "café ☕", want: "café ☕"},
+		{name: "truncated multibyte", in: "caf\xc3", want: "caf"},
+		{name: "description cut mid rune", in: truncateUTF8("naïve", 3), want: "na"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			escaped := escapeGML(test.in)
+			got, ok := readGMLString(escaped)
+			if !ok {
+				t.Fatalf("escapeGML(%q) = %q, which ends the GML string early", test.in, escaped)
+			}
+			if got != test.want {
+				t.Errorf("escapeGML(%q) reads back as %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLargeProfileImageURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://pbs.twimg.com/profile_images/1/abc_normal.jpg", "https://pbs.twimg.com/profile_images/1/abc_400x400.jpg"},
+		{"https://pbs.twimg.com/profile_images/1/abc_normal.jpeg", "https://pbs.twimg.com/profile_images/1/abc_400x400.jpeg"},
+		{"https://pbs.twimg.com/profile_images/1/abc_normal", "https://pbs.twimg.com/profile_images/1/abc_400x400"},
+		{"https://pbs.twimg.com/profile_images/1/abc_normal.png?format=png", "https://pbs.twimg.com/profile_images/1/abc_400x400.png?format=png"},
+		{"https://pbs.twimg.com/profile_images/1/abc_normal?format=png", "https://pbs.twimg.com/profile_images/1/abc_normal?format=png"},
+		{"https://pbs.twimg.com/_normal/abc.jpg", "https://pbs.twimg.com/_normal/abc.jpg"},
+		{"https://pbs.twimg.com/profile_images/1/abc_normalized.jpg", "https://pbs.twimg.com/profile_images/1/abc_normalized.jpg"},
+		{"https://pbs.twimg.com/profile_images/1/abc_bigger.jpg", "https://pbs.twimg.com/profile_images/1/abc_bigger.jpg"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := largeProfileImageURL(tt.url); got != tt.want {
+			t.Errorf("largeProfileImageURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestFilterHandles(t *testing.T) {
+	handles := []*FetchedHandle{testHandle("2", 5), testHandle("3", 50), testHandle("4", 10)}
+	tests := []struct {
+		minFollowers int
+		want         []string
+	}{
+		{minFollowers: 0, want: []string{"2", "3", "4"}},
+		{minFollowers: 10, want: []string{"3", "4"}},
+		{minFollowers: 51, want: nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, handle := range filterHandles(handles, tt.minFollowers) {
+			got = append(got, handle.Node.TwitterID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("filterHandles(%v) = %v, want %v", tt.minFollowers, got, tt.want)
+		}
+	}
+}
+
+func TestCollectGraphMinFollowersKeepsRootAndPrunesEdges(t *testing.T) {
+	root := testRoot("1", "2", "3")
+	g := collectGraph(root, []*FetchedHandle{testHandle("2", 5), testHandle("3", 50)}, &ExportOptions{MinFollowers: 10})
+	var nodes []string
+	for _, n := range g.Nodes {
+		nodes = append(nodes, n.TwitterID)
+	}
+	if want := []string{"1", "3"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("graph nodes = %v, want %v", nodes, want)
+	}
+	for _, e := range g.Edges {
+		if e.Source == "2" || e.Target == "2" {
+			t.Errorf("graph keeps edge %v -> %v of a dropped node", e.Source, e.Target)
+		}
+	}
+	if len(g.Edges) == 0 {
+		t.Errorf("graph has no edges, want those between the root and 3")
+	}
+	if g.NodesDropped != 1 {
+		t.Errorf("graph dropped %v nodes, want 1", g.NodesDropped)
+	}
+}
+
+func TestCapEdges(t *testing.T) {
+	edgeSet := map[string]bool{
+		"3 4": true,
+		"4 3": true,
+		"2 1": true,
+		"1 3": true,
+		"2 4": true,
+	}
+	tests := []struct {
+		maxEdges    int
+		want        []graphEdge
+		wantDropped int
+	}{
+		{maxEdges: 0, want: []graphEdge{
+			{Source: "1", Target: "3"},
+			{Source: "2", Target: "1"},
+			{Source: "2", Target: "4"},
+			{Source: "3", Target: "4", Mutual: true},
+			{Source: "4", Target: "3", Mutual: true},
+		}},
+		{maxEdges: 3, want: []graphEdge{
+			{Source: "1", Target: "3"},
+			{Source: "2", Target: "1"},
+			{Source: "2", Target: "4"},
+		}, wantDropped: 2},
+		{maxEdges: 1, want: []graphEdge{
+			{Source: "1", Target: "3"},
+		}, wantDropped: 4},
+	}
+	for _, tt := range tests {
+		got, dropped := capEdges(edgeSet, "1", tt.maxEdges, false)
+		if !reflect.DeepEqual(got, tt.want) || dropped != tt.wantDropped {
+			t.Errorf("capEdges(%v) = %v, %v dropped, want %v, %v dropped", tt.maxEdges, got, dropped, tt.want, tt.wantDropped)
+		}
+	}
+}
+
+func TestMaxEdgesRecordsDroppedEdges(t *testing.T) {
+	root := testRoot("1", "2", "3")
+	opts := &ExportOptions{MaxEdges: 2}
+	gml := string(buildGephiFile(root, []*FetchedHandle{testHandle("2", 10), testHandle("3", 10)}, opts))
+	if !strings.Contains(gml, "edges_dropped 2") {
+		t.Errorf("buildGephiFile() header does not record the 2 dropped edges:\n%v", gml)
+	}
+	if got := strings.Count(gml, "edge ["); got != 2 {
+		t.Errorf("buildGephiFile() wrote %v edges, want 2", got)
+	}
+}
+
+func TestCollectGraphDegreeExcludesRoot(t *testing.T) {
+	root := testRoot("1", "2", "3", "4")
+	linked := testHandle("2", 10)
+	linked.Node.FriendIDs = []string{"3"}
+	handles := []*FetchedHandle{linked, testHandle("3", 10), testHandle("4", 10)}
+	tests := []struct {
+		excludeRoot bool
+		want        []string
+	}{
+		{excludeRoot: false, want: []string{"1", "2", "3", "4"}},
+		{excludeRoot: true, want: []string{"1", "2", "3"}},
+	}
+	for _, tt := range tests {
+		g := collectGraph(root, handles, &ExportOptions{MinDegree: 1, DegreeExcludesRoot: tt.excludeRoot})
+		var nodes []string
+		for _, n := range g.Nodes {
+			nodes = append(nodes, n.TwitterID)
+		}
+		if !reflect.DeepEqual(nodes, tt.want) {
+			t.Errorf("degreeExcludesRoot=%v: graph nodes = %v, want %v", tt.excludeRoot, nodes, tt.want)
+		}
+	}
+}
+
+func TestTextExportsAreLFWithoutBOM(t *testing.T) {
+	root := testRoot("1", "2")
+	root.Node.Description = "\ufeffroot line one\r\nline two\rline three"
+	handle := testHandle("2", 10)
+	handle.Node.Description = "windows\r\ndescription\ufeff"
+	handle.Node.RecentTweets = []string{"tweet\r\none", "\ufefftweet two"}
+	handles := []*FetchedHandle{handle}
+	opts := &ExportOptions{}
+	exports := map[string]func() ([]byte, error){
+		"gml":     func() ([]byte, error) { return buildGephiFile(root, handles, opts), nil },
+		"gexf":    func() ([]byte, error) { return buildGEXFFile(root, handles, opts), nil },
+		"graphml": func() ([]byte, error) { return buildGraphMLFile(root, handles, opts), nil },
+		"csv":     func() ([]byte, error) { return buildCSVFile(root, handles, opts) },
+		"matrix":  func() ([]byte, error) { return buildMatrixCSV(root, handles, opts) },
+		"json":    func() ([]byte, error) { return buildCytoscapeJSON(root, handles, opts) },
+	}
+	for format, build := range exports {
+		content, err := build()
+		if err != nil {
+			t.Errorf("%v: %v", format, err)
+			continue
+		}
+		if strings.Contains(string(content), "\r") {
+			t.Errorf("%v export contains a carriage return", format)
+		}
+		if strings.Contains(string(content), "\ufeff") {
+			t.Errorf("%v export contains a byte order mark", format)
+		}
+	}
+}
+
+// gmlPair is one key and value of a parsed GML list.  A value is either text, with strings
+// decoded, or a nested list.
+type gmlPair struct {
+	Key  string
+	Text string
+	List []gmlPair
+}
+
+// parseGML reads a GML document strictly, as Gephi's parser would, failing on unbalanced
+// brackets, unterminated strings and keys without values.
+func parseGML(s string) ([]gmlPair, error) {
+	list, rest, err := parseGMLList(s, false)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("trailing text %.20q", rest)
+	}
+	return list, nil
+}
+
+// parseGMLList reads key value pairs up to the end of s, or up to the closing bracket when
+// nested, returning the text after it.
+func parseGMLList(s string, nested bool) ([]gmlPair, string, error) {
+	var list []gmlPair
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			if nested {
+				return nil, "", errors.New("unclosed list")
+			}
+			return list, "", nil
+		}
+		if s[0] == ']' {
+			if !nested {
+				return nil, "", errors.New("unbalanced ]")
+			}
+			return list, s[1:], nil
+		}
+		end := strings.IndexAny(s, " \t\r\n")
+		if end <= 0 {
+			return nil, "", fmt.Errorf("key %.20q without a value", s)
+		}
+		pair := gmlPair{Key: s[:end]}
+		s = strings.TrimLeft(s[end:], " \t\r\n")
+		switch {
+		case s == "":
+			return nil, "", fmt.Errorf("key %.40q without a value", pair.Key)
+		case s[0] == '[':
+			var err error
+			if pair.List, s, err = parseGMLList(s[1:], true); err != nil {
+				return nil, "", err
+			}
+		case s[0] == '"':
+			closing := 1
+			for ; closing < len(s) && s[closing] != '"'; closing++ {
+				if s[closing] == '\\' {
+					closing++
+				}
+			}
+			if closing >= len(s) {
+				return nil, "", fmt.Errorf("unterminated string in %.40q", pair.Key)
+			}
+			text, ok := readGMLString(s[1:closing])
+			if !ok {
+				return nil, "", fmt.Errorf("string of %.40q is split by a line break", pair.Key)
+			}
+			pair.Text, s = text, s[closing+1:]
+		default:
+			end := strings.IndexAny(s, " \t\r\n[]\"")
+			if end < 0 {
+				end = len(s)
+			}
+			if _, err := strconv.ParseFloat(s[:end], 64); err != nil {
+				return nil, "", fmt.Errorf("value %.40q of %.40q is not a number", s[:end], pair.Key)
+			}
+			pair.Text, s = s[:end], s[end:]
+		}
+		list = append(list, pair)
+	}
+}
+
+func TestBuildGephiFileWithAdversarialProfiles(t *testing.T) {
+	long := strings.Repeat(`"]x\`, 50000)
+	tests := []struct {
+		name        string
+		description string
+		want        string
+	}{
+		{name: "quotes", description: `she said "hi" and \"bye\"`, want: `she said "hi" and \"bye\"`},
+		{name: "brackets", description: `] ] node [ id 99 ] [`, want: `] ] node [ id 99 ] [`},
+		{name: "newlines", description: "one\ntwo\r\nthree\rfour", want: "one two three four"},
+		{name: "null bytes", description: "null\x00byte\x00", want: "nullbyte"},
+		{name: "long", description: long, want: long},
+		{name: "rtl and emoji", description: "\u202eשלום مرحبا 👩\u200d👩\u200d👧 🏳\ufe0f\u200d🌈", want: "\u202eשלום مرحبا 👩\u200d👩\u200d👧 🏳\ufe0f\u200d🌈"},
+		{name: "invalid utf-8", description: "bad\xff\xfebytes", want: "badbytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := testRoot("1", "2")
+			handle := testHandle("2", 10)
+			handle.Node.Description = tt.description
+			handle.Node.ScreenName = tt.description
+			handle.Node.RecentTweets = []string{tt.description}
+			doc, err := parseGML(string(buildGephiFile(root, []*FetchedHandle{handle}, &ExportOptions{})))
+			if err != nil {
+				t.Fatalf("buildGephiFile() is not well-formed: %v", err)
+			}
+			if len(doc) != 1 || doc[0].Key != "graph" {
+				t.Fatalf("buildGephiFile() = %v top-level pairs, want one graph", len(doc))
+			}
+			nodes, edges := 0, 0
+			for _, pair := range doc[0].List {
+				switch pair.Key {
+				case "node":
+					nodes++
+					values := make(map[string]string)
+					for _, attr := range pair.List {
+						values[attr.Key] = attr.Text
+					}
+					if values["id"] != "2" {
+						continue
+					}
+					for _, key := range []string{"label", "description", "recent_tweets"} {
+						if values[key] != tt.want {
+							t.Errorf("%v reads back as %.40q, want %.40q", key, values[key], tt.want)
+						}
+					}
+				case "edge":
+					edges++
+				}
+			}
+			if nodes != 2 || edges != 2 {
+				t.Errorf("buildGephiFile() has %v nodes and %v edges, want 2 and 2", nodes, edges)
+			}
+		})
+	}
+}
+
+func TestTagSelfLoops(t *testing.T) {
+	root := testRoot("1", "2")
+	looped := testHandle("2", 10)
+	looped.Node.FriendIDs = []string{"2"}
+	handles := []*FetchedHandle{looped}
+	exports := []struct {
+		format string
+		build  func(opts *ExportOptions) ([]byte, error)
+		tag    string
+	}{
+		{"gml", func(opts *ExportOptions) ([]byte, error) { return buildGephiFile(root, handles, opts), nil }, "self_loop 1"},
+		{"graphml", func(opts *ExportOptions) ([]byte, error) { return buildGraphMLFile(root, handles, opts), nil }, `<edge source="2" target="2"><data key="self_loop">true</data>`},
+		{"gexf", func(opts *ExportOptions) ([]byte, error) { return buildGEXFFile(root, handles, opts), nil }, `source="2" target="2"><attvalues><attvalue for="self_loop" value="true"/>`},
+		{"json", func(opts *ExportOptions) ([]byte, error) { return buildCytoscapeJSON(root, handles, opts) }, `"self_loop":true`},
+	}
+	for _, export := range exports {
+		for _, tag := range []bool{false, true} {
+			content, err := export.build(&ExportOptions{TagSelfLoops: tag})
+			if err != nil {
+				t.Errorf("%v: %v", export.format, err)
+				continue
+			}
+			if got := strings.Count(string(content), export.tag); got != map[bool]int{false: 0, true: 1}[tag] {
+				t.Errorf("%v with TagSelfLoops %v tags %v self loops, want one only when set:\n%s", export.format, tag, got, content)
+			}
+		}
+	}
+}
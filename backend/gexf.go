@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gexfAttribute declares a typed GEXF node attribute.  Attributes that are not Compact are left
+// out of compact exports, as with graphMLKeys.
+type gexfAttribute struct {
+	ID      string
+	Type    string
+	Compact bool
+}
+
+// gexfAttributes lists the node attributes in the order they are written.  The screen name is
+// the node label and the position is written with the viz module, so neither is listed.
+var gexfAttributes = []gexfAttribute{
+	{ID: "user_id", Type: "string", Compact: true},
+	{ID: "relationship", Type: "string", Compact: true},
+	{ID: "friends", Type: "integer", Compact: true},
+	{ID: "followers", Type: "integer", Compact: true},
+	{ID: "is_self", Type: "boolean", Compact: true},
+	{ID: "default_profile", Type: "boolean", Compact: true},
+	{ID: "default_profile_image", Type: "boolean", Compact: true},
+	{ID: "verified", Type: "boolean", Compact: true},
+	{ID: "statuses", Type: "integer", Compact: true},
+	{ID: "created_at", Type: "string", Compact: true},
+	{ID: "protected", Type: "boolean", Compact: true},
+	{ID: "profile_url", Type: "anyURI"},
+	{ID: "description", Type: "string"},
+	{ID: "profile_image_url", Type: "anyURI"},
+	{ID: "profile_banner_url", Type: "anyURI"},
+	{ID: "recent_tweets", Type: "string"},
+}
+
+// gexfStart returns the creation time of n as a GEXF dateTime, which opens the node's spell on
+// the Gephi timeline, or "" if it is unknown.
+func gexfStart(n *GephiNode) string {
+	created, err := parseTwitterTime(n.CreatedAt)
+	if err != nil {
+		return ""
+	}
+	return created.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// buildGEXFFile returns a GEXF 1.3 document describing the same graph as buildGephiFile, with
+// the same directed edges.  When creation times are known the graph is dynamic, each account
+// appearing on the timeline when it was created.
+func buildGEXFFile(rootHandle *RootHandle, fetchedHandles []*FetchedHandle, opts *ExportOptions) []byte {
+	g := collectGraph(rootHandle, fetchedHandles, opts)
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<gexf xmlns="http://gexf.net/1.3" xmlns:viz="http://gexf.net/1.3/viz" version="1.3">
+  <meta lastmodifieddate="%s">
+    <creator>twitterweb</creator>
+  </meta>`, time.Now().UTC().Format("2006-01-02"))
+	edgeType := "directed"
+	if g.Undirected {
+		edgeType = "undirected"
+	}
+	mode := "static"
+	for _, n := range g.Nodes {
+		if gexfStart(n) != "" {
+			mode = "dynamic"
+			break
+		}
+	}
+	fmt.Fprintf(w, `
+  <graph defaultedgetype="%s" mode="%s"`, edgeType, mode)
+	if mode == "dynamic" {
+		fmt.Fprintf(w, ` timeformat="dateTime"`)
+	}
+	fmt.Fprintf(w, `>
+    <attributes class="node">`)
+	for _, attr := range gexfAttributes {
+		if opts.Compact && !attr.Compact {
+			continue
+		}
+		fmt.Fprintf(w, `
+      <attribute id="%s" title="%s" type="%s"/>`, attr.ID, attr.ID, attr.Type)
+	}
+	fmt.Fprintf(w, `
+    </attributes>
+    <attributes class="edge">`)
+	if opts.TagSelfLoops {
+		fmt.Fprintf(w, `
+      <attribute id="self_loop" title="self_loop" type="boolean"/>`)
+	}
+	if !g.Undirected {
+		fmt.Fprintf(w, `
+      <attribute id="mutual" title="mutual" type="boolean"/>`)
+	}
+	fmt.Fprintf(w, `
+    </attributes>
+    <nodes>`)
+	for _, n := range g.Nodes {
+		writeGEXFNode(w, g, n, opts)
+	}
+	fmt.Fprintf(w, `
+    </nodes>
+    <edges>`)
+	for i, edge := range g.Edges {
+		fmt.Fprintf(w, `
+      <edge id="%d" source="%s" target="%s"`, i, g.nodeID(edge.Source), g.nodeID(edge.Target))
+		if opts.WeightEdges {
+			fmt.Fprintf(w, ` weight="%v"`, opts.edgeWeight(edge, rootHandle.Node.TwitterID))
+		}
+		selfLoop := opts.TagSelfLoops && edge.Source == edge.Target
+		mutual := edge.Mutual && !g.Undirected
+		if !selfLoop && !mutual {
+			fmt.Fprintf(w, `/>`)
+			continue
+		}
+		fmt.Fprintf(w, `><attvalues>`)
+		if selfLoop {
+			fmt.Fprintf(w, `<attvalue for="self_loop" value="true"/>`)
+		}
+		if mutual {
+			fmt.Fprintf(w, `<attvalue for="mutual" value="true"/>`)
+		}
+		fmt.Fprintf(w, `</attvalues></edge>`)
+	}
+	fmt.Fprintf(w, `
+    </edges>
+  </graph>
+</gexf>
+`)
+	return w.Bytes()
+}
+
+// writeGEXFNode appends a GEXF node element for n to the writer.
+func writeGEXFNode(w io.Writer, g *graphData, n *GephiNode, opts *ExportOptions) {
+	values := map[string]string{
+		"user_id":               n.TwitterID,
+		"relationship":          n.Relationship,
+		"friends":               strconv.Itoa(n.FriendsCount),
+		"followers":             strconv.Itoa(n.FollowersCount),
+		"is_self":               strconv.FormatBool(n.IsSelf),
+		"default_profile":       strconv.FormatBool(n.DefaultProfile),
+		"default_profile_image": strconv.FormatBool(n.DefaultProfileImage),
+		"verified":              strconv.FormatBool(n.Verified),
+		"statuses":              strconv.Itoa(n.StatusesCount),
+		"protected":             strconv.FormatBool(n.Protected),
+	}
+	if createdAt := exportedCreatedAt(n); createdAt != "" {
+		values["created_at"] = createdAt
+	}
+	if !opts.Compact {
+		values["profile_url"] = n.ProfileURL
+		values["description"] = normalizeText(n.Description)
+		if image := profileImageURL(n, opts); image != "" {
+			values["profile_image_url"] = image
+		}
+		if n.ProfileBannerURL != "" {
+			values["profile_banner_url"] = n.ProfileBannerURL
+		}
+		if len(n.RecentTweets) > 0 {
+			values["recent_tweets"] = normalizeText(strings.Join(n.RecentTweets, " | "))
+		}
+	}
+	fmt.Fprintf(w, `
+      <node id="%s" label="`, g.nodeID(n.TwitterID))
+	xml.EscapeText(w, []byte(n.ScreenName))
+	fmt.Fprintf(w, `"`)
+	if start := gexfStart(n); start != "" {
+		fmt.Fprintf(w, ` start="%s"`, start)
+	}
+	fmt.Fprintf(w, `>
+        <attvalues>`)
+	for _, attr := range gexfAttributes {
+		value, ok := values[attr.ID]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, `
+          <attvalue for="%s" value="`, attr.ID)
+		xml.EscapeText(w, []byte(value))
+		fmt.Fprintf(w, `"/>`)
+	}
+	fmt.Fprintf(w, `
+        </attvalues>`)
+	if p, ok := g.Positions[n.TwitterID]; ok {
+		fmt.Fprintf(w, `
+        <viz:position x="%.2f" y="%.2f" z="0.0"/>`, p.X, p.Y)
+	}
+	fmt.Fprintf(w, `
+      </node>`)
+}
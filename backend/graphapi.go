@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// apiEdgesPrefix serves the edges of a completed graph in pages, followed by its TwitterID.
+const apiEdgesPrefix = "/api/edges/"
+
+// apiNodesPrefix serves the nodes of a completed graph in pages, followed by its TwitterID.
+const apiNodesPrefix = "/api/nodes/"
+
+// graphPrefix serves a whole completed graph as JSON, followed by its TwitterID.
+const graphPrefix = "/graph/"
+
+// apiNeighborsPrefix serves the neighbors of one node of a completed graph, followed by the
+// TwitterID of the graph's root.
+const apiNeighborsPrefix = "/api/neighbors/"
+
+// defaultAPIPageSize and maxAPIPageSize bound the items returned per page.
+const defaultAPIPageSize = 1000
+const maxAPIPageSize = 5000
+
+// apiEdge is an edge in the paginated API.  Every edge means the source follows the target,
+// or both follow each other when Relationship is "mutual".
+type apiEdge struct {
+	Source       string `json:"source"`
+	Target       string `json:"target"`
+	Relationship string `json:"relationship"`
+}
+
+// edgesPage is a page of the edges of a graph.
+type edgesPage struct {
+	Edges    []apiEdge `json:"edges"`
+	NextPage string    `json:"nextPage,omitempty"`
+}
+
+// nodesPage is a page of the nodes of a graph.
+type nodesPage struct {
+	Nodes    []*GephiNode `json:"nodes"`
+	NextPage string       `json:"nextPage,omitempty"`
+}
+
+// graphNode is a node of the graph served by graphHandler.
+type graphNode struct {
+	TwitterID      string `json:"twitterID"`
+	ScreenName     string `json:"screenName"`
+	Relationship   string `json:"relationship"`
+	FriendsCount   int    `json:"friendsCount"`
+	FollowersCount int    `json:"followersCount"`
+}
+
+// graphJSON is a whole graph.  Every edge means the source follows the target; mutual edges
+// are followed back.
+type graphJSON struct {
+	Nodes []graphNode `json:"nodes"`
+	Edges []graphEdge `json:"edges"`
+}
+
+// apiNeighbor is an account linked to the requested node.  ScreenName is empty for accounts
+// outside the graph, whose details were never fetched.
+type apiNeighbor struct {
+	TwitterID  string `json:"twitterID"`
+	ScreenName string `json:"screenName,omitempty"`
+}
+
+// neighborsResponse lists the accounts that follow a node and those it follows.
+type neighborsResponse struct {
+	TwitterID    string        `json:"twitterID"`
+	ScreenName   string        `json:"screenName"`
+	InNeighbors  []apiNeighbor `json:"inNeighbors"`
+	OutNeighbors []apiNeighbor `json:"outNeighbors"`
+}
+
+// parsePage reads the page token and pageSize of the request.  The page token is the offset
+// of the first item, as returned in the NextPage of the previous page.
+func parsePage(r *http.Request) (int, int, error) {
+	offset := 0
+	if page := r.FormValue("page"); page != "" {
+		v, err := strconv.Atoi(page)
+		if err != nil || v < 0 {
+			return 0, 0, fmt.Errorf("invalid page token")
+		}
+		offset = v
+	}
+	size := defaultAPIPageSize
+	if pageSize := r.FormValue("pageSize"); pageSize != "" {
+		v, err := strconv.Atoi(pageSize)
+		if err != nil || v < 1 || v > maxAPIPageSize {
+			return 0, 0, fmt.Errorf("pageSize must be between 1 and %v", maxAPIPageSize)
+		}
+		size = v
+	}
+	return offset, size, nil
+}
+
+// pageBounds clamps a page to n items, returning its end and the token of the next page.
+func pageBounds(offset, size, n int) (int, int, string) {
+	if offset > n {
+		offset = n
+	}
+	end := offset + size
+	if end >= n {
+		return offset, n, ""
+	}
+	return offset, end, strconv.Itoa(end)
+}
+
+// loadAPIGraph loads the completed graph named after prefix in the URL, built with the job's
+// saved export options and any minFollowers parameter.  Admins may name another owner with the
+// user parameter, as with downloadHandler.  On failure it writes the response and returns nil.
+func loadAPIGraph(w http.ResponseWriter, r *http.Request, prefix string) *graphData {
+	ctx := r.Context()
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil
+	}
+	ownerID, ok := graphOwner(w, r)
+	if !ok {
+		return nil
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return nil
+	}
+	defer dataClient.Close()
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, ownerID, strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil {
+		writeHandlerError(w, "could not find identified user", err)
+		return nil
+	}
+	if !rootHandle.Node.Done {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "graph is not ready")
+		return nil
+	}
+	opts := rootHandle.ExportOptions
+	if err := parseCountParam(r, "minFollowers", &opts.MinFollowers); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid options: %v", err)
+		return nil
+	}
+	fetchedHandles, err := getDoneJobs(ctx, dataClient, rootHandle)
+	if err != nil {
+		writeHandlerError(w, "error getting handles", err)
+		return nil
+	}
+	return collectGraph(rootHandle, fetchedHandles, &opts)
+}
+
+// apiEdgesHandler returns a page of the edges of a completed graph as JSON.  Edges touching
+// the root come first, then the rest, each ordered by source and target ID.  The URL is
+// apiEdgesPrefix followed by the TwitterID of the handle, and may include:
+// auth - the Firebase token, unless sent as a Bearer token
+// page - optionally, the nextPage of the previous response
+// pageSize - optionally, the number of edges per page.
+func apiEdgesHandler(w http.ResponseWriter, r *http.Request) {
+	offset, size, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid options: %v", err)
+		return
+	}
+	g := loadAPIGraph(w, r, apiEdgesPrefix)
+	if g == nil {
+		return
+	}
+	start, end, next := pageBounds(offset, size, len(g.Edges))
+	page := &edgesPage{Edges: []apiEdge{}, NextPage: next}
+	for _, edge := range g.Edges[start:end] {
+		relationship := "follows"
+		if g.Undirected {
+			relationship = exportModeMutual
+		}
+		page.Edges = append(page.Edges, apiEdge{Source: edge.Source, Target: edge.Target, Relationship: relationship})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// apiNodesHandler returns a page of the nodes of a completed graph as JSON, ordered by
+// TwitterID.  The URL is apiNodesPrefix followed by the TwitterID of the handle, and may
+// include:
+// auth - the Firebase token, unless sent as a Bearer token
+// page - optionally, the nextPage of the previous response
+// pageSize - optionally, the number of nodes per page.
+func apiNodesHandler(w http.ResponseWriter, r *http.Request) {
+	offset, size, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid options: %v", err)
+		return
+	}
+	g := loadAPIGraph(w, r, apiNodesPrefix)
+	if g == nil {
+		return
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].TwitterID < g.Nodes[j].TwitterID })
+	start, end, next := pageBounds(offset, size, len(g.Nodes))
+	page := &nodesPage{Nodes: []*GephiNode{}, NextPage: next}
+	for _, n := range g.Nodes[start:end] {
+		// The ID lists are left out since the edges endpoint carries them.
+		node := *n
+		node.FriendIDs = nil
+		node.FollowerIDs = nil
+		page.Nodes = append(page.Nodes, &node)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// apiNeighborsHandler returns the in-neighbors (followers) and out-neighbors (friends) of a
+// node of a completed graph as JSON, from the ID lists stored with the node.  Neighbors that
+// are nodes of the graph carry their screen names.  The URL is apiNeighborsPrefix followed by
+// the TwitterID of the handle, and should include:
+// auth - the Firebase token, unless sent as a Bearer token
+// node - the TwitterID of the node, which defaults to the root.
+func apiNeighborsHandler(w http.ResponseWriter, r *http.Request) {
+	g := loadAPIGraph(w, r, apiNeighborsPrefix)
+	if g == nil {
+		return
+	}
+	nodeID := r.FormValue("node")
+	if nodeID == "" {
+		nodeID = g.Root.Node.TwitterID
+	}
+	screenNames := make(map[string]string, len(g.Nodes))
+	var node *GephiNode
+	for _, n := range g.Nodes {
+		screenNames[n.TwitterID] = n.ScreenName
+		if n.TwitterID == nodeID && node == nil {
+			node = n
+		}
+	}
+	if node == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "node %v is not in the graph", nodeID)
+		return
+	}
+	neighbors := func(ids []string) []apiNeighbor {
+		list := make([]apiNeighbor, 0, len(ids))
+		for _, id := range ids {
+			list = append(list, apiNeighbor{TwitterID: id, ScreenName: screenNames[id]})
+		}
+		return list
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&neighborsResponse{
+		TwitterID:    node.TwitterID,
+		ScreenName:   node.ScreenName,
+		InNeighbors:  neighbors(node.FollowerIDs),
+		OutNeighbors: neighbors(node.FriendIDs),
+	})
+}
+
+// graphHandler returns a whole completed graph as JSON, with the same nodes and edges as the
+// GML built from the job's saved export options.  The URL is graphPrefix followed by the
+// TwitterID of the handle, and may include:
+// auth - the Firebase token, unless sent as a Bearer token
+// minFollowers - optionally, the fewest followers a fetched account needs to be kept
+// user - optionally, the owning LoginID when an admin reads another user's graph.
+func graphHandler(w http.ResponseWriter, r *http.Request) {
+	g := loadAPIGraph(w, r, graphPrefix)
+	if g == nil {
+		return
+	}
+	doc := &graphJSON{Nodes: make([]graphNode, 0, len(g.Nodes)), Edges: g.Edges}
+	if doc.Edges == nil {
+		doc.Edges = []graphEdge{}
+	}
+	for _, n := range g.Nodes {
+		doc.Nodes = append(doc.Nodes, graphNode{
+			TwitterID:      n.TwitterID,
+			ScreenName:     n.ScreenName,
+			Relationship:   n.Relationship,
+			FriendsCount:   n.FriendsCount,
+			FollowersCount: n.FollowersCount,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
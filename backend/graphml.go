@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// graphMLKey declares a GraphML node attribute.  Counts are typed as long so that Gephi and
+// NetworkX import them as numbers rather than strings.
+type graphMLKey struct {
+	ID      string
+	Type    string
+	Compact bool
+}
+
+// graphMLKeys lists the node attributes in the order they are written.  Keys that are not
+// Compact are left out of compact exports.
+var graphMLKeys = []graphMLKey{
+	{ID: "user_id", Type: "string", Compact: true},
+	{ID: "label", Type: "string", Compact: true},
+	{ID: "type", Type: "string", Compact: true},
+	{ID: "friends", Type: "long", Compact: true},
+	{ID: "followers", Type: "long", Compact: true},
+	{ID: "is_self", Type: "boolean", Compact: true},
+	{ID: "default_profile", Type: "boolean", Compact: true},
+	{ID: "default_profile_image", Type: "boolean", Compact: true},
+	{ID: "verified", Type: "boolean", Compact: true},
+	{ID: "statuses", Type: "long", Compact: true},
+	{ID: "created_at", Type: "string", Compact: true},
+	{ID: "protected", Type: "boolean", Compact: true},
+	{ID: "x", Type: "double", Compact: true},
+	{ID: "y", Type: "double", Compact: true},
+	{ID: "profile_url", Type: "string"},
+	{ID: "description", Type: "string"},
+	{ID: "profile_image_url", Type: "string"},
+	{ID: "profile_banner_url", Type: "string"},
+	{ID: "recent_tweets", Type: "string"},
+}
+
+// buildGraphMLFile returns a GraphML document describing the same graph as buildGephiFile.
+func buildGraphMLFile(rootHandle *RootHandle, fetchedHandles []*FetchedHandle, opts *ExportOptions) []byte {
+	g := collectGraph(rootHandle, fetchedHandles, opts)
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns">`)
+	for _, key := range graphMLKeys {
+		if opts.Compact && !key.Compact {
+			continue
+		}
+		fmt.Fprintf(w, `
+  <key id="%s" for="node" attr.name="%s" attr.type="%s"/>`, key.ID, key.ID, key.Type)
+	}
+	if opts.WeightEdges {
+		fmt.Fprintf(w, `
+  <key id="weight" for="edge" attr.name="weight" attr.type="double"/>`)
+	}
+	if opts.TagSelfLoops {
+		fmt.Fprintf(w, `
+  <key id="self_loop" for="edge" attr.name="self_loop" attr.type="boolean"/>`)
+	}
+	edgeDefault := "directed"
+	if g.Undirected {
+		edgeDefault = "undirected"
+	} else {
+		fmt.Fprintf(w, `
+  <key id="mutual" for="edge" attr.name="mutual" attr.type="boolean"/>`)
+	}
+	fmt.Fprintf(w, `
+  <graph id="G" edgedefault="%s">`, edgeDefault)
+	for _, n := range g.Nodes {
+		writeGraphMLNode(w, g, n, opts)
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(w, `
+    <edge source="%s" target="%s">`, g.nodeID(edge.Source), g.nodeID(edge.Target))
+		if opts.WeightEdges {
+			fmt.Fprintf(w, `<data key="weight">%v</data>`, opts.edgeWeight(edge, rootHandle.Node.TwitterID))
+		}
+		if opts.TagSelfLoops && edge.Source == edge.Target {
+			fmt.Fprintf(w, `<data key="self_loop">true</data>`)
+		}
+		if edge.Mutual && !g.Undirected {
+			fmt.Fprintf(w, `<data key="mutual">true</data>`)
+		}
+		fmt.Fprintf(w, `</edge>`)
+	}
+	fmt.Fprintf(w, `
+  </graph>
+</graphml>
+`)
+	return w.Bytes()
+}
+
+// writeGraphMLNode appends a GraphML node element for n to the writer.
+func writeGraphMLNode(w io.Writer, g *graphData, n *GephiNode, opts *ExportOptions) {
+	values := map[string]string{
+		"user_id":   n.TwitterID,
+		"label":     n.ScreenName,
+		"type":      n.Relationship,
+		"friends":   fmt.Sprint(n.FriendsCount),
+		"followers": fmt.Sprint(n.FollowersCount),
+	}
+	if n.IsSelf {
+		values["is_self"] = "true"
+	}
+	if n.Protected {
+		values["protected"] = "true"
+	}
+	values["default_profile"] = strconv.FormatBool(n.DefaultProfile)
+	values["default_profile_image"] = strconv.FormatBool(n.DefaultProfileImage)
+	values["verified"] = strconv.FormatBool(n.Verified)
+	values["statuses"] = strconv.Itoa(n.StatusesCount)
+	if createdAt := exportedCreatedAt(n); createdAt != "" {
+		values["created_at"] = createdAt
+	}
+	if p, ok := g.Positions[n.TwitterID]; ok {
+		values["x"] = fmt.Sprintf("%.2f", p.X)
+		values["y"] = fmt.Sprintf("%.2f", p.Y)
+	}
+	if !opts.Compact {
+		values["profile_url"] = n.ProfileURL
+		values["description"] = normalizeText(n.Description)
+		if image := profileImageURL(n, opts); image != "" {
+			values["profile_image_url"] = image
+		}
+		if n.ProfileBannerURL != "" {
+			values["profile_banner_url"] = n.ProfileBannerURL
+		}
+		if len(n.RecentTweets) > 0 {
+			values["recent_tweets"] = normalizeText(strings.Join(n.RecentTweets, " | "))
+		}
+	}
+	fmt.Fprintf(w, `
+    <node id="%s">`, g.nodeID(n.TwitterID))
+	for _, key := range graphMLKeys {
+		value, ok := values[key.ID]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, `
+      <data key="%s">`, key.ID)
+		xml.EscapeText(w, []byte(value))
+		fmt.Fprintf(w, `</data>`)
+	}
+	fmt.Fprintf(w, `
+    </node>`)
+}
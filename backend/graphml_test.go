@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"testing"
+)
+
+// graphMLDocument is the part of a GraphML document the tests read back.
+type graphMLDocument struct {
+	Keys []struct {
+		ID   string `xml:"id,attr"`
+		Type string `xml:"attr.type,attr"`
+	} `xml:"key"`
+	Nodes []struct {
+		ID   string `xml:"id,attr"`
+		Data []struct {
+			Key   string `xml:"key,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"data"`
+	} `xml:"graph>node"`
+}
+
+func TestGraphMLTypesCounts(t *testing.T) {
+	root := testRoot("1", "2")
+	handle := testHandle("2", 1234)
+	handle.Node.FriendsCount = 56
+	handle.Node.StatusesCount = 789
+	var doc graphMLDocument
+	if err := xml.Unmarshal(buildGraphMLFile(root, []*FetchedHandle{handle}, &ExportOptions{}), &doc); err != nil {
+		t.Fatalf("reading the GraphML back: %v", err)
+	}
+	types := make(map[string]string)
+	for _, key := range doc.Keys {
+		types[key.ID] = key.Type
+	}
+	for id, want := range map[string]string{
+		"friends":     "long",
+		"followers":   "long",
+		"statuses":    "long",
+		"label":       "string",
+		"description": "string",
+		"verified":    "boolean",
+	} {
+		if types[id] != want {
+			t.Errorf("key %v has attr.type %q, want %q", id, types[id], want)
+		}
+	}
+	if len(doc.Nodes) != 2 {
+		t.Fatalf("GraphML has %v nodes, want 2", len(doc.Nodes))
+	}
+	for _, node := range doc.Nodes {
+		for _, data := range node.Data {
+			if types[data.Key] != "long" {
+				continue
+			}
+			if _, err := strconv.ParseInt(data.Value, 10, 64); err != nil {
+				t.Errorf("node %v has %v %q, want a plain number", node.ID, data.Key, data.Value)
+			}
+		}
+	}
+}
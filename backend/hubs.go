@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// completeHubsPrefix reopens a completed job to collect the hubs it skipped.
+const completeHubsPrefix = "/completeHubs"
+
+// completeHubsHandler reopens a completed job whose hubs, accounts with more than idsPageSize
+// friends or followers, were left without edges by crawls from before hubs were paginated.
+// They are hydrated again, collecting their ID lists a page per tick, and the graph is rebuilt
+// without crawling the rest of the network again.  Responds with the number of reopened hubs
+// as JSON.  The POST body should contain:
+// auth - the Firebase token
+// id - the TwitterID of the handle.
+func completeHubsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, loginID, r.FormValue("id"))
+	if err != nil {
+		writeHandlerError(w, "could not find identified user", err)
+		return
+	}
+	if !rootHandle.Node.Done {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "graph is not ready")
+		return
+	}
+	reopened, err := reopenSkippedHubs(ctx, dataClient, rootHandle)
+	if err != nil {
+		writeHandlerError(w, "failed to reopen hubs", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"reopened": reopened})
+}
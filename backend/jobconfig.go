@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+// updateJobPrefix changes the settings of a job that is still being fetched.
+const updateJobPrefix = "/updateJob"
+
+// pausePrefix pauses or resumes a job, followed by its TwitterID.
+const pausePrefix = "/pause/"
+
+// jobConfigUpdates returns the firestore updates for the settings present in the request,
+// checked against the current state of the job.  Settings that shape data already collected
+// are rejected with ErrSettingLocked once the collection they affect has begun.
+func jobConfigUpdates(r *http.Request, current *RootHandle) ([]firestore.Update, error) {
+	var updates []firestore.Update
+	if tweets := r.FormValue("tweets"); tweets != "" {
+		n, err := strconv.Atoi(tweets)
+		if err != nil || n < 0 || n > maxTweetSampleSize {
+			return nil, fmt.Errorf("tweets must be between 0 and %v", maxTweetSampleSize)
+		}
+		updates = append(updates, firestore.Update{Path: "TweetSampleSize", Value: n})
+	}
+	for _, param := range []struct{ name, path string }{
+		{"maxFollowerPages", "MaxFollowerPages"},
+		{"maxFriendPages", "MaxFriendPages"},
+	} {
+		if pages := r.FormValue(param.name); pages != "" {
+			n, err := strconv.Atoi(pages)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%v must be a non-negative integer", param.name)
+			}
+			updates = append(updates, firestore.Update{Path: param.path, Value: n})
+		}
+	}
+	collecting := current.FollowersCursor != -1 || current.FriendsCursor != -1
+	if order := r.FormValue("order"); order != "" && order != current.FetchOrder {
+		if order != fetchOrderFollowersFirst && order != fetchOrderFriendsFirst {
+			return nil, fmt.Errorf("order must be %v or %v", fetchOrderFollowersFirst, fetchOrderFriendsFirst)
+		}
+		if collecting {
+			return nil, fmt.Errorf("%w: order, collection has started", ErrSettingLocked)
+		}
+		updates = append(updates, firestore.Update{Path: "FetchOrder", Value: order})
+	}
+	if exclude := r.FormValue("exclude"); exclude != "" {
+		if collecting {
+			return nil, fmt.Errorf("%w: exclude, collection has started", ErrSettingLocked)
+		}
+		updates = append(updates, firestore.Update{Path: "Blocklist", Value: parseBlocklist(exclude)})
+	}
+	if mutual := r.FormValue("mutual"); mutual != "" {
+		v, err := strconv.ParseBool(mutual)
+		if err != nil {
+			return nil, fmt.Errorf("mutual must be true or false")
+		}
+		if v != current.MutualOnly && collecting {
+			return nil, fmt.Errorf("%w: mutual, collection has started", ErrSettingLocked)
+		}
+		updates = append(updates, firestore.Update{Path: "MutualOnly", Value: v})
+	}
+	if incremental := r.FormValue("incremental"); incremental != "" {
+		v, err := strconv.ParseBool(incremental)
+		if err != nil {
+			return nil, fmt.Errorf("incremental must be true or false")
+		}
+		// Fragments are only written as nodes are hydrated, so switching afterwards would
+		// build the graph from an incomplete set.
+		if v != current.IncrementalBuild && current.Remaining != -1 {
+			return nil, fmt.Errorf("%w: incremental, hydration has started", ErrSettingLocked)
+		}
+		updates = append(updates, firestore.Update{Path: "IncrementalBuild", Value: v})
+	}
+	if hasExportOptions(r) {
+		exportOpts, err := parseExportOptions(r, current.ExportOptions)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, firestore.Update{Path: "ExportOptions", Value: *exportOpts})
+	}
+	return updates, nil
+}
+
+// updateJobHandler changes the settings of an unfinished job without losing its progress.
+// Only the settings present are changed.  The POST body should contain:
+// auth - the Firebase token
+// id - the TwitterID of the handle
+// tweets - optionally, the number of recent tweets to sample per node from now on
+// maxFollowerPages, maxFriendPages - optionally, new page caps
+// order - optionally, which direction to collect first, until collection starts
+// exclude - optionally, TwitterIDs or screen names to leave out, until collection starts
+// mutual - optionally, "true" to crawl only mutual follows, until collection starts
+// incremental - optionally, "true" to assemble the graph in fragments, until hydration starts
+// export options - optionally, any option read by parseExportOptions, applied to the stored graph.
+func updateJobHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, loginID, r.FormValue("id"))
+	if err != nil {
+		writeHandlerError(w, "could not find identified user", err)
+		return
+	}
+	// Malformed values are reported before the transaction, which re-checks the locks
+	// against the latest state of the job.
+	if _, err := jobConfigUpdates(r, rootHandle); err != nil && !errors.Is(err, ErrSettingLocked) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid options: %v", err)
+		return
+	}
+	err = updateRootHandleConfig(ctx, dataClient, rootHandle, func(current *RootHandle) ([]firestore.Update, error) {
+		return jobConfigUpdates(r, current)
+	})
+	if err != nil {
+		writeHandlerError(w, "failed to update job", err)
+		return
+	}
+}
+
+// pauseHandler pauses a job that is still being fetched, or resumes a paused one.  Only the
+// Paused flag and status are written, so the cursors are kept and a resumed job continues
+// where it stopped.  The URL is pausePrefix followed by the TwitterID of the handle, and the
+// POST body should contain:
+// auth - the Firebase token
+// paused - optionally, "true" to pause or "false" to resume; without it the flag is flipped.
+func pauseHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var paused *bool
+	if v := r.FormValue("paused"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid options: paused must be true or false")
+			return
+		}
+		paused = &b
+	}
+	loginID := loginIDFromContext(ctx)
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, loginID, strings.TrimPrefix(r.URL.Path, pausePrefix))
+	if err != nil {
+		writeHandlerError(w, "could not find identified user", err)
+		return
+	}
+	err = updateRootHandleConfig(ctx, dataClient, rootHandle, func(current *RootHandle) ([]firestore.Update, error) {
+		v := !current.Paused
+		if paused != nil {
+			v = *paused
+		}
+		if v == current.Paused {
+			return nil, nil
+		}
+		status := "Resuming"
+		if v {
+			status = "Paused"
+		}
+		return []firestore.Update{{Path: "Paused", Value: v}, {Path: "Status", Value: status}}, nil
+	})
+	if err != nil {
+		writeHandlerError(w, "failed to pause job", err)
+		return
+	}
+}
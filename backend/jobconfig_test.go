@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestJobConfigUpdatesStoresImages(t *testing.T) {
+	form := url.Values{"images": {"false"}}
+	r := httptest.NewRequest("POST", "/updateJob", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	updates, err := jobConfigUpdates(r, &RootHandle{Remaining: -1})
+	if err != nil {
+		t.Fatalf("jobConfigUpdates() error = %v", err)
+	}
+	if len(updates) != 1 || updates[0].Path != "ExportOptions" {
+		t.Fatalf("jobConfigUpdates() = %+v, want one ExportOptions update", updates)
+	}
+	if opts, ok := updates[0].Value.(ExportOptions); !ok || !opts.OmitImages {
+		t.Errorf("ExportOptions update = %+v, want OmitImages set", updates[0].Value)
+	}
+}
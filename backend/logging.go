@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// logLevel orders log messages by how much detail they add.  A message is written when its
+// level is at most the configured one.
+type logLevel int
+
+const (
+	logLevelError logLevel = iota
+	logLevelInfo
+	logLevelDebug
+)
+
+// currentLogLevel is read from LOG_LEVEL, one of "error", "info" or "debug".  It defaults to
+// info, which leaves out the per-tick progress messages.
+var currentLogLevel = parseLogLevel(os.Getenv("LOG_LEVEL"))
+
+// parseLogLevel reads a LOG_LEVEL setting, falling back to info when it is unset or unknown.
+func parseLogLevel(v string) logLevel {
+	switch strings.ToLower(v) {
+	case "error":
+		return logLevelError
+	case "debug":
+		return logLevelDebug
+	}
+	return logLevelInfo
+}
+
+// logf writes the message when level is enabled, prefixed with the level name.
+func logf(level logLevel, format string, args ...interface{}) {
+	if level > currentLogLevel {
+		return
+	}
+	prefix := [...]string{"ERROR: ", "INFO: ", "DEBUG: "}[level]
+	log.Printf(prefix+format, args...)
+}
+
+// logErrorf logs a failure that needs attention.
+func logErrorf(format string, args ...interface{}) {
+	logf(logLevelError, format, args...)
+}
+
+// logInfof logs a notable event, such as a job stopping early.
+func logInfof(format string, args ...interface{}) {
+	logf(logLevelInfo, format, args...)
+}
+
+// logDebugf logs routine progress, such as each tick and page.
+func logDebugf(format string, args ...interface{}) {
+	logf(logLevelDebug, format, args...)
+}
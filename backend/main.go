@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"cloud.google.com/go/storage"
 	firebase "firebase.google.com/go"
+	"firebase.google.com/go/auth"
 	"github.com/dghubble/go-twitter/twitter"
 )
 
@@ -24,9 +31,33 @@ const updateUserPrefix = "/updateUser"
 // addHandlePrefix enqueues a new Handle for fetching.
 const addHandlePrefix = "/addHandle"
 
-//deleteHandlePrefix handles the cancellation and deletion of a fetch task.
+// checkHandlePrefix reports whether a handle already has a job.
+const checkHandlePrefix = "/checkHandle"
+
+// deleteHandlePrefix handles the cancellation and deletion of a fetch task.
 const deleteHandlePrefix = "/deleteHandle"
 
+// refreshHandlePrefix re-resolves the current screen name and profile of a handle.
+const refreshHandlePrefix = "/refreshHandle"
+
+// usersPerTick bounds how many users an all-users tick services.  Successive ticks resume
+// where the last one stopped so every user is serviced in turn.  Zero services every user.
+var usersPerTick = envInt("USERS_PER_TICK", 25)
+
+// workerConcurrency bounds how many jobs a worker tick advances at once.  Values below one
+// advance jobs one at a time.
+var workerConcurrency = envInt("WORKER_CONCURRENCY", 4)
+
+// envInt reads an integer setting from the environment, falling back to def when it is
+// unset or malformed.
+func envInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
 // User represents a single user of the system.  The Access fields
 // represent Twitter OAuth credentials, and LoginID ties the struct
 // back to a Firebase user.
@@ -35,6 +66,12 @@ type User struct {
 	AccessSecret string
 	LoginID      string
 	ScreenName   string
+	// TwitterID is the ID of the account the stored credentials were issued for.
+	TwitterID string
+	// ExportFormat and ExportOptions are the user's preferred download settings, applied
+	// when a download request does not set its own.
+	ExportFormat  string
+	ExportOptions ExportOptions
 }
 
 // GephiNode is a Gephi node in the graph, containing its identity,
@@ -51,6 +88,23 @@ type GephiNode struct {
 	ProfileURL      string
 	Description     string
 	ProfileImageURL string
+	// ProfileBannerURL is the account's banner image over HTTPS, or empty without a banner.
+	ProfileBannerURL string
+	RecentTweets     []string
+	// CreatedAt is when the account was created, in Twitter's created_at format.
+	CreatedAt string
+	// DefaultProfile and DefaultProfileImage are set for accounts that never changed their
+	// theme or avatar, a common sign of automated accounts.
+	DefaultProfile      bool
+	DefaultProfileImage bool
+	// Verified and StatusesCount are the account's verified badge and its number of tweets.
+	Verified      bool
+	StatusesCount int
+	// Protected marks an account whose ID lists could not be read because it is protected,
+	// leaving it without edges of its own.
+	Protected bool
+	// IsSelf marks the root node when it is the signed in user's own account.
+	IsSelf bool
 }
 
 // RootHandle is a top level handle to fetch.  All of its friends and
@@ -63,46 +117,296 @@ type RootHandle struct {
 	FriendsCursor   int64
 	Status          string
 	Remaining       int
+	EnqueuedCount   int
+	// PercentComplete is the share of enqueued handles hydrated, or -1 while the IDs are still
+	// being collected.  It is derived from the counts by percentComplete whenever they are saved.
+	PercentComplete int
 	PrepareGraph    bool
+	TweetSampleSize int
+	FetchOrder      string
+	Blocklist       []string
+	ShareNonce      string
+	// MaxFollowerPages and MaxFriendPages stop collecting a direction, of the root or of a
+	// fetched handle, after that many pages of 5000 IDs, sampling enormous accounts.  Zero
+	// collects everything.
+	MaxFollowerPages   int
+	MaxFriendPages     int
+	FollowerPages      int
+	FriendPages        int
+	FollowersTruncated bool
+	FriendsTruncated   bool
+	// ShortFollowerPages and ShortFriendPages count pages that returned fewer than a full
+	// page of new IDs yet still had a next cursor.  See maxShortPages.
+	ShortFollowerPages int
+	ShortFriendPages   int
+	// IncrementalBuild writes a graph fragment as each handle is hydrated.
+	IncrementalBuild bool
+	// ExportOptions shapes the graph file stored when the fetch completes.
+	ExportOptions ExportOptions
+	// MutualOnly hydrates only the accounts that are both friends and followers of the root.
+	MutualOnly bool
+	// Depth is how many hops from the root the crawl reaches.  At 2 the friends and followers
+	// of each hydrated handle are enqueued too, up to maxExpandedNodes handles in all.  Jobs
+	// saved before Depth existed hold zero, which crawls one hop like 1.
+	Depth int
+	// ExpansionTruncated is set when maxExpandedNodes stopped a second hop from being enqueued.
+	ExpansionTruncated bool
+	// Paused stops the worker from advancing the job, keeping its cursors so it resumes
+	// exactly where it stopped.
+	Paused bool
+	// StartedAt is when the job was enqueued, and zero for jobs enqueued before it was kept.
+	StartedAt time.Time
+	// CompletedAt is when the graph was built and the job marked done.
+	CompletedAt time.Time
+	// NotifyURL, when set, receives a completionNotice once the graph is built.
+	NotifyURL string
+	// NodeCount is the number of nodes in the stored graph file.
+	NodeCount int
+	// LastError is the failure of the most recent tick, kept apart from Status so the progress
+	// message survives it, and LastErrorAt when it happened.  Both are cleared by the next
+	// successful tick.
+	LastError   string
+	LastErrorAt time.Time
 }
 
 // FetchedHandle holds a friend or follower of a RootHandle.
 type FetchedHandle struct {
 	ParentID string
 	Node     GephiNode
+	// References counts the hydrated nodes that list this handle as a friend or follower.
+	// Unfinished handles with the most references are hydrated first, so the hubs of the
+	// network surface early in a partial crawl.
+	References int
+	// FriendsCursor and FollowersCursor continue the ID lists of a handle too large for one
+	// page, which is collected a page per tick like the root.  A handle stays unfinished until
+	// both are zero again; an unfinished handle with both at zero has not been started.
+	FriendsCursor   int64
+	FollowersCursor int64
+	// FriendPages and FollowerPages count the pages collected, capped like the root's by
+	// RootHandle.MaxFriendPages and MaxFollowerPages and by maxFetchedHandlePages.
+	FriendPages   int
+	FollowerPages int
+	// ShortFriendPages and ShortFollowerPages count short pages as on RootHandle.
+	ShortFriendPages   int
+	ShortFollowerPages int
+	// Hop is 2 for handles enqueued from the lists of another fetched handle.  They are
+	// hydrated with their profiles only, without ID lists of their own.  Zero means 1.
+	Hop int
+}
+
+// maxDepth is the deepest crawl a job may request.
+const maxDepth = 2
+
+// maxExpandedNodes caps the handles a job crawling two hops may enqueue, since each hop
+// multiplies the size of the crawl.
+var maxExpandedNodes = envInt("MAX_EXPANDED_NODES", 100000)
+
+// maxTweetSamplesPerTick caps the timelines one tick of a job samples.  Handles beyond it wait
+// for later ticks, keeping a batch of lookups from spending the user's whole timeline rate
+// limit at once.  Zero disables the cap.
+var maxTweetSamplesPerTick = envInt("TWEET_SAMPLES_PER_TICK", 50)
+
+// maxTweetSampleSize is the most tweets a single timeline call can return.
+const maxTweetSampleSize = 200
+
+// fetchOrderFollowersFirst collects the root's followers before its friends.  This is the default.
+const fetchOrderFollowersFirst = "followersFirst"
+
+// fetchOrderFriendsFirst collects the root's friends before its followers.
+const fetchOrderFriendsFirst = "friendsFirst"
+
+// jobOptions holds the optional settings chosen when a handle is enqueued.
+type jobOptions struct {
+	// TweetSampleSize is the number of recent tweets stored per node.  Zero disables
+	// sampling, which costs one extra API call per node.
+	TweetSampleSize int
+	// FetchOrder chooses which direction of the root's network is collected first.
+	FetchOrder string
+	// Blocklist holds TwitterIDs or screen names to leave out of the crawl, in addition
+	// to the globalBlocklist.
+	Blocklist []string
+	// MaxFollowerPages and MaxFriendPages cap how many pages of IDs each direction collects.
+	MaxFollowerPages int
+	MaxFriendPages   int
+	// IncrementalBuild assembles the graph in fragments during the crawl.
+	IncrementalBuild bool
+	// ExportOptions shapes the stored graph file.
+	ExportOptions ExportOptions
+	// MutualOnly limits the crawl to accounts the root mutually follows.
+	MutualOnly bool
+	// Depth is the number of hops to crawl, 1 or maxDepth.
+	Depth int
+	// NotifyURL is the webhook told when the fetch completes.
+	NotifyURL string
+}
+
+// parseJobOptions reads the optional enqueue settings from the request form:
+// tweets - the number of recent tweets to sample per node, at most maxTweetSampleSize
+// order - fetchOrderFollowersFirst or fetchOrderFriendsFirst
+// exclude - a comma separated list of TwitterIDs or screen names to leave out
+// maxFollowerPages, maxFriendPages - the most pages of 5000 IDs to collect per direction
+// incremental - "true" to assemble the graph in fragments during the crawl
+// depth - the hops from the root to crawl, 1 (the default) or maxDepth
+// notifyURL - an https URL to post a JSON notice to when the fetch completes.
+func parseJobOptions(r *http.Request) (*jobOptions, error) {
+	opts := &jobOptions{
+		FetchOrder: fetchOrderFollowersFirst,
+		Blocklist:  parseBlocklist(r.FormValue("exclude")),
+		Depth:      1,
+	}
+	switch order := r.FormValue("order"); order {
+	case "":
+	case fetchOrderFollowersFirst, fetchOrderFriendsFirst:
+		opts.FetchOrder = order
+	default:
+		return nil, fmt.Errorf("order must be %v or %v", fetchOrderFollowersFirst, fetchOrderFriendsFirst)
+	}
+	if tweets := r.FormValue("tweets"); tweets != "" {
+		n, err := strconv.Atoi(tweets)
+		if err != nil || n < 0 || n > maxTweetSampleSize {
+			return nil, fmt.Errorf("tweets must be between 0 and %v", maxTweetSampleSize)
+		}
+		opts.TweetSampleSize = n
+	}
+	// A slice rather than a map keeps the order, and so the reported error, stable.
+	for _, param := range []struct {
+		name  string
+		field *int
+	}{
+		{"maxFollowerPages", &opts.MaxFollowerPages},
+		{"maxFriendPages", &opts.MaxFriendPages},
+	} {
+		if pages := r.FormValue(param.name); pages != "" {
+			n, err := strconv.Atoi(pages)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%v must be a non-negative integer", param.name)
+			}
+			*param.field = n
+		}
+	}
+	if incremental := r.FormValue("incremental"); incremental != "" {
+		v, err := strconv.ParseBool(incremental)
+		if err != nil {
+			return nil, fmt.Errorf("incremental must be true or false")
+		}
+		opts.IncrementalBuild = v
+	}
+	if mutual := r.FormValue("mutual"); mutual != "" {
+		v, err := strconv.ParseBool(mutual)
+		if err != nil {
+			return nil, fmt.Errorf("mutual must be true or false")
+		}
+		opts.MutualOnly = v
+	}
+	if depth := r.FormValue("depth"); depth != "" {
+		n, err := strconv.Atoi(depth)
+		if err != nil || n < 1 || n > maxDepth {
+			return nil, fmt.Errorf("depth must be between 1 and %v", maxDepth)
+		}
+		opts.Depth = n
+	}
+	notifyURL, err := parseNotifyURL(r.FormValue("notifyURL"))
+	if err != nil {
+		return nil, err
+	}
+	opts.NotifyURL = notifyURL
+	exportOpts, err := parseExportOptions(r, ExportOptions{})
+	if err != nil {
+		return nil, err
+	}
+	opts.ExportOptions = *exportOpts
+	return opts, nil
 }
 
 // main registers the handlers for this web application.
 func main() {
 	http.HandleFunc(workerPrefix, workerHandler)
-	http.HandleFunc(updateUserPrefix, updateUserHandler)
-	http.HandleFunc(addHandlePrefix, addHandleHandler)
-	http.HandleFunc(deleteHandlePrefix, deleteHandleHandler)
+	http.HandleFunc(reconcileAllPrefix, reconcileAllHandler)
+	http.HandleFunc(cleanupPrefix, cleanupHandler)
+	http.HandleFunc(updateUserPrefix, withAuth(authAPI, updateUserHandler))
+	http.HandleFunc(preferencesPrefix, withAuth(authAPI, preferencesHandler))
+	http.HandleFunc(addHandlePrefix, withAuth(authAPI, addHandleHandler))
+	http.HandleFunc(checkHandlePrefix, withAuth(authAPI, checkHandleHandler))
+	http.HandleFunc(estimatePrefix, withAuth(authAPI, estimateHandler))
+	http.HandleFunc(estimateSlashPrefix, withAuth(authAPI, estimateHandler))
+	http.HandleFunc(deleteHandlePrefix, withAuth(authAPI, deleteHandleHandler))
+	http.HandleFunc(refreshHandlePrefix, withAuth(authAPI, refreshHandleHandler))
+	http.HandleFunc(completeHubsPrefix, withAuth(authAPI, completeHubsHandler))
+	http.HandleFunc(updateJobPrefix, withAuth(authAPI, updateJobHandler))
+	http.HandleFunc(pausePrefix, withAuth(authAPI, pauseHandler))
+	http.HandleFunc(searchPrefix, withAuth(authAPI, searchHandler))
+	http.HandleFunc(exportJobsPrefix, withAuth(authAPI, exportJobsHandler))
+	http.HandleFunc(importJobsPrefix, withAuth(authAPI, importJobsHandler))
+	http.HandleFunc(reconcilePrefix, withAuth(authAPI, reconcileHandler))
+	http.HandleFunc(replayTickPrefix, withAuth(authAPI, replayTickHandler))
+	http.HandleFunc(diagnosticsPrefix, withAuth(authAPI, diagnosticsHandler))
+	http.HandleFunc(cancelWorkerPrefix, withAuth(authAPI, cancelWorkerHandler))
+	http.HandleFunc(adminDashboardPrefix, withAuth(authPage, adminDashboardHandler))
+	http.HandleFunc(downloadPrefix, withAuth(authPage, downloadHandler))
+	http.HandleFunc(mergedDownloadPrefix, withAuth(authPage, mergedDownloadHandler))
+	http.HandleFunc(sharePrefix, withAuth(authAPI, shareHandler))
+	http.HandleFunc(unsharePrefix, withAuth(authAPI, unshareHandler))
+	http.HandleFunc(sharedPrefix, sharedHandler)
+	http.HandleFunc(graphStatsPrefix, withAuth(authAPI, graphStatsHandler))
+	http.HandleFunc(apiEdgesPrefix, withAuth(authAPI, apiEdgesHandler))
+	http.HandleFunc(apiNodesPrefix, withAuth(authAPI, apiNodesHandler))
+	http.HandleFunc(graphPrefix, withAuth(authAPI, graphHandler))
+	http.HandleFunc(apiNeighborsPrefix, withAuth(authAPI, apiNeighborsHandler))
+	http.HandleFunc(apiStatusesPrefix, withAuth(authAPI, apiStatusesHandler))
 	http.HandleFunc("/", indexHandler)
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
-		log.Printf("Defaulting to port %s", port)
+		logInfof("Defaulting to port %s", port)
 	}
 
-	log.Printf("Listening on port %s", port)
+	logInfof("Listening on port %s", port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
 }
 
+// isSelf reports whether user is the Twitter account appUser signed in with.  Users saved
+// before their TwitterID was recorded are matched by screen name instead.
+func isSelf(appUser *User, user *twitter.User) bool {
+	if appUser == nil {
+		return false
+	}
+	if appUser.TwitterID != "" {
+		return appUser.TwitterID == user.IDStr
+	}
+	return appUser.ScreenName != "" && strings.EqualFold(appUser.ScreenName, user.ScreenName)
+}
+
 // enqueueHandle uses the connected Twitter client to enqueue a request for the handle to be fetched.
-// It will use the credentials of loginID to do this.  The TwitterID of the fetched user is returned.
-func enqueueHandle(ctx context.Context, client *twitter.Client, dataClient *firestore.Client, loginID string, handle string) (string, error) {
-	user, err := getTwitterUserByName(client, handle)
+// It will use the credentials of loginID to do this.  The created RootHandle is returned, or an
+// ErrAlreadyExists error if the user is already crawling the handle.
+func enqueueHandle(ctx context.Context, client *twitter.Client, dataClient *firestore.Client, loginID string, handle string, opts *jobOptions) (*RootHandle, error) {
+	user, err := getTwitterUserByHandle(ctx, client, handle)
 	if err != nil {
-		return "", err
-	}
-	if err := newRootHandle(ctx, dataClient, loginID, user); err != nil {
-		return "", err
+		return nil, err
 	}
+	blocklist, err := resolveBlocklist(ctx, client, append(opts.Blocklist, globalBlocklist...))
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	opts.Blocklist = blocklist
+	rootHandle, err := newRootHandle(ctx, dataClient, loginID, user, opts)
+	if errors.Is(err, ErrAlreadyExists) {
+		return nil, alreadyCrawlingError(ctx, dataClient, loginID, user)
 	}
-	return user.IDStr, nil
+	return rootHandle, err
+}
+
+// alreadyCrawlingError explains that the account behind user, possibly enqueued earlier under a
+// different screen name, is already being crawled.  The stored screen name is brought up to date
+// along the way.
+func alreadyCrawlingError(ctx context.Context, dataClient *firestore.Client, loginID string, user *twitter.User) error {
+	existing, err := getRootHandleFromString(ctx, dataClient, loginID, user.IDStr)
+	if err == nil && existing.Node.ScreenName != user.ScreenName {
+		if err := updateRootHandleProfile(ctx, dataClient, existing, user); err != nil {
+			logErrorf("failed to refresh screen name: (%v) %v", loginID, err)
+		}
+	}
+	return fmt.Errorf("%w: you're already crawling this account (now @%v)", ErrAlreadyExists, user.ScreenName)
 }
 
 // runTick will advance the state machine one step for the requested Twitter handle.
@@ -111,28 +415,29 @@ func runTick(ctx context.Context, client *twitter.Client, dataClient *firestore.
 		return "", fmt.Errorf("User was already done: %v", rootHandle.Node.TwitterID)
 	}
 	if rootHandle.PrepareGraph {
-		config := &firebase.Config{
-			StorageBucket: ProjectID + ".appspot.com",
-		}
-		app, err := firebase.NewApp(ctx, config)
+		bucket, err := newGraphBucket(ctx)
 		if err != nil {
 			return "", err
 		}
-		storageClient, err := app.Storage(ctx)
-		if err != nil {
-			return "", err
+		var fetchedHandles []*FetchedHandle
+		if rootHandle.IncrementalBuild {
+			fetchedHandles, err = readGraphHandles(ctx, bucket, dataClient, rootHandle)
+		} else {
+			fetchedHandles, err = getDoneJobs(ctx, dataClient, rootHandle)
 		}
-		bucket, err := storageClient.DefaultBucket()
 		if err != nil {
-			return "", err
+			return "", fmt.Errorf("error getting handles: %v", err)
 		}
-		fetchedHandles, err := getDoneJobs(ctx, dataClient, rootHandle)
+		obj := getGraphObject(bucket, rootHandle)
+		// The graph is stored gzipped; Cloud Storage decodes it for clients that do not accept gzip.
+		g := collectGraph(rootHandle, fetchedHandles, &rootHandle.ExportOptions)
+		content, err := gzipContent(writeGephiGraph(g, &rootHandle.ExportOptions))
 		if err != nil {
-			return "", fmt.Errorf("error getting handles: %v", err)
+			return "", err
 		}
-		obj := bucket.Object("graphs/" + rootHandle.LoginID + "/" + rootHandle.Node.TwitterID)
-		content := buildGephiFile(rootHandle, fetchedHandles)
 		writer := obj.NewWriter(ctx)
+		writer.ContentType = "text/plain; charset=utf-8"
+		writer.ContentEncoding = "gzip"
 		_, err = writer.Write(content)
 		if err != nil {
 			closeErr := writer.Close()
@@ -143,109 +448,209 @@ func runTick(ctx context.Context, client *twitter.Client, dataClient *firestore.
 			return "", err
 		}
 		_, err = obj.Update(ctx, storage.ObjectAttrsToUpdate{
-			ContentDisposition: fmt.Sprintf("Attachment; filename=%v.gml", rootHandle.Node.ScreenName),
+			ContentDisposition: contentDisposition(rootHandle.Node.ScreenName + ".gml"),
 		})
 		if err != nil {
 			return "", err
 		}
+		if rootHandle.IncrementalBuild {
+			if err := deleteFragments(ctx, bucket, rootHandle); err != nil {
+				logErrorf("failed to delete fragments: (%v) %v", rootHandle.LoginID, err)
+			}
+		}
 		// Clear the message to empty the UI since it will be replaced with the Download link.
 		rootHandle.Status = ""
 		rootHandle.PrepareGraph = false
 		rootHandle.Node.Done = true
+		rootHandle.CompletedAt = time.Now()
+		rootHandle.NodeCount = len(g.Nodes)
 		if err := saveRootHandle(ctx, dataClient, rootHandle); err != nil {
 			return "", err
 		}
+		// The graph is complete either way, so a failing webhook is only logged.
+		if err := notifyComplete(ctx, rootHandle); err != nil {
+			logErrorf("notify error: (%v) %v: %v", rootHandle.LoginID, rootHandle.Node.TwitterID, err)
+		}
 		return "Graph built", nil
 	}
+	if rootHandle.FetchOrder == fetchOrderFriendsFirst && rootHandle.FriendsCursor != 0 {
+		return advanceFriends(ctx, client, dataClient, loginID, rootHandle)
+	}
 	if rootHandle.FollowersCursor != 0 {
-		addedIDs, nextCursor, err := addFollowersPage(client, &rootHandle.Node, rootHandle.FollowersCursor)
-		if err != nil {
-			return "", err
+		return advanceFollowers(ctx, client, dataClient, loginID, rootHandle)
+	}
+	if rootHandle.FriendsCursor != 0 {
+		return advanceFriends(ctx, client, dataClient, loginID, rootHandle)
+	}
+	if rootHandle.Remaining == -1 {
+		if rootHandle.TweetSampleSize > 0 {
+			tweets, err := getRecentTweets(ctx, client, rootHandle.Node.TwitterID, rootHandle.TweetSampleSize)
+			if err != nil {
+				return "", err
+			}
+			rootHandle.Node.RecentTweets = tweets
 		}
-		rootHandle.FollowersCursor = nextCursor
-		if err := newFetchedHandles(ctx, dataClient, loginID, "Follower", rootHandle.Node.TwitterID, addedIDs); err != nil {
-			return "", err
+		if rootHandle.MutualOnly {
+			// Pages were not enqueued as they arrived, since mutuals are only known once
+			// both directions are complete.
+			mutuals := filterBlocked(mutualIDs(&rootHandle.Node), blockedSet(rootHandle))
+			if err := newFetchedHandles(ctx, dataClient, rootHandle, "Mutual", mutuals); err != nil {
+				return "", err
+			}
 		}
-		msg := fmt.Sprintf("Fetched %v follower IDs", len(addedIDs))
+		// EnqueuedCount grew with the handles as they were written, so the countdown starts
+		// from it.
+		msg := fmt.Sprintf("Enqueued %v handles", rootHandle.EnqueuedCount)
 		rootHandle.Status = msg
+		rootHandle.Remaining = rootHandle.EnqueuedCount
 		if err := saveRootHandle(ctx, dataClient, rootHandle); err != nil {
 			return "", err
 		}
 		return msg, nil
 	}
-	if rootHandle.FriendsCursor != 0 {
-		addedIDs, nextCursor, err := addFriendsPage(client, &rootHandle.Node, rootHandle.FriendsCursor)
-		if err != nil {
-			return "", err
+	// Twitter is called before the transaction rather than inside it, since a transaction is
+	// rerun on contention and would repeat every call.  The transaction then commits what was
+	// collected, leaving out handles another tick advanced meanwhile.
+	fetchedHandles, err := getUnfinishedFetchHandles(ctx, dataClient, loginID, rootHandle, lookupBatchSize)
+	if err != nil {
+		return "", err
+	}
+	if len(fetchedHandles) == 0 {
+		return prepareGraph(ctx, dataClient, rootHandle)
+	}
+	ids := make([]string, 0, len(fetchedHandles))
+	for _, fetchedHandle := range fetchedHandles {
+		ids = append(ids, fetchedHandle.Node.TwitterID)
+	}
+	// Profiles hydrated recently for any job are reused, saving the lookup.
+	usersByID, err := getCachedUsers(ctx, dataClient, ids)
+	if err != nil {
+		return "", err
+	}
+	lookedUp, err := lookUpUncachedUsers(ctx, client, ids, usersByID)
+	if err != nil {
+		return "", err
+	}
+	if len(lookedUp) > 0 {
+		// Only one handle a tick pages its ID lists, so most of a batch of unstarted handles
+		// waits for later ticks.  Their profiles are cached at once for those ticks to reuse,
+		// whatever becomes of this one.
+		if err := putCachedUsers(ctx, dataClient, lookedUp); err != nil {
+			logErrorf("failed to cache %v users: %v", len(lookedUp), err)
 		}
-		rootHandle.FriendsCursor = nextCursor
-		if err := newFetchedHandles(ctx, dataClient, loginID, "Friend", rootHandle.Node.TwitterID, addedIDs); err != nil {
-			return "", err
+	}
+	// The ID lists are rate limited far more tightly than lookups, so only one handle per
+	// tick collects a page of them.  Handles needing none are hydrated with the rest of the
+	// batch.
+	var paged *FetchedHandle
+	var advanced []*advancedHandle
+	sampled := 0
+	for _, fetchedHandle := range fetchedHandles {
+		// A cancelled run, or one out of time, commits the handles advanced so far and leaves
+		// the rest.
+		if runStopped(ctx) || budgetSpent(ctx) {
+			break
 		}
-		msg := fmt.Sprintf("Fetched %v friend IDs", len(addedIDs))
-		rootHandle.Status = msg
-		if err := saveRootHandle(ctx, dataClient, rootHandle); err != nil {
+		twitterUser, ok := usersByID[fetchedHandle.Node.TwitterID]
+		if !ok {
+			continue
+		}
+		step := &advancedHandle{
+			handle:          fetchedHandle,
+			friendsCursor:   fetchedHandle.FriendsCursor,
+			followersCursor: fetchedHandle.FollowersCursor,
+		}
+		started := fetchedHandle.FriendsCursor != 0 || fetchedHandle.FollowersCursor != 0
+		sample := !started && rootHandle.TweetSampleSize > 0 && !twitterUser.Protected
+		if sample && maxTweetSamplesPerTick > 0 && sampled >= maxTweetSamplesPerTick {
+			continue
+		}
+		if !started && fetchedHandle.Hop < 2 {
+			if twitterUser.FriendsCount != 0 {
+				fetchedHandle.FriendsCursor = -1
+			}
+			if twitterUser.FollowersCount != 0 {
+				fetchedHandle.FollowersCursor = -1
+			}
+		}
+		if fetchedHandle.FriendsCursor != 0 || fetchedHandle.FollowersCursor != 0 {
+			if paged != nil {
+				continue
+			}
+			paged = fetchedHandle
+		}
+		if err := advanceFetchedHandle(ctx, client, rootHandle, fetchedHandle); err != nil {
 			return "", err
 		}
-		return msg, nil
+		if sample {
+			tweets, err := getRecentTweets(ctx, client, fetchedHandle.Node.TwitterID, rootHandle.TweetSampleSize)
+			if err != nil {
+				return "", err
+			}
+			fetchedHandle.Node.RecentTweets = tweets
+			sampled++
+		}
+		hydrateHandle(twitterUser, fetchedHandle)
+		advanced = append(advanced, step)
 	}
-	if rootHandle.Remaining == -1 {
-		unique := make(map[string]bool)
-		for _, friend := range rootHandle.Node.FriendIDs {
-			unique[friend] = true
+	if len(advanced) == 0 {
+		if runStopped(ctx) {
+			return "Cancelled by an admin", nil
 		}
-		for _, follower := range rootHandle.Node.FollowerIDs {
-			unique[follower] = true
+		if budgetSpent(ctx) {
+			return "Stopped by the time budget", nil
 		}
-		msg := fmt.Sprintf("Enqueued %v handles", len(unique))
-		rootHandle.Status = msg
-		rootHandle.Remaining = len(unique)
-		if err := saveRootHandle(ctx, dataClient, rootHandle); err != nil {
-			return "", err
+		return "", fmt.Errorf("lookup of %v handles returned none of them", len(fetchedHandles))
+	}
+	// The second hop is enqueued before the handles are marked done, so a failed expansion
+	// leaves them unfinished to be expanded again rather than losing their neighbours.
+	// Neighbours enqueued by an earlier attempt already exist and are not counted twice.
+	if rootHandle.Depth >= 2 {
+		for _, step := range advanced {
+			fetchedHandle := step.handle
+			if !fetchedHandle.Node.Done || fetchedHandle.Hop >= 2 {
+				continue
+			}
+			if err := expandFetchedHandle(ctx, dataClient, rootHandle, fetchedHandle); err != nil {
+				return "", fmt.Errorf("error expanding %v: %v", fetchedHandle.Node.TwitterID, err)
+			}
 		}
-		return msg, nil
 	}
 	tMsg := ""
-	tErr := dataClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+	var hydrated []*FetchedHandle
+	tErr := runTransactionWithRetry(ctx, dataClient, func(ctx context.Context, tx *firestore.Transaction) error {
+		hydrated = nil
 		// Reload the root handle inside the transaction to keep the count accurate in case two updates
 		// are in flight.
 		rootHandle, err := getRootHandleTransaction(ctx, dataClient, tx, rootHandle)
-		fetchedHandle, err := getUnfinishedFetchHandle(ctx, dataClient, tx, loginID, rootHandle)
 		if err != nil {
 			return err
 		}
-		if fetchedHandle == nil {
-			rootHandle.PrepareGraph = true
-			tMsg = "Preparing graph"
-			rootHandle.Status = tMsg
-			rootHandle.Remaining = 0
-			if err := saveRootHandleTransaction(ctx, dataClient, tx, rootHandle); err != nil {
-				return err
-			}
-			return nil
-		}
-		twitterUser, err := getTwitterUser(client, fetchedHandle.Node.TwitterID)
+		saved, err := saveAdvancedHandles(ctx, dataClient, tx, loginID, rootHandle, advanced)
 		if err != nil {
 			return err
 		}
-		if twitterUser.FriendsCount != 0 && twitterUser.FriendsCount <= 5000 {
-			_, _, err := addFriendsPage(client, &fetchedHandle.Node, -1)
-			if err != nil {
-				return err
+		var savedPaged *FetchedHandle
+		for _, fetchedHandle := range saved {
+			if fetchedHandle.Node.Done {
+				hydrated = append(hydrated, fetchedHandle)
+			} else {
+				savedPaged = fetchedHandle
 			}
 		}
-		if twitterUser.FollowersCount != 0 && twitterUser.FollowersCount <= 5000 {
-			_, _, err := addFollowersPage(client, &fetchedHandle.Node, -1)
-			if err != nil {
-				return err
-			}
-		}
-		if err := hydrateHandle(ctx, dataClient, tx, loginID, twitterUser, fetchedHandle); err != nil {
-			return err
+		switch {
+		case len(hydrated) > 1:
+			tMsg = fmt.Sprintf("Fetched %v and %v more", hydrated[0].Node.ScreenName, len(hydrated)-1)
+		case len(hydrated) == 1:
+			tMsg = fmt.Sprintf("Fetched %v", hydrated[0].Node.ScreenName)
+		case savedPaged != nil:
+			tMsg = fmt.Sprintf("Fetching %v, %v IDs so far", savedPaged.Node.ScreenName, len(savedPaged.Node.FriendIDs)+len(savedPaged.Node.FollowerIDs))
+		default:
+			tMsg = "Another tick advanced the same handles"
+			return nil
 		}
-		tMsg = fmt.Sprintf("Fetched %v", fetchedHandle.Node.ScreenName)
 		rootHandle.Status = tMsg
-		rootHandle.Remaining--
+		rootHandle.Remaining -= len(hydrated)
 		if err := saveRootHandleTransaction(ctx, dataClient, tx, rootHandle); err != nil {
 			return err
 		}
@@ -254,29 +659,357 @@ func runTick(ctx context.Context, client *twitter.Client, dataClient *firestore.
 	if tErr != nil {
 		return "", tErr
 	}
+	for _, fetchedHandle := range hydrated {
+		if err := addReferences(ctx, dataClient, rootHandle, &fetchedHandle.Node); err != nil {
+			// The counts only order the crawl, so a failure here should not fail the tick.
+			logErrorf("failed to count references of %v: %v", fetchedHandle.Node.TwitterID, err)
+		}
+	}
+	if rootHandle.IncrementalBuild && len(hydrated) > 0 {
+		bucket, err := newGraphBucket(ctx)
+		if err != nil {
+			return "", err
+		}
+		for _, fetchedHandle := range hydrated {
+			if err := writeFragment(ctx, bucket, rootHandle, fetchedHandle); err != nil {
+				return "", fmt.Errorf("error writing fragment: %v", err)
+			}
+		}
+	}
 	return tMsg, nil
 }
 
+// prepareGraph moves rootHandle on to building its graph once no FetchedHandle is left to
+// hydrate, checking again within the transaction that none was enqueued meanwhile.
+func prepareGraph(ctx context.Context, dataClient *firestore.Client, rootHandle *RootHandle) (string, error) {
+	tMsg := "Preparing graph"
+	err := runTransactionWithRetry(ctx, dataClient, func(ctx context.Context, tx *firestore.Transaction) error {
+		rootHandle, err := getRootHandleTransaction(ctx, dataClient, tx, rootHandle)
+		if err != nil {
+			return err
+		}
+		unfinished, err := hasUnfinishedFetchHandles(ctx, dataClient, tx, rootHandle)
+		if err != nil {
+			return err
+		}
+		if unfinished {
+			tMsg = "Handles were enqueued meanwhile"
+			return nil
+		}
+		rootHandle.PrepareGraph = true
+		rootHandle.Status = tMsg
+		rootHandle.Remaining = 0
+		return saveRootHandleTransaction(ctx, dataClient, tx, rootHandle)
+	})
+	if err != nil {
+		return "", err
+	}
+	return tMsg, nil
+}
+
+// advancedHandle is a FetchedHandle advanced by a tick outside its transaction, together with
+// the cursors it was read with.
+type advancedHandle struct {
+	handle          *FetchedHandle
+	friendsCursor   int64
+	followersCursor int64
+}
+
+// saveAdvancedHandles saves the advanced handles within a Transaction and returns those saved.
+// A handle is left out when its stored copy was finished or moved to other cursors since it was
+// read, as another tick then advanced it first.
+func saveAdvancedHandles(ctx context.Context, client *firestore.Client, tx *firestore.Transaction, userID string, rootHandle *RootHandle, advanced []*advancedHandle) ([]*FetchedHandle, error) {
+	collection := getFetchedHandleCollection(client, userID, rootHandle.Node.TwitterID)
+	refs := make([]*firestore.DocumentRef, 0, len(advanced))
+	for _, step := range advanced {
+		refs = append(refs, collection.Doc(step.handle.Node.TwitterID))
+	}
+	docs, err := tx.GetAll(refs)
+	if err != nil {
+		return nil, err
+	}
+	var saved []*FetchedHandle
+	for i, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		var stored FetchedHandle
+		if err := doc.DataTo(&stored); err != nil {
+			return nil, err
+		}
+		step := advanced[i]
+		if stored.Node.Done || stored.FriendsCursor != step.friendsCursor || stored.FollowersCursor != step.followersCursor {
+			continue
+		}
+		if err := tx.Set(doc.Ref, step.handle); err != nil {
+			return nil, err
+		}
+		saved = append(saved, step.handle)
+	}
+	return saved, nil
+}
+
+// contentDisposition returns an attachment Content-Disposition header value for filename
+// following RFC 6266.  Placeholder screen names such as "NOT FOUND" contain characters that
+// are not valid in a bare token, so an ASCII fallback is quoted and the exact name is
+// percent-encoded in filename*.
+func contentDisposition(filename string) string {
+	fallback := make([]byte, 0, len(filename))
+	encoded := new(strings.Builder)
+	for i := 0; i < len(filename); i++ {
+		c := filename[i]
+		isAttrChar := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+		if isAttrChar {
+			fallback = append(fallback, c)
+			encoded.WriteByte(c)
+			continue
+		}
+		fallback = append(fallback, '_')
+		fmt.Fprintf(encoded, "%%%02X", c)
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, encoded.String())
+}
+
+// advanceFollowers fetches the next page of follower IDs of the root and enqueues them.
+func advanceFollowers(ctx context.Context, client *twitter.Client, dataClient *firestore.Client, loginID string, rootHandle *RootHandle) (string, error) {
+	addedIDs, nextCursor, err := addFollowersPage(ctx, client, &rootHandle.Node, rootHandle.FollowersCursor)
+	if err != nil {
+		return "", err
+	}
+	rootHandle.FollowersCursor = nextCursor
+	rootHandle.FollowerPages++
+	if !rootHandle.MutualOnly {
+		if err := newFetchedHandles(ctx, dataClient, rootHandle, "Follower", filterBlocked(addedIDs, blockedSet(rootHandle))); err != nil {
+			return "", err
+		}
+	}
+	msg := fmt.Sprintf("Fetched %v follower IDs", len(addedIDs))
+	if rootHandle.MaxFollowerPages > 0 && rootHandle.FollowerPages >= rootHandle.MaxFollowerPages && nextCursor != 0 {
+		rootHandle.FollowersCursor = 0
+		rootHandle.FollowersTruncated = true
+		msg += fmt.Sprintf(", sampled after %v pages", rootHandle.FollowerPages)
+	}
+	if countShortPage(rootHandle.Node.TwitterID, "followers", len(addedIDs), nextCursor, &rootHandle.ShortFollowerPages) && rootHandle.FollowersCursor != 0 {
+		rootHandle.FollowersCursor = 0
+		rootHandle.FollowersTruncated = true
+		msg += fmt.Sprintf(", stopped after %v short pages", rootHandle.ShortFollowerPages)
+	}
+	rootHandle.Status = msg
+	if err := saveRootHandle(ctx, dataClient, rootHandle); err != nil {
+		return "", err
+	}
+	return msg, nil
+}
+
+// advanceFriends fetches the next page of friend IDs of the root and enqueues them.
+func advanceFriends(ctx context.Context, client *twitter.Client, dataClient *firestore.Client, loginID string, rootHandle *RootHandle) (string, error) {
+	addedIDs, nextCursor, err := addFriendsPage(ctx, client, &rootHandle.Node, rootHandle.FriendsCursor)
+	if err != nil {
+		return "", err
+	}
+	rootHandle.FriendsCursor = nextCursor
+	rootHandle.FriendPages++
+	if !rootHandle.MutualOnly {
+		if err := newFetchedHandles(ctx, dataClient, rootHandle, "Friend", filterBlocked(addedIDs, blockedSet(rootHandle))); err != nil {
+			return "", err
+		}
+	}
+	msg := fmt.Sprintf("Fetched %v friend IDs", len(addedIDs))
+	if rootHandle.MaxFriendPages > 0 && rootHandle.FriendPages >= rootHandle.MaxFriendPages && nextCursor != 0 {
+		rootHandle.FriendsCursor = 0
+		rootHandle.FriendsTruncated = true
+		msg += fmt.Sprintf(", sampled after %v pages", rootHandle.FriendPages)
+	}
+	if countShortPage(rootHandle.Node.TwitterID, "friends", len(addedIDs), nextCursor, &rootHandle.ShortFriendPages) && rootHandle.FriendsCursor != 0 {
+		rootHandle.FriendsCursor = 0
+		rootHandle.FriendsTruncated = true
+		msg += fmt.Sprintf(", stopped after %v short pages", rootHandle.ShortFriendPages)
+	}
+	rootHandle.Status = msg
+	if err := saveRootHandle(ctx, dataClient, rootHandle); err != nil {
+		return "", err
+	}
+	return msg, nil
+}
+
+// advanceFetchedHandle collects the next page of each unfinished ID list of fetchedHandle,
+// leaving a cursor of zero once a list is complete or reaches the root's page cap.  Protected
+// accounts whose lists cannot be read are marked Protected and finished rather than failing.
+func advanceFetchedHandle(ctx context.Context, client *twitter.Client, rootHandle *RootHandle, fetchedHandle *FetchedHandle) error {
+	err := advanceFetchedHandleLists(ctx, client, rootHandle, fetchedHandle)
+	if errors.Is(err, ErrProtected) {
+		// The lists stay unreadable, so the handle is finished with whatever was collected.
+		fetchedHandle.Node.Protected = true
+		fetchedHandle.FriendsCursor = 0
+		fetchedHandle.FollowersCursor = 0
+		return nil
+	}
+	return err
+}
+
+// advanceFetchedHandleLists collects the next page of each unfinished ID list of fetchedHandle.
+func advanceFetchedHandleLists(ctx context.Context, client *twitter.Client, rootHandle *RootHandle, fetchedHandle *FetchedHandle) error {
+	if fetchedHandle.FriendsCursor != 0 {
+		addedIDs, nextCursor, err := addFriendsPage(ctx, client, &fetchedHandle.Node, fetchedHandle.FriendsCursor)
+		if err != nil {
+			return err
+		}
+		fetchedHandle.FriendsCursor = nextCursor
+		fetchedHandle.FriendPages++
+		if reachedPageCap(fetchedHandle.FriendPages, rootHandle.MaxFriendPages) {
+			fetchedHandle.FriendsCursor = 0
+		}
+		if countShortPage(fetchedHandle.Node.TwitterID, "friends", len(addedIDs), nextCursor, &fetchedHandle.ShortFriendPages) {
+			fetchedHandle.FriendsCursor = 0
+		}
+	}
+	if fetchedHandle.FollowersCursor != 0 {
+		addedIDs, nextCursor, err := addFollowersPage(ctx, client, &fetchedHandle.Node, fetchedHandle.FollowersCursor)
+		if err != nil {
+			return err
+		}
+		fetchedHandle.FollowersCursor = nextCursor
+		fetchedHandle.FollowerPages++
+		if reachedPageCap(fetchedHandle.FollowerPages, rootHandle.MaxFollowerPages) {
+			fetchedHandle.FollowersCursor = 0
+		}
+		if countShortPage(fetchedHandle.Node.TwitterID, "followers", len(addedIDs), nextCursor, &fetchedHandle.ShortFollowerPages) {
+			fetchedHandle.FollowersCursor = 0
+		}
+	}
+	return nil
+}
+
+// maxFetchedHandlePages caps the pages of IDs collected in each direction of a fetched handle,
+// whatever the root's caps.  A FetchedHandle keeps its lists in its own document, which
+// Firestore limits to 1 MiB, so at four pages of 5000 IDs per direction the lists of even
+// the largest hubs still fit.  Zero leaves only the root's caps.
+var maxFetchedHandlePages = envInt("MAX_FETCHED_HANDLE_PAGES", 4)
+
+// reachedPageCap reports whether a direction of a fetched handle that collected pages has
+// reached rootCap, the root's cap for that direction, or maxFetchedHandlePages.
+func reachedPageCap(pages int, rootCap int) bool {
+	if rootCap > 0 && pages >= rootCap {
+		return true
+	}
+	return maxFetchedHandlePages > 0 && pages >= maxFetchedHandlePages
+}
+
+// maxShortPages is how many short pages a direction may return before it is treated as
+// complete.  Twitter sometimes returns pages of far fewer than 5000 IDs with a next cursor
+// anyway, and a pathological account could otherwise trickle IDs forever.  Zero disables it.
+var maxShortPages = envInt("MAX_SHORT_PAGES", 50)
+
+// countShortPage counts a page of added IDs in *shortPages when it was short but not the last,
+// logging once half of maxShortPages, rounded up, have been seen.  It reports whether the
+// direction reached maxShortPages.
+func countShortPage(twitterID string, direction string, added int, nextCursor int64, shortPages *int) bool {
+	if nextCursor == 0 || added >= idsPageSize {
+		return false
+	}
+	*shortPages++
+	if maxShortPages > 0 && *shortPages == (maxShortPages+1)/2 {
+		logInfof("%v of %v returned %v short pages", direction, twitterID, *shortPages)
+	}
+	if maxShortPages > 0 && *shortPages >= maxShortPages {
+		logInfof("%v of %v returned %v short pages, treating %v as complete", direction, twitterID, *shortPages, direction)
+		return true
+	}
+	return false
+}
+
+// mutualIDs returns the IDs that are both friends and followers of n.
+func mutualIDs(n *GephiNode) []string {
+	followers := make(map[string]bool, len(n.FollowerIDs))
+	for _, follower := range n.FollowerIDs {
+		followers[follower] = true
+	}
+	var mutuals []string
+	for _, friend := range n.FriendIDs {
+		if followers[friend] {
+			mutuals = append(mutuals, friend)
+		}
+	}
+	return mutuals
+}
+
+// auditCredentialUse records that loginID's Twitter credentials made the counted calls on
+// behalf of job.  Failing to record is logged rather than failing the caller.
+func auditCredentialUse(ctx context.Context, dataClient *firestore.Client, loginID string, action string, job string, counter *callCounter) {
+	entry := &AuditEntry{
+		LoginID: loginID,
+		Action:  action,
+		Job:     job,
+		Calls:   counter.Calls(),
+		Time:    time.Now(),
+	}
+	logDebugf("audit: (%v) %v %v made %v calls", entry.LoginID, entry.Action, entry.Job, entry.Calls)
+	if err := saveAuditEntry(ctx, dataClient, entry); err != nil {
+		logErrorf("audit error: (%v) %v", loginID, err)
+	}
+}
+
 // logError logs the given error and returns a 500 response.  It is meant to be used in a headless Worker thread.
 func logError(ctx context.Context, w http.ResponseWriter, loginID string, err error) {
 	s := fmt.Sprintf("worker error: (%v) %v", loginID, err)
-	log.Printf(s)
+	logErrorf("%v", s)
 	http.Error(w, s, http.StatusInternalServerError)
 }
 
+// tickBudget is how long a worker run may keep starting jobs, ending it cleanly before the
+// cron request deadline would kill it mid-write.  It is read from TICK_BUDGET_SECONDS.
+var tickBudget = time.Duration(envInt("TICK_BUDGET_SECONDS", 45)) * time.Second
+
+// expectedTickDuration is about how long one job's tick takes, reserved at the end of the
+// budget for the ticks still running.
+const expectedTickDuration = 10 * time.Second
+
+// tickBudgetKey is the context key holding the time by which a worker run should be done.
+type tickBudgetKey struct{}
+
+// withTickBudget returns a context carrying the end of the worker run's time budget.
+func withTickBudget(ctx context.Context, budget time.Time) context.Context {
+	return context.WithValue(ctx, tickBudgetKey{}, budget)
+}
+
+// budgetSpent reports whether the worker run of ctx is past its time budget.  runTick checks it
+// between handles as well as the worker between jobs, so a slow tick commits what it advanced
+// and stops rather than running into the request deadline.
+func budgetSpent(ctx context.Context) bool {
+	budget, ok := ctx.Value(tickBudgetKey{}).(time.Time)
+	return ok && time.Now().After(budget)
+}
+
+// cronSecret, when set, lets a request carrying it in the X-Cron-Secret header run the worker.
+// Off App Engine it is the only way to do so, since any caller can set X-Appengine-Cron there.
+var cronSecret = os.Getenv("CRON_SECRET")
+
+// onAppEngine reports whether the server runs on App Engine, which strips X-Appengine-Cron
+// from requests that do not come from its cron service.
+var onAppEngine = os.Getenv("GAE_APPLICATION") != ""
+
+// isCronRequest reports whether r was sent by the scheduler that drives the worker.
+func isCronRequest(r *http.Request) bool {
+	if cronSecret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Cron-Secret")), []byte(cronSecret)) == 1 {
+		return true
+	}
+	return onAppEngine && r.Header.Get("X-Appengine-Cron") == "true"
+}
+
 // workerHandler processes URLs starting with workerPrefix(?/$USERID)(?/$TWITTERID), updating the state machine.
 // If USERID and TWITTERID are specified, advance that user and handle.
 // If just USERID is specified, advance that user.
 // If neither, advance all users.
 func workerHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	if r.Header.Get("X-Appengine-Cron") != "true" {
+	if !isCronRequest(r) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	} else if time.Now().Minute()%10 == 0 {
 		const SkipMessage = "Skipping tick"
-		log.Printf(SkipMessage)
-		fmt.Fprintf(w, SkipMessage)
+		logDebugf("%v", SkipMessage)
+		fmt.Fprint(w, SkipMessage)
 		return
 	}
 	args := strings.Split(strings.TrimPrefix(r.URL.Path, workerPrefix), "/")
@@ -305,7 +1038,7 @@ func workerHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		rootHandles = append(rootHandles, rootHandle)
 	} else {
-		handles, err := getRootHandlePerUser(ctx, dataClient)
+		handles, err := getRootHandlePerUser(ctx, dataClient, usersPerTick)
 		if err != nil {
 			logError(ctx, w, "", err)
 			return
@@ -316,68 +1049,213 @@ func workerHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "User done")
 		return
 	}
-	for _, rootHandle := range rootHandles {
-		client, err := newUserTwitterClient(ctx, dataClient, rootHandle.LoginID)
-		if err != nil {
-			s := fmt.Sprintf("twitter error: (%v) %v", rootHandle.LoginID, err)
-			if tErr := updateRootHandleStatus(ctx, dataClient, s, rootHandle); err != nil {
-				s = s + fmt.Sprintf(" and couldn't save: %v", tErr)
-			}
-			log.Printf(s)
-			fmt.Fprintf(w, s)
-			continue
+	runCtx, done, err := startWorkerRun(ctx, dataClient, r.URL.Path)
+	if err != nil {
+		logError(ctx, w, "", err)
+		return
+	}
+	defer done()
+	// With several jobs running at once each may start just before the budget ends, so jobs
+	// only start while a whole tick still fits.  Ticks stop between handles at the budget,
+	// which ends a tick ahead of the request deadline to leave them time to commit.
+	budget := time.Now().Add(tickBudget)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Add(-expectedTickDuration).Before(budget) {
+		budget = deadline.Add(-expectedTickDuration)
+	}
+	startBudget := budget.Add(-expectedTickDuration)
+	runCtx = withTickBudget(runCtx, budget)
+	// Each job runs with its own user's Twitter client, so rate limits stay per user, and its
+	// own transactions; only the firestore client is shared.  Statuses are written in order at
+	// the end.
+	statuses := make([]string, len(rootHandles))
+	concurrency := workerConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, rootHandle := range rootHandles {
+		slots <- struct{}{}
+		if runStopped(runCtx) {
+			<-slots
+			s := fmt.Sprintf("Cancelled by an admin, skipped %v jobs", len(rootHandles)-i)
+			logInfof("%v", s)
+			statuses[i] = s
+			break
 		}
-		status, err := runTick(ctx, client, dataClient, rootHandle.LoginID, rootHandle)
-		if err != nil {
-			s := fmt.Sprintf("worker error: (%v) %v", rootHandle.LoginID, err)
-			if tErr := updateRootHandleStatus(ctx, dataClient, s, rootHandle); err != nil {
-				s = s + fmt.Sprintf(" and couldn't save: %v", tErr)
+		if time.Now().After(startBudget) {
+			<-slots
+			// Jobs are only started while time remains, so none is cut off mid-write.  The
+			// note goes to LastError, leaving the progress in Status as it was.
+			deferred := rootHandles[i:]
+			for _, skipped := range deferred {
+				if err := updateRootHandleError(ctx, dataClient, "Deferred to the next run by the time budget", skipped); err != nil {
+					logErrorf("failed to save error: (%v) %v", skipped.LoginID, err)
+				}
 			}
-			log.Printf(s)
-			fmt.Fprintf(w, s)
-			continue
+			s := fmt.Sprintf("Stopped early due to time budget, deferred %v jobs", len(deferred))
+			logInfof("%v", s)
+			statuses[i] = s
+			break
+		}
+		wg.Add(1)
+		go func(i int, rootHandle *RootHandle) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			statuses[i] = tickRootHandle(runCtx, dataClient, rootHandle)
+		}(i, rootHandle)
+	}
+	wg.Wait()
+	for _, s := range statuses {
+		fmt.Fprint(w, s)
+	}
+}
+
+// tickRootHandle runs one tick of rootHandle with the Twitter credentials of its user, saving
+// any failure to its status.  The outcome is returned for the worker's response.
+func tickRootHandle(ctx context.Context, dataClient *firestore.Client, rootHandle *RootHandle) string {
+	client, counter, err := newUserTwitterClient(ctx, dataClient, rootHandle.LoginID)
+	if err != nil {
+		s := fmt.Sprintf("twitter error: (%v) %v", rootHandle.LoginID, err)
+		if tErr := updateRootHandleError(ctx, dataClient, s, rootHandle); tErr != nil {
+			s = s + fmt.Sprintf(" and couldn't save: %v", tErr)
+		}
+		logErrorf("%v", s)
+		return s
+	}
+	tickCtx, throttled := withThrottleTimer(ctx)
+	status, err := runTick(tickCtx, client, dataClient, rootHandle.LoginID, rootHandle)
+	if d := time.Duration(atomic.LoadInt64(throttled)); d > 0 {
+		logInfof("tick throttled: (%v) waited %v for firestore writes", rootHandle.LoginID, d)
+		status = fmt.Sprintf("%v (throttled %v)", status, d)
+	}
+	auditCredentialUse(ctx, dataClient, rootHandle.LoginID, "tick", rootHandle.Node.TwitterID, counter)
+	if errors.Is(err, ErrRateLimited) {
+		// Nothing was advanced, so the next tick retries the same step once the limit resets.
+		s := rateLimitStatus(err)
+		if tErr := updateRootHandleStatus(ctx, dataClient, s, rootHandle); tErr != nil {
+			logErrorf("failed to save status: (%v) %v", rootHandle.LoginID, tErr)
+		}
+		logInfof("rate limited: (%v) %v", rootHandle.LoginID, s)
+		return fmt.Sprintf(`Updated %v: %v`, rootHandle.LoginID, s)
+	}
+	if err != nil {
+		s := fmt.Sprintf("worker error: (%v) %v", rootHandle.LoginID, err)
+		if tErr := updateRootHandleError(ctx, dataClient, s, rootHandle); tErr != nil {
+			s = s + fmt.Sprintf(" and couldn't save: %v", tErr)
+		}
+		logErrorf("%v", s)
+		return s
+	}
+	if rootHandle.LastError != "" {
+		if err := updateRootHandleError(ctx, dataClient, "", rootHandle); err != nil {
+			logErrorf("failed to clear error: (%v) %v", rootHandle.LoginID, err)
 		}
-		fmt.Fprintf(w, `Updated %v: %v`, rootHandle.LoginID, status)
 	}
+	logDebugf("Updated %v: %v", rootHandle.LoginID, status)
+	return fmt.Sprintf(`Updated %v: %v`, rootHandle.LoginID, status)
 }
 
-// getFirebaseUserFromToken returns the user ID of the logged in user.
-func getFirebaseUserFromToken(ctx context.Context, token string) (string, error) {
+// verifyFirebaseToken verifies the Firebase ID token and returns its contents.
+func verifyFirebaseToken(ctx context.Context, token string) (*auth.Token, error) {
 	config := &firebase.Config{
 		ProjectID: ProjectID,
 	}
 	app, err := firebase.NewApp(ctx, config)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	authClient, err := app.Auth(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	t, err := authClient.VerifyIDToken(ctx, token)
-	if err != nil {
-		return "", err
+	return authClient.VerifyIDToken(ctx, token)
+}
+
+// getTwitterIdentity returns the TwitterID the Firebase user signed in with, or "" if the
+// token carries no Twitter identity.
+func getTwitterIdentity(t *auth.Token) string {
+	firebaseClaim, _ := t.Claims["firebase"].(map[string]interface{})
+	identities, _ := firebaseClaim["identities"].(map[string]interface{})
+	twitterIDs, _ := identities["twitter.com"].([]interface{})
+	if len(twitterIDs) == 0 {
+		return ""
 	}
-	return t.UID, nil
+	twitterID, _ := twitterIDs[0].(string)
+	return twitterID
 }
 
-// addHandleHandler enqueues a new handle for fetching.  Its POST body should include:
+// addHandleHandler enqueues a new handle for fetching and responds with the created job as
+// JSON.  Its POST body should include:
 // auth - the Firebase token
-// handle - the handle to fetch.
+// handle - the screen name, with or without "@", or the numeric ID of the account to fetch
+// tweets - optionally, the number of recent tweets to sample per node
+// order - optionally, which direction to collect first
+// exclude - optionally, TwitterIDs or screen names to leave out of the crawl
+// maxFollowerPages, maxFriendPages - optionally, page caps that sample enormous accounts
+// incremental - optionally, "true" to assemble the graph in fragments during the crawl
+// mutual - optionally, "true" to crawl only accounts the handle mutually follows
+// export options - optionally, any option read by parseExportOptions, applied to the stored graph.
 func addHandleHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	authToken := r.FormValue("auth")
-	loginID, err := getFirebaseUserFromToken(ctx, authToken)
+	loginID := loginIDFromContext(ctx)
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	client, counter, err := newUserTwitterClient(ctx, dataClient, loginID)
+	if err != nil {
+		writeHandlerError(w, "failed to connect Twitter", err)
+		return
+	}
+	opts, err := parseJobOptions(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "failed to validate firebase token: %v", err)
+		fmt.Fprintf(w, "invalid options: %v", err)
 		return
 	}
+	rootHandle, err := enqueueHandle(ctx, client, dataClient, loginID, r.FormValue("handle"), opts)
+	auditCredentialUse(ctx, dataClient, loginID, "addHandle", r.FormValue("handle"), counter)
+	if err != nil {
+		writeHandlerError(w, "failed to load handle", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rootHandle)
+}
+
+// HandleCheck describes whether a handle already has a job for the user.
+type HandleCheck struct {
+	TwitterID  string
+	ScreenName string
+	Exists     bool
+	Done       bool
+	Status     string
+	// StatusURL is the absolute address of the existing job's progress.
+	StatusURL string `json:",omitempty"`
+	// DownloadURL is the absolute address of the existing job's graph, set once it is ready.
+	DownloadURL string `json:",omitempty"`
+}
+
+// checkHandleHandler resolves a handle and reports whether the user already has a job for it,
+// so the frontend can offer the existing job instead of failing on submit.  The POST body
+// should include:
+// auth - the Firebase token
+// handle - the screen name or numeric ID to check.
+func checkHandleHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
 	dataClient, err := newFirestoreClient(ctx)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -385,18 +1263,34 @@ func addHandleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer dataClient.Close()
-	client, err := newUserTwitterClient(ctx, dataClient, loginID)
+	client, counter, err := newUserTwitterClient(ctx, dataClient, loginID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "failed to connect Twitter: %v", err)
+		writeHandlerError(w, "failed to connect Twitter", err)
 		return
 	}
-	_, err = enqueueHandle(ctx, client, dataClient, loginID, r.FormValue("handle"))
+	user, err := getTwitterUserByHandle(ctx, client, r.FormValue("handle"))
+	auditCredentialUse(ctx, dataClient, loginID, "checkHandle", r.FormValue("handle"), counter)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "failed to load handle: %v", err)
+		writeHandlerError(w, "failed to load handle", err)
 		return
 	}
+	check := &HandleCheck{TwitterID: user.IDStr, ScreenName: user.ScreenName}
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, loginID, user.IDStr)
+	switch {
+	case err == nil:
+		check.Exists = true
+		check.Done = rootHandle.Node.Done
+		check.Status = rootHandle.Status
+		check.StatusURL = statusURL(rootHandle)
+		if rootHandle.Node.Done {
+			check.DownloadURL = downloadURL(rootHandle)
+		}
+	case !errors.Is(err, ErrHandleNotFound):
+		writeHandlerError(w, "failed to check handle", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check)
 }
 
 // deleteHandleHandler deletes a fetch task on behalf of a user.  The POST body
@@ -405,18 +1299,42 @@ func addHandleHandler(w http.ResponseWriter, r *http.Request) {
 // id - the TwitterID of the handle to delete.
 func deleteHandleHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	authToken := r.FormValue("auth")
-	loginID, err := getFirebaseUserFromToken(ctx, authToken)
+	loginID := loginIDFromContext(ctx)
+	dataClient, err := newFirestoreClient(ctx)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "failed to validate firebase token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, loginID, r.FormValue("id"))
+	if err != nil {
+		writeHandlerError(w, "could not find identified user", err)
+		return
+	}
+	err = deleteRootHandle(ctx, dataClient, rootHandle)
+	if err != nil {
+		writeHandlerError(w, "failed to delete handle", err)
+		return
+	}
+}
+
+// refreshHandleHandler re-fetches a handle from Twitter by its stable ID and updates the stored
+// screen name and profile fields, since accounts may rename themselves during or after a fetch.
+// The POST body should contain:
+// auth - the Firebase token
+// id - the TwitterID of the handle to refresh.
+func refreshHandleHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	loginID := loginIDFromContext(ctx)
 	dataClient, err := newFirestoreClient(ctx)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -426,39 +1344,48 @@ func deleteHandleHandler(w http.ResponseWriter, r *http.Request) {
 	defer dataClient.Close()
 	rootHandle, err := getRootHandleFromString(ctx, dataClient, loginID, r.FormValue("id"))
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "could not find identified user: %v", err)
+		writeHandlerError(w, "could not find identified user", err)
 		return
 	}
-	err = deleteRootHandle(ctx, dataClient, rootHandle)
+	client, counter, err := newUserTwitterClient(ctx, dataClient, loginID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "failed to delete handle: %v", err)
+		writeHandlerError(w, "failed to connect Twitter", err)
 		return
 	}
+	twitterUser, err := getTwitterUser(ctx, client, rootHandle.Node.TwitterID)
+	auditCredentialUse(ctx, dataClient, loginID, "refreshHandle", rootHandle.Node.TwitterID, counter)
+	if err != nil {
+		writeHandlerError(w, "failed to load handle", err)
+		return
+	}
+	if twitterUser.ID == 0 {
+		// getTwitterUser substitutes a placeholder for suspended and deleted accounts.
+		writeHandlerError(w, "failed to load handle", fmt.Errorf("%w: %v", ErrHandleNotFound, twitterUser.ScreenName))
+		return
+	}
+	if err := updateRootHandleProfile(ctx, dataClient, rootHandle, twitterUser); err != nil {
+		writeHandlerError(w, "failed to update handle", err)
+		return
+	}
+	fmt.Fprintf(w, "%v", twitterUser.ScreenName)
 }
 
 // updateUserHandler implements a POST handler that captures a user's Twitter
 // credentials for later use in background fetch tasks.
+// The credentials must have been issued for the Twitter account the user signed in with.
 // The post contents should contain:
 // auth - the Firebase token
-// name - the user's handle
+// name - the user's display name; the screen name Twitter reports for the credentials is stored instead
 // token - the Twitter token
 // secret - the Twitter secret.
 func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	authToken := r.FormValue("auth")
-	loginID, err := getFirebaseUserFromToken(ctx, authToken)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "failed to validate firebase token: %v", err)
-		return
-	}
+	firebaseToken := firebaseTokenFromContext(ctx)
+	loginID := firebaseToken.UID
 	accessToken := r.FormValue("token")
 	accessSecret := r.FormValue("secret")
 	if accessToken == "" || accessSecret == "" {
@@ -480,7 +1407,19 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if appUser == nil || appUser.AccessToken != accessToken || appUser.AccessSecret != accessSecret {
-		if err := saveApplicationUser(ctx, dataClient, loginID, r.FormValue("name"), accessToken, accessSecret); err != nil {
+		// Only bind credentials that were actually issued for the account the user logged in with.
+		twitterUser, err := verifyTwitterCredentials(ctx, accessToken, accessSecret)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "failed to verify twitter tokens: %v", err)
+			return
+		}
+		if twitterUser.IDStr != getTwitterIdentity(firebaseToken) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "twitter tokens belong to a different account")
+			return
+		}
+		if err := saveApplicationUser(ctx, dataClient, loginID, twitterUser.IDStr, twitterUser.ScreenName, accessToken, accessSecret); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "failed to update user: %v", err)
 			return
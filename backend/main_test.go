@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"mime"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCountShortPage(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	defer func(v int) { maxShortPages = v }(maxShortPages)
+	tests := []struct {
+		cap      int
+		pages    int
+		wantStop bool
+		wantWarn bool
+	}{
+		{cap: 1, pages: 1, wantStop: true, wantWarn: true},
+		{cap: 4, pages: 1, wantStop: false, wantWarn: false},
+		{cap: 4, pages: 2, wantStop: false, wantWarn: true},
+		{cap: 4, pages: 4, wantStop: true, wantWarn: true},
+		{cap: 5, pages: 3, wantStop: false, wantWarn: true},
+		{cap: 0, pages: 100, wantStop: false, wantWarn: false},
+	}
+	for _, tt := range tests {
+		maxShortPages = tt.cap
+		logged.Reset()
+		shortPages := 0
+		stopped := false
+		for i := 0; i < tt.pages; i++ {
+			stopped = countShortPage("1", "friends", 10, 1, &shortPages)
+		}
+		if stopped != tt.wantStop {
+			t.Errorf("cap %v after %v pages: stopped = %v, want %v", tt.cap, tt.pages, stopped, tt.wantStop)
+		}
+		warned := strings.Contains(logged.String(), "short pages")
+		if warned != tt.wantWarn {
+			t.Errorf("cap %v after %v pages: warned = %v, want %v (log %q)", tt.cap, tt.pages, warned, tt.wantWarn, logged.String())
+		}
+	}
+	shortPages := 0
+	if countShortPage("1", "friends", 10, 0, &shortPages) || shortPages != 0 {
+		t.Errorf("the last page was counted as short")
+	}
+	if countShortPage("1", "friends", idsPageSize, 1, &shortPages) || shortPages != 0 {
+		t.Errorf("a full page was counted as short")
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "jack.gml", want: `attachment; filename="jack.gml"; filename*=UTF-8''jack.gml`},
+		{name: "NOT FOUND.gml", want: `attachment; filename="NOT_FOUND.gml"; filename*=UTF-8''NOT%20FOUND.gml`},
+		{name: `a"b;c.gml`, want: `attachment; filename="a_b_c.gml"; filename*=UTF-8''a%22b%3Bc.gml`},
+	}
+	for _, tt := range tests {
+		got := contentDisposition(tt.name)
+		if got != tt.want {
+			t.Errorf("contentDisposition(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		disposition, params, err := mime.ParseMediaType(got)
+		if err != nil || disposition != "attachment" || params["filename"] != tt.name {
+			t.Errorf("contentDisposition(%q) parses as %q %v (%v), want the name back", tt.name, disposition, params, err)
+		}
+	}
+}
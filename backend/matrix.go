@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// maxMatrixNodes caps the nodes of an adjacency matrix export, whose size grows with the
+// square of the node count.
+const maxMatrixNodes = 2000
+
+// buildMatrixCSV returns the graph as an N×N adjacency matrix in CSV.  The header row and the
+// first column hold the TwitterIDs in ascending numeric order, and the cell in row i and column
+// j is 1 when node i has an edge to node j, making the matrix symmetric for an undirected graph.
+// Graphs above maxMatrixNodes are rejected.
+func buildMatrixCSV(rootHandle *RootHandle, fetchedHandles []*FetchedHandle, opts *ExportOptions) ([]byte, error) {
+	g := collectGraph(rootHandle, fetchedHandles, opts)
+	if len(g.Nodes) > maxMatrixNodes {
+		return nil, fmt.Errorf("graph has %v nodes but a matrix is limited to %v", len(g.Nodes), maxMatrixNodes)
+	}
+	ids := make([]string, 0, len(g.Nodes))
+	for _, n := range g.Nodes {
+		ids = append(ids, n.TwitterID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, aErr := strconv.ParseUint(ids[i], 10, 64)
+		b, bErr := strconv.ParseUint(ids[j], 10, 64)
+		if aErr != nil || bErr != nil {
+			return ids[i] < ids[j]
+		}
+		return a < b
+	})
+	index := make(map[string]int, len(ids))
+	for i, id := range ids {
+		index[id] = i
+	}
+	matrix := make([][]bool, len(ids))
+	for i := range matrix {
+		matrix[i] = make([]bool, len(ids))
+	}
+	for _, edge := range g.Edges {
+		matrix[index[edge.Source]][index[edge.Target]] = true
+		if g.Undirected {
+			matrix[index[edge.Target]][index[edge.Source]] = true
+		}
+	}
+	b := new(bytes.Buffer)
+	w := csv.NewWriter(b)
+	w.Write(append([]string{""}, ids...))
+	row := make([]string, len(ids)+1)
+	for i, id := range ids {
+		row[0] = id
+		for j, connected := range matrix[i] {
+			row[j+1] = "0"
+			if connected {
+				row[j+1] = "1"
+			}
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// mergedDownloadPrefix builds one graph out of several completed handles.
+const mergedDownloadPrefix = "/downloadMerged"
+
+// maxMergedGraphs bounds how many graphs one merged download may combine.
+const maxMergedGraphs = 10
+
+// mergeGraphs combines collected graphs into one, keeping each account and edge once.  The
+// roots of the graphs become its seeds; a seed that is also an ordinary node of another graph
+// keeps the data of its own root.  Nodes are written seeds first and edges in order.
+func mergeGraphs(graphs []*graphData, opts *ExportOptions) *graphData {
+	merged := &graphData{Undirected: opts.Mode == exportModeMutual}
+	nodes := make(map[string]bool)
+	for _, g := range graphs {
+		merged.Seeds = append(merged.Seeds, g.Root)
+		if !nodes[g.Root.Node.TwitterID] {
+			nodes[g.Root.Node.TwitterID] = true
+			merged.Nodes = append(merged.Nodes, &g.Root.Node)
+		}
+	}
+	edges := make(map[graphEdge]bool)
+	for _, g := range graphs {
+		for _, n := range g.Nodes {
+			if !nodes[n.TwitterID] {
+				nodes[n.TwitterID] = true
+				merged.Nodes = append(merged.Nodes, n)
+			}
+		}
+		for _, edge := range g.Edges {
+			key := graphEdge{Source: edge.Source, Target: edge.Target}
+			if !edges[key] {
+				edges[key] = true
+				merged.Edges = append(merged.Edges, edge)
+			}
+		}
+		merged.EdgesDropped += g.EdgesDropped
+		merged.NodesDropped += g.NodesDropped
+		merged.ComponentsDropped += g.ComponentsDropped
+	}
+	// A follow is mutual when any of the graphs holds its reverse.
+	for i, edge := range merged.Edges {
+		merged.Edges[i].Mutual = merged.Undirected || edges[graphEdge{Source: edge.Target, Target: edge.Source}]
+	}
+	sort.Slice(merged.Edges, func(i, j int) bool {
+		if merged.Edges[i].Source != merged.Edges[j].Source {
+			return merged.Edges[i].Source < merged.Edges[j].Source
+		}
+		return merged.Edges[i].Target < merged.Edges[j].Target
+	})
+	if opts.Layout {
+		merged.Positions = circularLayout(merged.Nodes)
+	}
+	if opts.SequentialIDs {
+		merged.IDs = sequentialIDs(merged.Nodes)
+	}
+	return merged
+}
+
+// mergedDownloadHandler builds a GML file combining the graphs of several completed handles.
+// Each original root is tagged as a seed.  The request should include:
+// auth - the Firebase token
+// ids - the comma separated TwitterIDs of the handles, at most maxMergedGraphs
+// the export options read by parseExportOptions, applied over those saved with each job.
+func mergedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	var ids []string
+	for _, id := range strings.Split(r.FormValue("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxMergedGraphs {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid options: ids must name between 1 and %v handles", maxMergedGraphs)
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	var graphs []*graphData
+	var mergedOpts *ExportOptions
+	for _, id := range ids {
+		rootHandle, err := getRootHandleFromString(ctx, dataClient, loginID, id)
+		if err != nil {
+			writeHandlerError(w, "could not find identified user", err)
+			return
+		}
+		if !rootHandle.Node.Done {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "graph of %v is not ready", rootHandle.Node.ScreenName)
+			return
+		}
+		opts, err := parseExportOptions(r, rootHandle.ExportOptions)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid options: %v", err)
+			return
+		}
+		fetchedHandles, err := getDoneJobs(ctx, dataClient, rootHandle)
+		if err != nil {
+			writeHandlerError(w, "error getting handles", err)
+			return
+		}
+		// Each graph is laid out and numbered once merged rather than around its own root.
+		collectOpts := *opts
+		collectOpts.Layout = false
+		collectOpts.SequentialIDs = false
+		graphs = append(graphs, collectGraph(rootHandle, fetchedHandles, &collectOpts))
+		if mergedOpts == nil {
+			mergedOpts = opts
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition("merged.gml"))
+	w.Write(writeGephiGraph(mergeGraphs(graphs, mergedOpts), mergedOpts))
+}
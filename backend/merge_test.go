@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergeGraphsTagsSeeds(t *testing.T) {
+	first := testRoot("1", "2")
+	first.Node.ScreenName = "first"
+	second := testRoot("2", "1", "3")
+	second.Node.ScreenName = "second"
+	opts := &ExportOptions{}
+	// Each root is also an ordinary node of the other graph.
+	merged := mergeGraphs([]*graphData{
+		collectGraph(first, []*FetchedHandle{testHandle("2", 10)}, opts),
+		collectGraph(second, []*FetchedHandle{testHandle("1", 10), testHandle("3", 10)}, opts),
+	}, opts)
+	var nodes []string
+	for _, n := range merged.Nodes {
+		nodes = append(nodes, n.TwitterID)
+	}
+	if got, want := strings.Join(nodes, ","), "1,2,3"; got != want {
+		t.Errorf("merged nodes = %v, want %v", got, want)
+	}
+	if merged.Nodes[1] != &second.Node {
+		t.Errorf("seed 2 is written with the data of %+v, want its own root", merged.Nodes[1])
+	}
+	seeds := merged.seedNames()
+	if len(seeds) != 2 || seeds["1"] != "first" || seeds["2"] != "second" {
+		t.Errorf("seedNames() = %v, want both roots", seeds)
+	}
+	gml := string(writeGephiGraph(merged, opts))
+	if got := strings.Count(gml, "seed 1"); got != 2 {
+		t.Errorf("GML tags %v nodes as seeds, want 2", got)
+	}
+	for _, name := range []string{"first", "second"} {
+		if !strings.Contains(gml, `seed_screen_name "`+name+`"`) {
+			t.Errorf("GML has no seed_screen_name %q", name)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// notifyTimeout bounds the webhook call made when a fetch completes, so that a slow endpoint
+// cannot hold up the worker.
+const notifyTimeout = 10 * time.Second
+
+// completionNotice is the JSON body posted to a RootHandle's NotifyURL.
+type completionNotice struct {
+	TwitterID   string `json:"twitter_id"`
+	ScreenName  string `json:"screen_name"`
+	NodeCount   int    `json:"node_count"`
+	DownloadURL string `json:"download_url"`
+}
+
+// appBaseURL is the scheme and host links back to the app are built on, from APP_BASE_URL,
+// falling back to the default App Engine host of the project.
+var appBaseURL = parseAppBaseURL(os.Getenv("APP_BASE_URL"))
+
+// parseAppBaseURL returns raw without a trailing slash, or the default App Engine host of the
+// project when raw is empty.
+func parseAppBaseURL(raw string) string {
+	if raw == "" {
+		return "https://" + ProjectID + ".appspot.com"
+	}
+	return strings.TrimRight(raw, "/")
+}
+
+// blockedNetworks are the private, shared and unique local ranges a webhook may not reach,
+// since it is called from inside the project's network.  Loopback, link-local and unspecified
+// addresses are refused by isPublicIP too.
+var blockedNetworks = parseCIDRs("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+// parseCIDRs parses each of cidrs, which must be valid.
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// isPublicIP reports whether ip may be the address of a webhook.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNotifyURL checks a webhook URL given at enqueue time.  Only absolute https URLs are
+// accepted, since the notice names the user's graph, and only hosts whose addresses are all
+// public, since the webhook is called from inside the project's network.
+func parseNotifyURL(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return "", fmt.Errorf("notifyURL must be an absolute https URL")
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return "", fmt.Errorf("notifyURL host could not be resolved: %v", err)
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return "", fmt.Errorf("notifyURL must not name a private address")
+		}
+	}
+	return u.String(), nil
+}
+
+// notifyClient calls webhooks, refusing to connect to addresses that are not public in case
+// the host resolves differently than when its URL was checked.
+var notifyClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: notifyTimeout,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("webhook address %v is not public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: notifyTimeout,
+	},
+}
+
+// appURL returns the absolute address of path on the app, with the given query.
+func appURL(path string, query url.Values) string {
+	return appBaseURL + path + "?" + query.Encode()
+}
+
+// downloadURL returns the address the graph of rootHandle is downloaded from.  The caller
+// still needs to sign in to use it.
+func downloadURL(rootHandle *RootHandle) string {
+	return appURL(downloadPrefix, url.Values{"id": {rootHandle.Node.TwitterID}})
+}
+
+// statusURL returns the address of the progress of rootHandle in the statuses API.  The caller
+// still needs to sign in to use it.
+func statusURL(rootHandle *RootHandle) string {
+	return appURL(apiStatusesPrefix, url.Values{"ids": {rootHandle.Node.TwitterID}})
+}
+
+// notifyComplete posts a completionNotice to the NotifyURL of rootHandle, if it has one.
+func notifyComplete(ctx context.Context, rootHandle *RootHandle) error {
+	if rootHandle.NotifyURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(&completionNotice{
+		TwitterID:   rootHandle.Node.TwitterID,
+		ScreenName:  rootHandle.Node.ScreenName,
+		NodeCount:   rootHandle.NodeCount,
+		DownloadURL: downloadURL(rootHandle),
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", rootHandle.NotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := notifyClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNotifyURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		wantErr bool
+	}{
+		{"", false},
+		{"https://8.8.8.8/hook", false},
+		{"https://[2001:4860:4860::8888]/hook", false},
+		{"http://8.8.8.8/hook", true},
+		{"/hook", true},
+		{"https://127.0.0.1/hook", true},
+		{"https://[::1]/hook", true},
+		{"https://localhost:8080/hook", true},
+		{"https://10.1.2.3/hook", true},
+		{"https://172.20.0.1/hook", true},
+		{"https://192.168.1.1/hook", true},
+		{"https://100.64.0.1/hook", true},
+		{"https://169.254.169.254/computeMetadata/v1/", true},
+		{"https://[fe80::1]/hook", true},
+		{"https://[fd00::1]/hook", true},
+		{"https://0.0.0.0/hook", true},
+	}
+	for _, tt := range tests {
+		_, err := parseNotifyURL(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseNotifyURL(%q) error = %v, want error %v", tt.raw, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"172.32.0.1", true},
+		{"127.0.0.2", false},
+		{"172.31.255.255", false},
+		{"169.254.1.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIP(%v) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestParseAppBaseURL(t *testing.T) {
+	if got, want := parseAppBaseURL(""), "https://"+ProjectID+".appspot.com"; got != want {
+		t.Errorf("parseAppBaseURL(\"\") = %q, want %q", got, want)
+	}
+	if got, want := parseAppBaseURL("https://graphs.example.com/"), "https://graphs.example.com"; got != want {
+		t.Errorf("parseAppBaseURL() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// preferencesPrefix reads and updates the signed in user's default export settings.
+const preferencesPrefix = "/preferences"
+
+// exportPreferences is the JSON form of the export settings saved on a User.
+type exportPreferences struct {
+	Format  string
+	Options ExportOptions
+}
+
+// preferencesHandler returns the user's preferred export format and options as JSON.  A POST
+// updates them first, taking the same parameters as downloadHandler over the saved ones:
+// auth - the Firebase token
+// format - optionally, the preferred format
+// the export options read by parseExportOptions.
+func preferencesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	appUser, err := getApplicationUser(ctx, dataClient, loginID)
+	if err != nil {
+		writeHandlerError(w, "failed to load user", err)
+		return
+	}
+	prefs := &exportPreferences{}
+	if appUser != nil {
+		prefs.Format = appUser.ExportFormat
+		prefs.Options = appUser.ExportOptions
+	}
+	if r.Method == "POST" {
+		opts, err := parseExportOptions(r, prefs.Options)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid options: %v", err)
+			return
+		}
+		format, err := parseExportFormat(r, prefs.Format, opts)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid options: %v", err)
+			return
+		}
+		if err := saveUserPreferences(ctx, dataClient, loginID, format, opts); err != nil {
+			writeHandlerError(w, "failed to save preferences", err)
+			return
+		}
+		prefs.Format = format
+		prefs.Options = *opts
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+// cleanupPrefix is run by cron to delete completed jobs older than the retention period.
+const cleanupPrefix = "/cron/cleanup"
+
+// retentionDays is how long a completed job is kept before cleanupHandler deletes it, read
+// from RETENTION_DAYS.  Zero, the default, never deletes anything.
+var retentionDays = envInt("RETENTION_DAYS", 0)
+
+// cleanupHandler is run by cron to delete the RootHandles, and their FetchedHandles, of jobs
+// completed more than retentionDays ago, along with their stored graphs and fragments.  The
+// objects go first, so a failure part way leaves the job to be deleted again on the next run
+// rather than orphaning them.  Jobs completed before CompletedAt was recorded are never deleted.
+func cleanupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !isCronRequest(r) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if retentionDays <= 0 {
+		fmt.Fprint(w, "Retention disabled")
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		logError(ctx, w, "", err)
+		return
+	}
+	defer dataClient.Close()
+	bucket, err := newGraphBucket(ctx)
+	if err != nil {
+		logError(ctx, w, "", err)
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+	iter := getUserCollection(dataClient).Documents(ctx)
+	defer iter.Stop()
+	deleted := 0
+	for {
+		userDoc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			logError(ctx, w, "", err)
+			return
+		}
+		rootHandles, err := getExpiredRootHandles(ctx, dataClient, userDoc.Ref.ID, cutoff)
+		if err != nil {
+			logErrorf("cleanup error: (%v) %v", userDoc.Ref.ID, err)
+			continue
+		}
+		for _, rootHandle := range rootHandles {
+			if err := deleteGraphObjects(ctx, bucket, rootHandle); err != nil {
+				logErrorf("cleanup error: (%v) %v: %v", rootHandle.LoginID, rootHandle.Node.TwitterID, err)
+				continue
+			}
+			if err := deleteRootHandle(ctx, dataClient, rootHandle); err != nil {
+				logErrorf("cleanup error: (%v) %v: %v", rootHandle.LoginID, rootHandle.Node.TwitterID, err)
+				continue
+			}
+			logInfof("deleted expired job: (%v) %v completed %v", rootHandle.LoginID, rootHandle.Node.TwitterID, rootHandle.CompletedAt)
+			deleted++
+		}
+	}
+	fmt.Fprintf(w, "Deleted %v expired jobs", deleted)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// cancelWorkerPrefix stops in-progress worker runs, whichever instance serves them.
+const cancelWorkerPrefix = "/admin/cancelWorker"
+
+// WorkerRun describes an in-progress worker invocation.  Runs are kept in the firestore rather
+// than in instance memory, so an admin request served by any instance can list and stop them.
+type WorkerRun struct {
+	ID      string `firestore:"-"`
+	Path    string
+	Started time.Time
+	// Cancelled asks the run to stop.  The run notices within runPollInterval.
+	Cancelled bool
+}
+
+// runPollInterval is how often a worker run checks whether it was cancelled.
+const runPollInterval = 5 * time.Second
+
+// maxRunAge is longer than any worker request may last.  Older runs were left behind by an
+// instance that died mid-run and are not listed.
+const maxRunAge = 10 * time.Minute
+
+// getWorkerRunCollection returns the collection of WorkerRuns in progress.
+func getWorkerRunCollection(client *firestore.Client) *firestore.CollectionRef {
+	return client.Collection(collectionName("WorkerRun"))
+}
+
+// runStopKey is the context key holding the stop signal of a worker run.
+type runStopKey struct{}
+
+// startWorkerRun registers a worker run for path.  The returned context carries the run's stop
+// signal, which runStopped reports once an admin cancels the run.  The context itself is not
+// cancelled, so a job already started always finishes its writes; the worker checks runStopped
+// between jobs and runTick between handles.  The returned function must be called when the
+// run ends.
+func startWorkerRun(ctx context.Context, client *firestore.Client, path string) (context.Context, func(), error) {
+	ref := getWorkerRunCollection(client).NewDoc()
+	if _, err := ref.Create(ctx, &WorkerRun{Path: path, Started: time.Now()}); err != nil {
+		return nil, nil, err
+	}
+	stop, cancel := context.WithCancel(context.Background())
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		pollWorkerRun(ctx, ref, stop, cancel)
+	}()
+	return context.WithValue(ctx, runStopKey{}, stop), func() {
+		cancel()
+		<-polled
+		if _, err := ref.Delete(ctx); err != nil {
+			logErrorf("failed to unregister worker run %v: %v", ref.ID, err)
+		}
+	}, nil
+}
+
+// pollWorkerRun calls cancel once the run stored at ref is marked Cancelled, checking every
+// runPollInterval until stop is done.
+func pollWorkerRun(ctx context.Context, ref *firestore.DocumentRef, stop context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(runPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop.Done():
+			return
+		case <-ticker.C:
+		}
+		doc, err := ref.Get(ctx)
+		if err != nil {
+			logErrorf("failed to check worker run %v: %v", ref.ID, err)
+			continue
+		}
+		var run WorkerRun
+		if err := doc.DataTo(&run); err != nil {
+			logErrorf("failed to check worker run %v: %v", ref.ID, err)
+			continue
+		}
+		if run.Cancelled {
+			cancel()
+			return
+		}
+	}
+}
+
+// runStopped reports whether an admin cancelled the worker run whose context is ctx.
+func runStopped(ctx context.Context) bool {
+	stop, ok := ctx.Value(runStopKey{}).(context.Context)
+	return ok && stop.Err() != nil
+}
+
+// listWorkerRuns returns the runs in progress, oldest first.
+func listWorkerRuns(ctx context.Context, client *firestore.Client) ([]*WorkerRun, error) {
+	iter := getWorkerRunCollection(client).Where("Started", ">", time.Now().Add(-maxRunAge)).OrderBy("Started", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	runs := []*WorkerRun{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return runs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var run WorkerRun
+		if err := doc.DataTo(&run); err != nil {
+			return nil, err
+		}
+		run.ID = doc.Ref.ID
+		runs = append(runs, &run)
+	}
+}
+
+// cancelWorkerHandler stops worker runs in progress, which finish the handle they are on and
+// skip the rest.  The runs still in progress are returned as JSON, so calling it without run or
+// all just lists them.  Its POST body should include:
+// auth - the Firebase token of an admin
+// run - optionally, the ID of the run to stop
+// all - optionally, "true" to stop every run.
+func cancelWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	if !requireAdmin(ctx, w, dataClient) {
+		return
+	}
+	runs, err := listWorkerRuns(ctx, dataClient)
+	if err != nil {
+		writeHandlerError(w, "failed to list worker runs", err)
+		return
+	}
+	id := r.FormValue("run")
+	all := r.FormValue("all") == "true"
+	cancelled := []string{}
+	for _, run := range runs {
+		if !all && run.ID != id {
+			continue
+		}
+		_, err := getWorkerRunCollection(dataClient).Doc(run.ID).Update(ctx, []firestore.Update{{Path: "Cancelled", Value: true}})
+		if err != nil {
+			writeHandlerError(w, "failed to cancel worker run", err)
+			return
+		}
+		run.Cancelled = true
+		cancelled = append(cancelled, run.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"cancelled": cancelled, "active": runs})
+}
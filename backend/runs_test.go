@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRunStopped(t *testing.T) {
+	if runStopped(context.Background()) {
+		t.Error("runStopped() = true outside a worker run")
+	}
+	stop, cancel := context.WithCancel(context.Background())
+	ctx := context.WithValue(context.Background(), runStopKey{}, stop)
+	if runStopped(ctx) {
+		t.Error("runStopped() = true before the run was cancelled")
+	}
+	cancel()
+	if !runStopped(ctx) {
+		t.Error("runStopped() = false after the run was cancelled")
+	}
+	if ctx.Err() != nil {
+		t.Errorf("cancelling the run cancelled its context: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// searchPrefix suggests accounts matching a partial name for the add-handle form.
+const searchPrefix = "/search/"
+
+// maxSearchResults bounds the accounts one search returns.
+const maxSearchResults = 10
+
+// searchResult is an account suggested by searchHandler.
+type searchResult struct {
+	ScreenName      string `json:"screen_name"`
+	Name            string `json:"name"`
+	ProfileImageURL string `json:"profile_image_url"`
+	FollowersCount  int    `json:"followers_count"`
+}
+
+// searchHandler returns up to maxSearchResults accounts matching the query as a JSON array,
+// searched with the signed in user's own Twitter credentials.  An empty query or one matching
+// nothing returns an empty array.  The request should include:
+// auth - the Firebase token
+// q - the partial screen name or name to search for.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	results := []searchResult{}
+	query := strings.TrimSpace(r.FormValue("q"))
+	if query != "" {
+		loginID := loginIDFromContext(ctx)
+		dataClient, err := newFirestoreClient(ctx)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "failed to load firestore: %v", err)
+			return
+		}
+		defer dataClient.Close()
+		client, counter, err := newUserTwitterClient(ctx, dataClient, loginID)
+		if err != nil {
+			writeHandlerError(w, "failed to connect Twitter", err)
+			return
+		}
+		users, err := searchTwitterUsers(ctx, client, query, maxSearchResults)
+		auditCredentialUse(ctx, dataClient, loginID, "search", query, counter)
+		if err != nil {
+			writeHandlerError(w, "failed to search Twitter", err)
+			return
+		}
+		for _, user := range users {
+			if len(results) >= maxSearchResults {
+				break
+			}
+			results = append(results, searchResult{
+				ScreenName:      user.ScreenName,
+				Name:            user.Name,
+				ProfileImageURL: user.ProfileImageURLHttps,
+				FollowersCount:  user.FollowersCount,
+			})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sharePrefix mints a share link for a completed graph.
+const sharePrefix = "/share"
+
+// unsharePrefix revokes every share link of a graph.
+const unsharePrefix = "/unshare"
+
+// sharedPrefix serves a graph to anyone holding a valid share token.
+const sharedPrefix = "/shared/"
+
+// shareSecret signs share tokens.  Sharing is disabled when SHARE_SECRET is unset.
+var shareSecret = []byte(os.Getenv("SHARE_SECRET"))
+
+// defaultShareHours and maxShareHours bound how long a share link stays valid.
+const defaultShareHours = 7 * 24
+const maxShareHours = 30 * 24
+
+// shareClaims identifies the graph a share token grants access to.
+type shareClaims struct {
+	LoginID   string
+	TwitterID string
+	Expires   time.Time
+	Nonce     string
+}
+
+// signShareToken encodes the claims as "payload.signature", both base64url encoded, where the
+// signature is an HMAC-SHA256 of the payload under shareSecret.
+func signShareToken(c *shareClaims) string {
+	payload := strings.Join([]string{c.LoginID, c.TwitterID, strconv.FormatInt(c.Expires.Unix(), 10), c.Nonce}, "/")
+	mac := hmac.New(sha256.New, shareSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyShareToken checks the signature and expiry of token and returns its claims.
+func verifyShareToken(token string, now time.Time) (*shareClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed share token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed share token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed share token")
+	}
+	mac := hmac.New(sha256.New, shareSecret)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid share token")
+	}
+	fields := strings.Split(string(payload), "/")
+	if len(fields) != 4 {
+		return nil, errors.New("malformed share token")
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed share token")
+	}
+	c := &shareClaims{LoginID: fields[0], TwitterID: fields[1], Expires: time.Unix(expires, 0), Nonce: fields[3]}
+	if now.After(c.Expires) {
+		return nil, errors.New("share token expired")
+	}
+	return c, nil
+}
+
+// newShareNonce returns a random nonce to store on a shared RootHandle.
+func newShareNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// shareHandler mints a signed, expiring link that serves a completed graph without logging in.
+// Links stay valid until they expire or the graph is unshared.  The POST body should contain:
+// auth - the Firebase token
+// id - the TwitterID of the handle to share
+// hours - optionally, how long the link is valid, at most maxShareHours.
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(shareSecret) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "sharing is disabled")
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	hours := defaultShareHours
+	if h := r.FormValue("hours"); h != "" {
+		n, err := strconv.Atoi(h)
+		if err != nil || n < 1 || n > maxShareHours {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "hours must be between 1 and %v", maxShareHours)
+			return
+		}
+		hours = n
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, loginID, r.FormValue("id"))
+	if err != nil {
+		writeHandlerError(w, "could not find identified user", err)
+		return
+	}
+	if !rootHandle.Node.Done {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "graph is not ready")
+		return
+	}
+	if rootHandle.ShareNonce == "" {
+		nonce, err := newShareNonce()
+		if err != nil {
+			writeHandlerError(w, "failed to share graph", err)
+			return
+		}
+		if err := updateRootHandleShareNonce(ctx, dataClient, rootHandle, nonce); err != nil {
+			writeHandlerError(w, "failed to share graph", err)
+			return
+		}
+		rootHandle.ShareNonce = nonce
+	}
+	token := signShareToken(&shareClaims{
+		LoginID:   loginID,
+		TwitterID: rootHandle.Node.TwitterID,
+		Expires:   time.Now().Add(time.Duration(hours) * time.Hour),
+		Nonce:     rootHandle.ShareNonce,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": "https://" + r.Host + sharedPrefix + token})
+}
+
+// unshareHandler revokes every share link previously minted for a graph.  The POST body
+// should contain:
+// auth - the Firebase token
+// id - the TwitterID of the shared handle.
+func unshareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, loginID, r.FormValue("id"))
+	if err != nil {
+		writeHandlerError(w, "could not find identified user", err)
+		return
+	}
+	if err := updateRootHandleShareNonce(ctx, dataClient, rootHandle, ""); err != nil {
+		writeHandlerError(w, "failed to unshare graph", err)
+		return
+	}
+}
+
+// sharedHandler serves the stored graph named by the share token in the URL, which is
+// sharedPrefix followed by the token.  No Firebase login is required.
+func sharedHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if len(shareSecret) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	claims, err := verifyShareToken(strings.TrimPrefix(r.URL.Path, sharedPrefix), time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	rootHandle, err := getRootHandleFromString(ctx, dataClient, claims.LoginID, claims.TwitterID)
+	if err != nil {
+		writeHandlerError(w, "could not find shared graph", err)
+		return
+	}
+	if rootHandle.ShareNonce == "" || rootHandle.ShareNonce != claims.Nonce || !rootHandle.Node.Done {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "share link was revoked")
+		return
+	}
+	bucket, err := newGraphBucket(ctx)
+	if err != nil {
+		writeHandlerError(w, "failed to load storage", err)
+		return
+	}
+	reader, err := getGraphObject(bucket, rootHandle).NewReader(ctx)
+	if err != nil {
+		writeHandlerError(w, "failed to read graph", err)
+		return
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition(rootHandle.Node.ScreenName+".gml"))
+	io.Copy(w, reader)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// graphStatsPrefix reports the current size of a graph, finished or not.
+const graphStatsPrefix = "/graphStats"
+
+// graphStatsTTL is how long computed stats are reused before being recomputed.
+const graphStatsTTL = time.Minute
+
+// cachedGraphStats is a GraphStats along with when it was computed.
+type cachedGraphStats struct {
+	GraphStats
+	ComputedAt time.Time
+}
+
+// maxCachedGraphStats bounds how many stats graphStatsCache holds.
+const maxCachedGraphStats = 1000
+
+// graphStatsCache holds recently computed stats keyed by "loginID/twitterID".  It is local to
+// each instance, so different instances may briefly report different figures.
+var graphStatsCache = struct {
+	sync.Mutex
+	m map[string]*cachedGraphStats
+}{m: make(map[string]*cachedGraphStats)}
+
+// cacheGraphStats stores stats under key, first dropping the stats older than graphStatsTTL
+// and, if the cache is still full, the oldest, so the cache stays within maxCachedGraphStats.
+func cacheGraphStats(key string, stats *cachedGraphStats) {
+	graphStatsCache.Lock()
+	defer graphStatsCache.Unlock()
+	oldestKey := ""
+	for k, cached := range graphStatsCache.m {
+		if time.Since(cached.ComputedAt) > graphStatsTTL {
+			delete(graphStatsCache.m, k)
+			continue
+		}
+		if oldestKey == "" || cached.ComputedAt.Before(graphStatsCache.m[oldestKey].ComputedAt) {
+			oldestKey = k
+		}
+	}
+	if _, ok := graphStatsCache.m[key]; !ok && len(graphStatsCache.m) >= maxCachedGraphStats {
+		delete(graphStatsCache.m, oldestKey)
+	}
+	graphStatsCache.m[key] = stats
+}
+
+// graphStatsHandler returns the node and edge counts of a handle's graph as collected so far,
+// as JSON.  Counting reads every fetched handle, so results are cached for graphStatsTTL and may
+// lag the crawl by that much; ComputedAt tells when they were taken.  The POST body should contain:
+// auth - the Firebase token
+// id - the TwitterID of the handle.
+func graphStatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	key := loginID + "/" + r.FormValue("id")
+	graphStatsCache.Lock()
+	stats, ok := graphStatsCache.m[key]
+	graphStatsCache.Unlock()
+	if !ok || time.Since(stats.ComputedAt) > graphStatsTTL {
+		dataClient, err := newFirestoreClient(ctx)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "failed to load firestore: %v", err)
+			return
+		}
+		defer dataClient.Close()
+		rootHandle, err := getRootHandleFromString(ctx, dataClient, loginID, r.FormValue("id"))
+		if err != nil {
+			writeHandlerError(w, "could not find identified user", err)
+			return
+		}
+		fetchedHandles, err := getDoneJobs(ctx, dataClient, rootHandle)
+		if err != nil {
+			writeHandlerError(w, "error getting handles", err)
+			return
+		}
+		stats = &cachedGraphStats{
+			GraphStats: *computeGraphStats(rootHandle, fetchedHandles),
+			ComputedAt: time.Now(),
+		}
+		cacheGraphStats(key, stats)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheGraphStatsStaysBounded(t *testing.T) {
+	graphStatsCache.Lock()
+	graphStatsCache.m = make(map[string]*cachedGraphStats)
+	graphStatsCache.Unlock()
+	cacheGraphStats("expired", &cachedGraphStats{ComputedAt: time.Now().Add(-2 * graphStatsTTL)})
+	for i := 0; i < maxCachedGraphStats+10; i++ {
+		cacheGraphStats(strconv.Itoa(i), &cachedGraphStats{ComputedAt: time.Now()})
+	}
+	graphStatsCache.Lock()
+	defer graphStatsCache.Unlock()
+	if len(graphStatsCache.m) > maxCachedGraphStats {
+		t.Errorf("cache holds %v stats, want at most %v", len(graphStatsCache.m), maxCachedGraphStats)
+	}
+	if _, ok := graphStatsCache.m["expired"]; ok {
+		t.Error("expired stats were kept")
+	}
+	if _, ok := graphStatsCache.m[strconv.Itoa(maxCachedGraphStats+9)]; !ok {
+		t.Error("the newest stats were evicted")
+	}
+}
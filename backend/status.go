@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// apiStatusesPrefix reports the progress of several jobs in one call.
+const apiStatusesPrefix = "/api/statuses"
+
+// maxStatusBatch bounds the jobs one statuses request may name.
+const maxStatusBatch = 100
+
+// jobStatus is the progress of one job as reported by the statuses API.  StartedAt and
+// CompletedAt are RFC 3339 times, omitted while unknown or unfinished.  LastError is the
+// failure of the job's most recent tick, at LastErrorAt, while Error reports a job that could
+// not be read.
+type jobStatus struct {
+	TwitterID       string `json:"twitterID"`
+	ScreenName      string `json:"screenName,omitempty"`
+	Status          string `json:"status"`
+	Remaining       int    `json:"remaining"`
+	EnqueuedCount   int    `json:"enqueuedCount"`
+	PercentComplete int    `json:"percentComplete"`
+	PrepareGraph    bool   `json:"prepareGraph"`
+	Done            bool   `json:"done"`
+	StartedAt       string `json:"startedAt,omitempty"`
+	CompletedAt     string `json:"completedAt,omitempty"`
+	Elapsed         string `json:"elapsed,omitempty"`
+	LastError       string `json:"lastError,omitempty"`
+	LastErrorAt     string `json:"lastErrorAt,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// elapsedDescription describes how long rootHandle has been running at now, as "running for
+// 12m", or how long it took once done, as "took 1h5m".  It is empty for jobs without a start
+// time.
+func elapsedDescription(rootHandle *RootHandle, now time.Time) string {
+	if rootHandle.StartedAt.IsZero() {
+		return ""
+	}
+	if rootHandle.Node.Done && !rootHandle.CompletedAt.IsZero() {
+		return "took " + formatDuration(rootHandle.CompletedAt.Sub(rootHandle.StartedAt))
+	}
+	return "running for " + formatDuration(now.Sub(rootHandle.StartedAt))
+}
+
+// formatDuration writes d in whole minutes, as "45m" or "26h3m", and "0m" for less than a
+// minute.
+func formatDuration(d time.Duration) string {
+	minutes := int(d / time.Minute)
+	if minutes < 0 {
+		minutes = 0
+	}
+	if minutes < 60 {
+		return fmt.Sprintf("%vm", minutes)
+	}
+	return fmt.Sprintf("%vh%vm", minutes/60, minutes%60)
+}
+
+// percentComplete returns the share of the enqueued handles of rootHandle that are hydrated,
+// from 0 to 100.  It is -1 while the IDs are still being collected and nothing is enqueued,
+// when progress cannot be known, and 100 once the graph file is being built or is done.
+func percentComplete(rootHandle *RootHandle) int {
+	if rootHandle.Node.Done || rootHandle.PrepareGraph {
+		return 100
+	}
+	if rootHandle.EnqueuedCount <= 0 || rootHandle.Remaining < 0 {
+		return -1
+	}
+	hydrated := rootHandle.EnqueuedCount - rootHandle.Remaining
+	if hydrated < 0 {
+		hydrated = 0
+	}
+	percent := hydrated * 100 / rootHandle.EnqueuedCount
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
+
+// jobStatusFor summarizes the progress of rootHandle.
+func jobStatusFor(rootHandle *RootHandle) *jobStatus {
+	status := &jobStatus{
+		TwitterID:       rootHandle.Node.TwitterID,
+		ScreenName:      rootHandle.Node.ScreenName,
+		Status:          rootHandle.Status,
+		Remaining:       rootHandle.Remaining,
+		EnqueuedCount:   rootHandle.EnqueuedCount,
+		PercentComplete: percentComplete(rootHandle),
+		PrepareGraph:    rootHandle.PrepareGraph,
+		Done:            rootHandle.Node.Done,
+		Elapsed:         elapsedDescription(rootHandle, time.Now()),
+		LastError:       rootHandle.LastError,
+	}
+	if !rootHandle.LastErrorAt.IsZero() {
+		status.LastErrorAt = rootHandle.LastErrorAt.UTC().Format(time.RFC3339)
+	}
+	if !rootHandle.StartedAt.IsZero() {
+		status.StartedAt = rootHandle.StartedAt.UTC().Format(time.RFC3339)
+	}
+	if rootHandle.Node.Done && !rootHandle.CompletedAt.IsZero() {
+		status.CompletedAt = rootHandle.CompletedAt.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// apiStatusesHandler returns the progress of the signed in user's jobs named in the request as
+// JSON, in the order they were named.  Jobs that do not exist are reported with an error.  The
+// request should include:
+// auth - the Firebase token, unless sent as a Bearer token
+// ids - the comma separated TwitterIDs of the jobs, at most maxStatusBatch.
+func apiStatusesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loginID := loginIDFromContext(ctx)
+	var ids []string
+	for _, id := range strings.Split(r.FormValue("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxStatusBatch {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid options: ids must name between 1 and %v jobs", maxStatusBatch)
+		return
+	}
+	dataClient, err := newFirestoreClient(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to load firestore: %v", err)
+		return
+	}
+	defer dataClient.Close()
+	refs := make([]*firestore.DocumentRef, 0, len(ids))
+	for _, id := range ids {
+		refs = append(refs, getRootHandleRef(dataClient, loginID, id))
+	}
+	docs, err := dataClient.GetAll(ctx, refs)
+	if err != nil {
+		writeHandlerError(w, "failed to load jobs", err)
+		return
+	}
+	statuses := make([]*jobStatus, 0, len(docs))
+	for i, doc := range docs {
+		if !doc.Exists() {
+			statuses = append(statuses, &jobStatus{TwitterID: ids[i], Error: ErrHandleNotFound.Error()})
+			continue
+		}
+		var rootHandle RootHandle
+		if err := doc.DataTo(&rootHandle); err != nil {
+			writeHandlerError(w, "failed to load jobs", err)
+			return
+		}
+		statuses = append(statuses, jobStatusFor(&rootHandle))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*jobStatus{"statuses": statuses})
+}
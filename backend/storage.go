@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
 
 	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
 	firebase "firebase.google.com/go"
 	"github.com/dghubble/go-twitter/twitter"
 	"google.golang.org/api/iterator"
@@ -11,6 +16,45 @@ import (
 	"google.golang.org/grpc/codes"
 )
 
+// collectionPrefix is prepended to every Firestore collection name so that several
+// deployments can share one Firestore project.  It is read from COLLECTION_PREFIX.
+var collectionPrefix = os.Getenv("COLLECTION_PREFIX")
+
+// collectionName returns the name of the given Firestore collection with collectionPrefix applied.
+func collectionName(name string) string {
+	return collectionPrefix + name
+}
+
+// newGraphBucket returns the Cloud Storage bucket holding completed graphs.
+func newGraphBucket(ctx context.Context) (*storage.BucketHandle, error) {
+	config := &firebase.Config{
+		StorageBucket: ProjectID + ".appspot.com",
+	}
+	app, err := firebase.NewApp(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	storageClient, err := app.Storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return storageClient.DefaultBucket()
+}
+
+// getGraphObject returns the Cloud Storage object holding the completed graph of rootHandle.
+func getGraphObject(bucket *storage.BucketHandle, rootHandle *RootHandle) *storage.ObjectHandle {
+	return bucket.Object("graphs/" + rootHandle.LoginID + "/" + rootHandle.Node.TwitterID)
+}
+
+// deleteGraphObjects removes the stored graph of rootHandle and any fragments left from its
+// build.  Objects that do not exist count as deleted.
+func deleteGraphObjects(ctx context.Context, bucket *storage.BucketHandle, rootHandle *RootHandle) error {
+	if err := getGraphObject(bucket, rootHandle).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	return deleteFragments(ctx, bucket, rootHandle)
+}
+
 // newDatastoreClient returns a client good for connecting to the Cloud Firestore.
 func newFirestoreClient(ctx context.Context) (*firestore.Client, error) {
 	// Use the application default credentials
@@ -26,9 +70,29 @@ func newFirestoreClient(ctx context.Context) (*firestore.Client, error) {
 	return client, nil
 }
 
+// getUserCollection returns the collection holding every User of the system.
+func getUserCollection(client *firestore.Client) *firestore.CollectionRef {
+	return client.Collection(collectionName("User"))
+}
+
 // getUserRef returns the document reference of the given string user ID.
 func getUserRef(client *firestore.Client, userID string) *firestore.DocumentRef {
-	return client.Collection("User").Doc(userID)
+	return getUserCollection(client).Doc(userID)
+}
+
+// getRootHandleCollection returns the collection of RootHandles owned by userID.
+func getRootHandleCollection(client *firestore.Client, userID string) *firestore.CollectionRef {
+	return getUserRef(client, userID).Collection(collectionName("RootHandle"))
+}
+
+// getRootHandleRef returns the document reference of the RootHandle identified by twitterID and owned by userID.
+func getRootHandleRef(client *firestore.Client, userID string, twitterID string) *firestore.DocumentRef {
+	return getRootHandleCollection(client, userID).Doc(twitterID)
+}
+
+// getFetchedHandleCollection returns the collection of FetchedHandles under the given RootHandle.
+func getFetchedHandleCollection(client *firestore.Client, userID string, rootID string) *firestore.CollectionRef {
+	return getRootHandleRef(client, userID, rootID).Collection(collectionName("FetchedHandle"))
 }
 
 // getApplicationUser retrieves the given user.  Returns nil if that user does not exist.
@@ -48,14 +112,33 @@ func getApplicationUser(ctx context.Context, client *firestore.Client, userID st
 }
 
 // saveApplicationUser persists a newly authorized user to the backing table.
-func saveApplicationUser(ctx context.Context, client *firestore.Client, userID string, name string, accessToken string, accessSecret string) error {
+func saveApplicationUser(ctx context.Context, client *firestore.Client, userID string, twitterID string, name string, accessToken string, accessSecret string) error {
 	user := &User{
 		LoginID:      userID,
+		TwitterID:    twitterID,
 		ScreenName:   name,
 		AccessToken:  accessToken,
 		AccessSecret: accessSecret,
 	}
-	if _, err := getUserRef(client, userID).Set(ctx, user); err != nil {
+	if err := throttleWrites(ctx, 1); err != nil {
+		return err
+	}
+	// Merging keeps the user's preferences, which are saved separately.
+	merge := firestore.Merge([]string{"LoginID"}, []string{"TwitterID"}, []string{"ScreenName"}, []string{"AccessToken"}, []string{"AccessSecret"})
+	if _, err := getUserRef(client, userID).Set(ctx, user, merge); err != nil {
+		return err
+	}
+	return nil
+}
+
+// saveUserPreferences stores the preferred export format and options of the given user.
+func saveUserPreferences(ctx context.Context, client *firestore.Client, userID string, format string, opts *ExportOptions) error {
+	user := &User{LoginID: userID, ExportFormat: format, ExportOptions: *opts}
+	if err := throttleWrites(ctx, 1); err != nil {
+		return err
+	}
+	merge := firestore.Merge([]string{"LoginID"}, []string{"ExportFormat"}, []string{"ExportOptions"})
+	if _, err := getUserRef(client, userID).Set(ctx, user, merge); err != nil {
 		return err
 	}
 	return nil
@@ -63,9 +146,9 @@ func saveApplicationUser(ctx context.Context, client *firestore.Client, userID s
 
 // getRootHandleFromString gets a single root handle identified by twitterID and owned by userID.
 func getRootHandleFromString(ctx context.Context, client *firestore.Client, userID string, twitterID string) (*RootHandle, error) {
-	docsnap, err := getUserRef(client, userID).Collection("RootHandle").Doc(twitterID).Get(ctx)
+	docsnap, err := getRootHandleRef(client, userID, twitterID).Get(ctx)
 	if err != nil {
-		return nil, err
+		return nil, wrapFirestoreError(err)
 	}
 	var rootHandle RootHandle
 	if err := docsnap.DataTo(&rootHandle); err != nil {
@@ -74,9 +157,47 @@ func getRootHandleFromString(ctx context.Context, client *firestore.Client, user
 	return &rootHandle, nil
 }
 
+// maxContentionRetries bounds how many times runTransactionWithRetry reruns a transaction
+// that was aborted by contention, on top of the client's own immediate retries.
+const maxContentionRetries = 3
+
+// contentionRetryDelay is the wait before the first rerun of an aborted transaction, growing
+// with each one after.  Up to two and a half times as much is added at random so overlapping
+// ticks drift apart.
+var contentionRetryDelay = 100 * time.Millisecond
+
+// runTransactionWithRetry runs f in a transaction.  When overlapping ticks keep aborting it, the
+// transaction is rerun after a randomized delay a bounded number of times before giving up.
+func runTransactionWithRetry(ctx context.Context, client *firestore.Client, f func(context.Context, *firestore.Transaction) error) error {
+	return retryAborted(ctx, func() error {
+		return client.RunTransaction(ctx, f)
+	})
+}
+
+// retryAborted calls run until it fails with anything but codes.Aborted, up to
+// maxContentionRetries more times.
+func retryAborted(ctx context.Context, run func() error) error {
+	var err error
+	for attempt := 0; attempt <= maxContentionRetries; attempt++ {
+		if attempt > 0 {
+			delay := time.Duration(attempt)*contentionRetryDelay + time.Duration(rand.Int63n(int64(contentionRetryDelay)*5/2+1))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+		err = run()
+		if grpc.Code(err) != codes.Aborted {
+			return err
+		}
+	}
+	return fmt.Errorf("transaction contention after %v retries: %v", maxContentionRetries, err)
+}
+
 // getRootHandleTransaction reloads a single root handle within a Transaction.
 func getRootHandleTransaction(ctx context.Context, client *firestore.Client, tx *firestore.Transaction, handle *RootHandle) (*RootHandle, error) {
-	docsnap, err := tx.Get(getUserRef(client, handle.LoginID).Collection("RootHandle").Doc(handle.Node.TwitterID))
+	docsnap, err := tx.Get(getRootHandleRef(client, handle.LoginID, handle.Node.TwitterID))
 	if err != nil {
 		return nil, err
 	}
@@ -88,83 +209,368 @@ func getRootHandleTransaction(ctx context.Context, client *firestore.Client, tx
 }
 
 // updateRootHandleStatus overwrites just the Status of the given RootHandle in the database.
-// This feeds an error back to the frontend.
+// This feeds a note about the job's progress back to the frontend.
 func updateRootHandleStatus(ctx context.Context, client *firestore.Client, msg string, handle *RootHandle) error {
-	ref := getUserRef(client, handle.LoginID).Collection("RootHandle").Doc(handle.Node.TwitterID)
+	ref := getRootHandleRef(client, handle.LoginID, handle.Node.TwitterID)
+	if err := throttleWrites(ctx, 1); err != nil {
+		return err
+	}
 	if _, err := ref.Update(ctx, []firestore.Update{{Path: "Status", Value: msg}}); err != nil {
 		return err
 	}
 	return nil
 }
 
-// getRootHandlePerUser gets at most one unfinished root handle for each user in the system.
-func getRootHandlePerUser(ctx context.Context, client *firestore.Client) ([]*RootHandle, error) {
-	iter := client.Collection("User").Documents(ctx)
-	defer iter.Stop()
+// updateRootHandleError records msg as the LastError of the given RootHandle in the database,
+// leaving its Status alone.  An empty msg clears the error.
+func updateRootHandleError(ctx context.Context, client *firestore.Client, msg string, handle *RootHandle) error {
+	at := time.Time{}
+	if msg != "" {
+		at = time.Now()
+	}
+	ref := getRootHandleRef(client, handle.LoginID, handle.Node.TwitterID)
+	if err := throttleWrites(ctx, 1); err != nil {
+		return err
+	}
+	if _, err := ref.Update(ctx, []firestore.Update{{Path: "LastError", Value: msg}, {Path: "LastErrorAt", Value: at}}); err != nil {
+		return err
+	}
+	handle.LastError = msg
+	handle.LastErrorAt = at
+	return nil
+}
+
+// SweepMarker records where the last all-users sweep of the worker stopped.
+type SweepMarker struct {
+	LastLoginID string
+}
+
+// getSweepMarkerRef returns the document holding the SweepMarker.
+func getSweepMarkerRef(client *firestore.Client) *firestore.DocumentRef {
+	return client.Collection(collectionName("Worker")).Doc("sweep")
+}
+
+// getRootHandlePerUser gets at most one unfinished root handle for each of up to limit users,
+// resuming after the user where the previous call stopped and wrapping around to the start
+// of the user base.  A limit of zero visits every user.
+func getRootHandlePerUser(ctx context.Context, client *firestore.Client, limit int) ([]*RootHandle, error) {
+	var marker SweepMarker
+	docsnap, err := getSweepMarkerRef(client).Get(ctx)
+	if err != nil && grpc.Code(err) != codes.NotFound {
+		return nil, err
+	}
+	if err == nil {
+		if err := docsnap.DataTo(&marker); err != nil {
+			return nil, err
+		}
+	}
+	users := getUserCollection(client).OrderBy(firestore.DocumentID, firestore.Asc)
+	queries := []firestore.Query{users}
+	if marker.LastLoginID != "" {
+		queries = []firestore.Query{users.StartAfter(marker.LastLoginID), users.EndAt(marker.LastLoginID)}
+	}
 	var rootHandles []*RootHandle
-	for {
+	lastLoginID := marker.LastLoginID
+	for _, query := range queries {
+		handles, last, err := appendRootHandlePerUser(ctx, client, query, rootHandles, limit)
+		if err != nil {
+			return nil, err
+		}
+		rootHandles = handles
+		if last != "" {
+			lastLoginID = last
+		}
+		if limit > 0 && len(rootHandles) >= limit {
+			break
+		}
+	}
+	if _, err := getSweepMarkerRef(client).Set(ctx, &SweepMarker{LastLoginID: lastLoginID}); err != nil {
+		return nil, err
+	}
+	return rootHandles, nil
+}
+
+// appendRootHandlePerUser appends one unfinished root handle for each user produced by the query
+// until limit handles are collected.  The ID of the last user visited is returned.
+func appendRootHandlePerUser(ctx context.Context, client *firestore.Client, query firestore.Query, rootHandles []*RootHandle, limit int) ([]*RootHandle, string, error) {
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+	lastLoginID := ""
+	for limit == 0 || len(rootHandles) < limit {
 		userDoc, err := iter.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
+		lastLoginID = userDoc.Ref.ID
 		rootHandle, err := getUnfinishedRootHandle(ctx, client, userDoc.Ref.ID)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		if rootHandle == nil {
 			continue
 		}
 		rootHandles = append(rootHandles, rootHandle)
 	}
-	return rootHandles, nil
+	return rootHandles, lastLoginID, nil
 }
 
-// getUnfinishedRootHandle gets a single root handle to work on for the passed in user.
-// Returns nil with no error if there is no work to do for this user.
+// getExpiredRootHandles returns the user's RootHandles that were completed before cutoff.
+func getExpiredRootHandles(ctx context.Context, client *firestore.Client, userID string, cutoff time.Time) ([]*RootHandle, error) {
+	iter := getRootHandleCollection(client, userID).Where("CompletedAt", "<", cutoff).Documents(ctx)
+	defer iter.Stop()
+	var rootHandles []*RootHandle
+	for {
+		handleDoc, err := iter.Next()
+		if err == iterator.Done {
+			return rootHandles, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rootHandle RootHandle
+		if err := handleDoc.DataTo(&rootHandle); err != nil {
+			return nil, err
+		}
+		// Unfinished jobs saved with an unset CompletedAt also sort before the cutoff.
+		if !rootHandle.Node.Done || rootHandle.CompletedAt.IsZero() {
+			continue
+		}
+		rootHandles = append(rootHandles, &rootHandle)
+	}
+}
+
+// getUnfinishedRootHandles returns every RootHandle of the user that is not yet done.
+func getUnfinishedRootHandles(ctx context.Context, client *firestore.Client, userID string) ([]*RootHandle, error) {
+	iter := getRootHandleCollection(client, userID).Where("Node.Done", "==", false).Documents(ctx)
+	defer iter.Stop()
+	var rootHandles []*RootHandle
+	for {
+		handleDoc, err := iter.Next()
+		if err == iterator.Done {
+			return rootHandles, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rootHandle RootHandle
+		if err := handleDoc.DataTo(&rootHandle); err != nil {
+			return nil, err
+		}
+		rootHandles = append(rootHandles, &rootHandle)
+	}
+}
+
+// getUnfinishedRootHandle gets a single root handle to work on for the passed in user, skipping
+// paused ones.  Returns nil with no error if there is no work to do for this user.
 func getUnfinishedRootHandle(ctx context.Context, client *firestore.Client, userID string) (*RootHandle, error) {
-	iter := getUserRef(client, userID).Collection("RootHandle").Where("Node.Done", "==", false).Limit(1).Documents(ctx)
+	// Paused is filtered here rather than in the query, which would leave out handles saved
+	// before the field existed.
+	iter := getRootHandleCollection(client, userID).Where("Node.Done", "==", false).Documents(ctx)
 	defer iter.Stop()
-	handleDoc, err := iter.Next()
-	if err == iterator.Done {
-		return nil, nil
+	for {
+		handleDoc, err := iter.Next()
+		if err == iterator.Done {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rootHandle RootHandle
+		if err := handleDoc.DataTo(&rootHandle); err != nil {
+			return nil, err
+		}
+		if rootHandle.Paused {
+			continue
+		}
+		return &rootHandle, nil
 	}
+}
+
+// getUnfinishedFetchHandles gets up to limit users to "hydrate", those with the most References
+// first.  Returns an empty slice if there is no work to do.
+func getUnfinishedFetchHandles(ctx context.Context, client *firestore.Client, userID string, rootHandle *RootHandle, limit int) ([]*FetchedHandle, error) {
+	unfinished := getFetchedHandleCollection(client, userID, rootHandle.Node.TwitterID).Where("Node.Done", "==", false)
+	handleDocs, err := unfinished.OrderBy("References", firestore.Desc).Limit(limit).Documents(ctx).GetAll()
 	if err != nil {
 		return nil, err
 	}
-	var rootHandle RootHandle
-	if err := handleDoc.DataTo(&rootHandle); err != nil {
-		return nil, err
+	if len(handleDocs) < limit {
+		// Handles saved before References existed lack the field and are left out of the
+		// ordered query, so they fill the rest of the batch in any order.
+		moreDocs, err := unfinished.Limit(limit).Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		handleDocs = append(handleDocs, moreDocs...)
 	}
-	return &rootHandle, nil
+	var fetchedHandles []*FetchedHandle
+	seen := make(map[string]bool)
+	for _, handleDoc := range handleDocs {
+		if seen[handleDoc.Ref.ID] || len(fetchedHandles) >= limit {
+			continue
+		}
+		seen[handleDoc.Ref.ID] = true
+		var fetchedHandle FetchedHandle
+		if err := handleDoc.DataTo(&fetchedHandle); err != nil {
+			return nil, err
+		}
+		fetchedHandles = append(fetchedHandles, &fetchedHandle)
+	}
+	return fetchedHandles, nil
 }
 
-// getUnfinishedFetchedHandle gets a single user to "hydrate". Returns nil if there is no work to do.
-func getUnfinishedFetchHandle(ctx context.Context, client *firestore.Client, tx *firestore.Transaction, userID string, rootHandle *RootHandle) (*FetchedHandle, error) {
-	iter := tx.Documents(getUserRef(client, userID).Collection("RootHandle").Doc(rootHandle.Node.TwitterID).Collection("FetchedHandle").Where("Node.Done", "==", false).Limit(1))
-	defer iter.Stop()
-	handleDoc, err := iter.Next()
-	if err == iterator.Done {
-		return nil, nil
+// hasUnfinishedFetchHandles reports within a Transaction whether any FetchedHandle of rootHandle
+// is left to hydrate.
+func hasUnfinishedFetchHandles(ctx context.Context, client *firestore.Client, tx *firestore.Transaction, rootHandle *RootHandle) (bool, error) {
+	unfinished := getFetchedHandleCollection(client, rootHandle.LoginID, rootHandle.Node.TwitterID).Where("Node.Done", "==", false)
+	docs, err := tx.Documents(unfinished.Select().Limit(1)).GetAll()
+	if err != nil {
+		return false, err
+	}
+	return len(docs) > 0, nil
+}
+
+// addReferences increments the References of each unfinished FetchedHandle of rootHandle that
+// the hydrated node lists as a friend or follower.  The counts only order the crawl, so they
+// are updated outside the hydrating transaction and a lost increment is tolerated.
+func addReferences(ctx context.Context, client *firestore.Client, rootHandle *RootHandle, hydrated *GephiNode) error {
+	network := validIDs(rootHandle)
+	seen := make(map[string]bool)
+	var refs []*firestore.DocumentRef
+	collection := getFetchedHandleCollection(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	for _, ids := range [][]string{hydrated.FriendIDs, hydrated.FollowerIDs} {
+		for _, id := range ids {
+			if seen[id] || !network[id] || id == rootHandle.Node.TwitterID {
+				continue
+			}
+			seen[id] = true
+			refs = append(refs, collection.Doc(id))
+		}
 	}
+	// Firestore only handles writes up to 500 documents.
+	for start := 0; start < len(refs); start += 500 {
+		end := start + 500
+		if end > len(refs) {
+			end = len(refs)
+		}
+		docs, err := client.GetAll(ctx, refs[start:end])
+		if err != nil {
+			return err
+		}
+		batch := client.Batch()
+		numBatched := 0
+		for _, doc := range docs {
+			if !doc.Exists() {
+				continue
+			}
+			var fetchedHandle FetchedHandle
+			if err := doc.DataTo(&fetchedHandle); err != nil {
+				return err
+			}
+			if fetchedHandle.Node.Done {
+				continue
+			}
+			batch.Update(doc.Ref, []firestore.Update{{Path: "References", Value: fetchedHandle.References + 1}})
+			numBatched++
+		}
+		if numBatched == 0 {
+			continue
+		}
+		if err := throttleWrites(ctx, numBatched); err != nil {
+			return err
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSkippedHub reports whether hydration skipped the ID lists of fetchedHandle because they
+// exceeded idsPageSize.  Second hop handles never collect lists and the lists of protected
+// accounts cannot be read, so neither is a hub worth reopening.
+func isSkippedHub(fetchedHandle *FetchedHandle) bool {
+	if fetchedHandle.Hop >= 2 || fetchedHandle.Node.Protected {
+		return false
+	}
+	n := &fetchedHandle.Node
+	return (n.FriendsCount > idsPageSize && len(n.FriendIDs) == 0) || (n.FollowersCount > idsPageSize && len(n.FollowerIDs) == 0)
+}
+
+// reopenSkippedHubs marks the skipped hubs among the done handles of rootHandle unfinished and
+// reopens the job to hydrate them again.  The reopened job builds its graph from the
+// firestore rather than fragments.  It returns how many hubs were reopened.
+func reopenSkippedHubs(ctx context.Context, client *firestore.Client, rootHandle *RootHandle) (int, error) {
+	fetchedHandles, err := getDoneJobs(ctx, client, rootHandle)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	var fetchedHandle FetchedHandle
-	if err := handleDoc.DataTo(&fetchedHandle); err != nil {
-		return nil, err
+	collection := getFetchedHandleCollection(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	batch := client.Batch()
+	numBatched := 0
+	reopened := 0
+	for _, fetchedHandle := range fetchedHandles {
+		if !isSkippedHub(fetchedHandle) {
+			continue
+		}
+		batch.Update(collection.Doc(fetchedHandle.Node.TwitterID), []firestore.Update{
+			{Path: "Node.Done", Value: false},
+		})
+		numBatched++
+		reopened++
+		// Firestore only handles writes up to 500 documents.
+		if numBatched >= 500 {
+			if err := throttleWrites(ctx, numBatched); err != nil {
+				return 0, err
+			}
+			if _, err := batch.Commit(ctx); err != nil {
+				return 0, err
+			}
+			batch = client.Batch()
+			numBatched = 0
+		}
+	}
+	if numBatched > 0 {
+		if err := throttleWrites(ctx, numBatched); err != nil {
+			return 0, err
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if reopened == 0 {
+		return 0, nil
 	}
-	return &fetchedHandle, nil
+	// The counts are taken afresh, as a job whose counts drifted would otherwise show the
+	// reopened hubs against a stale total.
+	enqueued, remaining, err := countFetchedHandles(ctx, client, rootHandle)
+	if err != nil {
+		return 0, err
+	}
+	rootHandle.Node.Done = false
+	rootHandle.PrepareGraph = false
+	// The fragments were deleted when the graph was first built, so the rebuild reads every
+	// handle from the firestore.
+	rootHandle.IncrementalBuild = false
+	rootHandle.EnqueuedCount = enqueued
+	rootHandle.Remaining = remaining
+	rootHandle.CompletedAt = time.Time{}
+	rootHandle.Status = fmt.Sprintf("Completing %v skipped hubs", reopened)
+	if err := saveRootHandle(ctx, client, rootHandle); err != nil {
+		return 0, err
+	}
+	return reopened, nil
 }
 
 // deleteRootHandle deletes a handle and its component pieces from the firestore.
 func deleteRootHandle(ctx context.Context, client *firestore.Client, rootHandle *RootHandle) error {
 	batch := client.Batch()
 	numBatched := 0
-	rootRef := getUserRef(client, rootHandle.LoginID).Collection("RootHandle").Doc(rootHandle.Node.TwitterID)
-	iter := rootRef.Collection("FetchedHandle").DocumentRefs(ctx)
+	rootRef := getRootHandleRef(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	iter := getFetchedHandleCollection(client, rootHandle.LoginID, rootHandle.Node.TwitterID).DocumentRefs(ctx)
 	for {
 		fetchedDoc, err := iter.Next()
 		if err == iterator.Done {
@@ -176,6 +582,9 @@ func deleteRootHandle(ctx context.Context, client *firestore.Client, rootHandle
 		batch.Delete(fetchedDoc)
 		numBatched++
 		if numBatched >= 500 {
+			if err := throttleWrites(ctx, numBatched); err != nil {
+				return err
+			}
 			if _, err := batch.Commit(ctx); err != nil {
 				return err
 			}
@@ -184,10 +593,16 @@ func deleteRootHandle(ctx context.Context, client *firestore.Client, rootHandle
 		}
 	}
 	if numBatched > 0 {
+		if err := throttleWrites(ctx, numBatched); err != nil {
+			return err
+		}
 		if _, err := batch.Commit(ctx); err != nil {
 			return err
 		}
 	}
+	if err := throttleWrites(ctx, 1); err != nil {
+		return err
+	}
 	if _, err := rootRef.Delete(ctx); err != nil {
 		return err
 	}
@@ -197,7 +612,7 @@ func deleteRootHandle(ctx context.Context, client *firestore.Client, rootHandle
 // getDoneJobs gets the slice of all completed fetch jobs for this user and root handle.
 func getDoneJobs(ctx context.Context, client *firestore.Client, rootHandle *RootHandle) ([]*FetchedHandle, error) {
 	var fetchedHandles []*FetchedHandle
-	iter := getUserRef(client, rootHandle.LoginID).Collection("RootHandle").Doc(rootHandle.Node.TwitterID).Collection("FetchedHandle").Where("Node.Done", "==", true).Documents(ctx)
+	iter := getFetchedHandleCollection(client, rootHandle.LoginID, rootHandle.Node.TwitterID).Where("Node.Done", "==", true).Documents(ctx)
 	defer iter.Stop()
 	for {
 		fetchedDoc, err := iter.Next()
@@ -216,9 +631,31 @@ func getDoneJobs(ctx context.Context, client *firestore.Client, rootHandle *Root
 	return fetchedHandles, nil
 }
 
+// getDoneJobIDs returns the TwitterIDs of the hydrated handles of rootHandle.  Only document
+// references are read.
+func getDoneJobIDs(ctx context.Context, client *firestore.Client, rootHandle *RootHandle) ([]string, error) {
+	var ids []string
+	iter := getFetchedHandleCollection(client, rootHandle.LoginID, rootHandle.Node.TwitterID).Where("Node.Done", "==", true).Select().Documents(ctx)
+	defer iter.Stop()
+	for {
+		fetchedDoc, err := iter.Next()
+		if err == iterator.Done {
+			return ids, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, fetchedDoc.Ref.ID)
+	}
+}
+
 // saveRootHandle saves the given handle back to the firestore.
 func saveRootHandle(ctx context.Context, client *firestore.Client, rootHandle *RootHandle) error {
-	docRef := getUserRef(client, rootHandle.LoginID).Collection("RootHandle").Doc(rootHandle.Node.TwitterID)
+	rootHandle.PercentComplete = percentComplete(rootHandle)
+	docRef := getRootHandleRef(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	if err := throttleWrites(ctx, 1); err != nil {
+		return err
+	}
 	if _, err := docRef.Set(ctx, rootHandle); err != nil {
 		return err
 	}
@@ -227,92 +664,515 @@ func saveRootHandle(ctx context.Context, client *firestore.Client, rootHandle *R
 
 // saveRootHandleTransaction saves the given handle back to the firestore.
 func saveRootHandleTransaction(ctx context.Context, client *firestore.Client, tx *firestore.Transaction, rootHandle *RootHandle) error {
-	docRef := getUserRef(client, rootHandle.LoginID).Collection("RootHandle").Doc(rootHandle.Node.TwitterID)
+	rootHandle.PercentComplete = percentComplete(rootHandle)
+	docRef := getRootHandleRef(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
 	if err := tx.Set(docRef, rootHandle); err != nil {
 		return err
 	}
 	return nil
 }
 
-// newFetchedHandles saves the slice of TwitterIDs as fetch handles to the firestore.
-func newFetchedHandles(ctx context.Context, client *firestore.Client, userID string, relationship string, parentID string, twitterIDs []string) error {
-	handleCollection := getUserRef(client, userID).Collection("RootHandle").Doc(parentID).Collection("FetchedHandle")
-	batch := client.Batch()
-	numBatched := 0
-	// Firestore only handles writes up to 500 documents.
+// newFetchedHandles enqueues the slice of TwitterIDs as fetch handles under rootHandle and
+// updates the counts of rootHandle to match.
+func newFetchedHandles(ctx context.Context, client *firestore.Client, rootHandle *RootHandle, relationship string, twitterIDs []string) error {
+	handles := make([]*FetchedHandle, 0, len(twitterIDs))
 	for _, twitterID := range twitterIDs {
-		fetched := &FetchedHandle{
-			ParentID: parentID,
+		handles = append(handles, &FetchedHandle{
+			ParentID: rootHandle.Node.TwitterID,
 			Node: GephiNode{
 				TwitterID:    twitterID,
 				Relationship: relationship,
 			},
+		})
+	}
+	current, err := enqueueFetchedHandles(ctx, client, rootHandle, handles)
+	if err != nil {
+		return err
+	}
+	rootHandle.EnqueuedCount = current.EnqueuedCount
+	rootHandle.Remaining = current.Remaining
+	return nil
+}
+
+// enqueueFetchedHandles writes handles under rootHandle and, in the same transaction, counts
+// those new to the job into its EnqueuedCount, and into Remaining once enqueuing is over and
+// Remaining is no longer -1, so the counts never drift from the documents.  A first hop handle
+// replaces an earlier document of the same ID, which only exists before hydration starts.  A
+// second hop handle is only written if it is new, and only until the job holds
+// maxExpandedNodes handles, after which ExpansionTruncated is set.  A transaction holds up to
+// 500 writes, so the handles are written up to 499 at a time beside the root.  The root as of
+// the last transaction is returned.
+func enqueueFetchedHandles(ctx context.Context, client *firestore.Client, rootHandle *RootHandle, handles []*FetchedHandle) (*RootHandle, error) {
+	collection := getFetchedHandleCollection(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	current := rootHandle
+	for start := 0; start < len(handles); start += 499 {
+		end := start + 499
+		if end > len(handles) {
+			end = len(handles)
 		}
-		batch.Set(handleCollection.Doc(twitterID), fetched)
-		numBatched++
-		if numBatched >= 500 {
-			if _, err := batch.Commit(ctx); err != nil {
+		chunk := handles[start:end]
+		err := runTransactionWithRetry(ctx, client, func(ctx context.Context, tx *firestore.Transaction) error {
+			root, err := getRootHandleTransaction(ctx, client, tx, rootHandle)
+			if err != nil {
 				return err
 			}
-			batch = client.Batch()
-			numBatched = 0
+			refs := make([]*firestore.DocumentRef, 0, len(chunk))
+			for _, fetched := range chunk {
+				refs = append(refs, collection.Doc(fetched.Node.TwitterID))
+			}
+			docs, err := tx.GetAll(refs)
+			if err != nil {
+				return err
+			}
+			var writes []int
+			added := 0
+			truncated := false
+			for i, doc := range docs {
+				if doc.Exists() {
+					if chunk[i].Hop < 2 {
+						writes = append(writes, i)
+					}
+					continue
+				}
+				if chunk[i].Hop >= 2 && root.EnqueuedCount+added >= maxExpandedNodes {
+					truncated = true
+					continue
+				}
+				writes = append(writes, i)
+				added++
+			}
+			current = root
+			if len(writes) == 0 && (!truncated || root.ExpansionTruncated) {
+				return nil
+			}
+			if err := throttleWrites(ctx, len(writes)+1); err != nil {
+				return err
+			}
+			for _, i := range writes {
+				if err := tx.Set(refs[i], chunk[i]); err != nil {
+					return err
+				}
+			}
+			root.ExpansionTruncated = root.ExpansionTruncated || truncated
+			root.EnqueuedCount += added
+			if root.Remaining >= 0 {
+				root.Remaining += added
+			}
+			return saveRootHandleTransaction(ctx, client, tx, root)
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
-	if numBatched > 0 {
-		if _, err := batch.Commit(ctx); err != nil {
-			return err
+	return current, nil
+}
+
+// expandFetchedHandle enqueues the friends and followers of a hydrated first hop handle that
+// are not yet part of the crawl as second hop handles.  Once the job holds maxExpandedNodes
+// handles the rest are left out and ExpansionTruncated is set.
+func expandFetchedHandle(ctx context.Context, client *firestore.Client, rootHandle *RootHandle, expanded *FetchedHandle) error {
+	if rootHandle.ExpansionTruncated {
+		return nil
+	}
+	blocked := blockedSet(rootHandle)
+	seen := map[string]bool{rootHandle.Node.TwitterID: true}
+	var handles []*FetchedHandle
+	for _, ids := range [][]string{expanded.Node.FriendIDs, expanded.Node.FollowerIDs} {
+		for _, id := range ids {
+			if seen[id] || blocked[id] {
+				continue
+			}
+			seen[id] = true
+			handles = append(handles, &FetchedHandle{
+				ParentID: rootHandle.Node.TwitterID,
+				Node:     GephiNode{TwitterID: id, Relationship: "SecondHop"},
+				Hop:      2,
+			})
 		}
 	}
+	if len(handles) == 0 {
+		return nil
+	}
+	current, err := enqueueFetchedHandles(ctx, client, rootHandle, handles)
+	if err != nil {
+		return err
+	}
+	rootHandle.ExpansionTruncated = current.ExpansionTruncated
 	return nil
 }
 
 // hydrateHandle inflates the given FetchedHandle with data from the twitter User object
-func hydrateHandle(ctx context.Context, client *firestore.Client, tx *firestore.Transaction, userID string, twitterUser *twitter.User, fetchedHandle *FetchedHandle) error {
+func hydrateHandle(twitterUser *twitter.User, fetchedHandle *FetchedHandle) {
 	fetchedHandle.Node.FriendsCount = twitterUser.FriendsCount
 	fetchedHandle.Node.FollowersCount = twitterUser.FollowersCount
 	fetchedHandle.Node.ScreenName = twitterUser.ScreenName
-	fetchedHandle.Node.Done = true
+	// A handle whose lists continue on later ticks stays unfinished until they are complete.
+	fetchedHandle.Node.Done = fetchedHandle.FriendsCursor == 0 && fetchedHandle.FollowersCursor == 0
 	fetchedHandle.Node.ProfileURL = twitterUser.URL
-	fetchedHandle.Node.Description = twitterUser.Description
-	if len(fetchedHandle.Node.Description) > 500 {
-		fetchedHandle.Node.Description = fetchedHandle.Node.Description[:500]
-	}
+	fetchedHandle.Node.Description = expandedDescription(twitterUser)
+	fetchedHandle.Node.Description = truncateUTF8(fetchedHandle.Node.Description, maxDescriptionLength)
 	fetchedHandle.Node.ProfileImageURL = twitterUser.ProfileImageURL
-	ref := getUserRef(client, userID).Collection("RootHandle").Doc(fetchedHandle.ParentID).Collection("FetchedHandle").Doc(fetchedHandle.Node.TwitterID)
-	if err := tx.Set(ref, fetchedHandle); err != nil {
-		return err
-	}
-	return nil
+	fetchedHandle.Node.ProfileBannerURL = httpsURL(twitterUser.ProfileBannerURL)
+	fetchedHandle.Node.CreatedAt = twitterUser.CreatedAt
+	fetchedHandle.Node.DefaultProfile = twitterUser.DefaultProfile
+	fetchedHandle.Node.DefaultProfileImage = twitterUser.DefaultProfileImage
+	fetchedHandle.Node.Verified = twitterUser.Verified
+	fetchedHandle.Node.StatusesCount = twitterUser.StatusesCount
 }
 
 // newRootHandle records the fetched Twitter user to the firestore as a new graph root to be expanded.
-// Fails if the handle is already being fetched.
-func newRootHandle(ctx context.Context, client *firestore.Client, userID string, user *twitter.User) error {
+// The saved RootHandle is returned.  Fails with ErrAlreadyExists if the handle is already being fetched.
+func newRootHandle(ctx context.Context, client *firestore.Client, userID string, user *twitter.User, opts *jobOptions) (*RootHandle, error) {
 	rootHandle := &RootHandle{
 		LoginID: userID,
 		Node: GephiNode{
-			TwitterID:       user.IDStr,
-			ScreenName:      user.ScreenName,
-			Relationship:    "Root",
-			FollowersCount:  user.FollowersCount,
-			FriendsCount:    user.FriendsCount,
-			Done:            false,
-			ProfileURL:      user.URL,
-			Description:     user.Description,
-			ProfileImageURL: user.ProfileImageURLHttps,
+			TwitterID:           user.IDStr,
+			ScreenName:          user.ScreenName,
+			Relationship:        "Root",
+			FollowersCount:      user.FollowersCount,
+			FriendsCount:        user.FriendsCount,
+			Done:                false,
+			ProfileURL:          user.URL,
+			Description:         expandedDescription(user),
+			ProfileImageURL:     user.ProfileImageURLHttps,
+			ProfileBannerURL:    httpsURL(user.ProfileBannerURL),
+			CreatedAt:           user.CreatedAt,
+			DefaultProfile:      user.DefaultProfile,
+			DefaultProfileImage: user.DefaultProfileImage,
+			Verified:            user.Verified,
+			StatusesCount:       user.StatusesCount,
 		},
-		FollowersCursor: -1,
-		FriendsCursor:   -1,
-		Status:          "Preparing to fetch",
-		Remaining:       -1,
-		PrepareGraph:    false,
+		FollowersCursor:  -1,
+		FriendsCursor:    -1,
+		Status:           "Preparing to fetch",
+		Remaining:        -1,
+		PrepareGraph:     false,
+		TweetSampleSize:  opts.TweetSampleSize,
+		FetchOrder:       opts.FetchOrder,
+		Blocklist:        opts.Blocklist,
+		MaxFollowerPages: opts.MaxFollowerPages,
+		MaxFriendPages:   opts.MaxFriendPages,
+		IncrementalBuild: opts.IncrementalBuild,
+		ExportOptions:    opts.ExportOptions,
+		MutualOnly:       opts.MutualOnly,
+		Depth:            opts.Depth,
+		StartedAt:        time.Now(),
+		NotifyURL:        opts.NotifyURL,
+	}
+	appUser, err := getApplicationUser(ctx, client, userID)
+	if err != nil {
+		return nil, err
 	}
-	if len(rootHandle.Node.Description) > 500 {
-		rootHandle.Node.Description = rootHandle.Node.Description[:500]
+	rootHandle.Node.IsSelf = isSelf(appUser, user)
+	rootHandle.Node.Description = truncateUTF8(rootHandle.Node.Description, maxDescriptionLength)
+	rootHandle.PercentComplete = percentComplete(rootHandle)
+	ref := getRootHandleRef(client, userID, user.IDStr)
+	if err := throttleWrites(ctx, 1); err != nil {
+		return nil, err
 	}
-	ref := getUserRef(client, userID).Collection("RootHandle").Doc(user.IDStr)
 	if _, err := ref.Create(ctx, rootHandle); err != nil {
+		return nil, wrapFirestoreError(err)
+	}
+	return rootHandle, nil
+}
+
+// countFetchedHandles counts the FetchedHandles enqueued under the given root and how many
+// of them remain to be hydrated.  Only document references are read.
+func countFetchedHandles(ctx context.Context, client *firestore.Client, rootHandle *RootHandle) (int, int, error) {
+	collection := getFetchedHandleCollection(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	enqueued, err := countDocuments(collection.Select().Documents(ctx))
+	if err != nil {
+		return 0, 0, err
+	}
+	remaining, err := countDocuments(collection.Where("Node.Done", "==", false).Select().Documents(ctx))
+	if err != nil {
+		return 0, 0, err
+	}
+	return enqueued, remaining, nil
+}
+
+// countFetchedHandlesTransaction counts like countFetchedHandles within a Transaction.
+func countFetchedHandlesTransaction(ctx context.Context, client *firestore.Client, tx *firestore.Transaction, rootHandle *RootHandle) (int, int, error) {
+	collection := getFetchedHandleCollection(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	enqueued, err := countDocuments(tx.Documents(collection.Select()))
+	if err != nil {
+		return 0, 0, err
+	}
+	remaining, err := countDocuments(tx.Documents(collection.Where("Node.Done", "==", false).Select()))
+	if err != nil {
+		return 0, 0, err
+	}
+	return enqueued, remaining, nil
+}
+
+// countDocuments drains the iterator and returns the number of documents it produced.
+func countDocuments(iter *firestore.DocumentIterator) (int, error) {
+	defer iter.Stop()
+	count := 0
+	for {
+		_, err := iter.Next()
+		if err == iterator.Done {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+}
+
+// updateRootHandleCountsTransaction overwrites just the cached EnqueuedCount and Remaining of
+// the given RootHandle within a Transaction.
+func updateRootHandleCountsTransaction(ctx context.Context, client *firestore.Client, tx *firestore.Transaction, rootHandle *RootHandle, enqueued int, remaining int) error {
+	ref := getRootHandleRef(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	counted := *rootHandle
+	counted.EnqueuedCount = enqueued
+	counted.Remaining = remaining
+	updates := []firestore.Update{
+		{Path: "EnqueuedCount", Value: enqueued},
+		{Path: "Remaining", Value: remaining},
+		{Path: "PercentComplete", Value: percentComplete(&counted)},
+	}
+	if err := throttleWrites(ctx, 1); err != nil {
+		return err
+	}
+	return tx.Update(ref, updates)
+}
+
+// AuditEntry records one use of a user's Twitter credentials.  It never holds the
+// credentials themselves, only identifiers and counts.
+type AuditEntry struct {
+	LoginID string
+	Action  string
+	Job     string
+	Calls   int
+	Time    time.Time
+}
+
+// saveAuditEntry appends the entry to the Audit collection.
+func saveAuditEntry(ctx context.Context, client *firestore.Client, entry *AuditEntry) error {
+	if _, _, err := client.Collection(collectionName("Audit")).Add(ctx, entry); err != nil {
+		return err
+	}
+	return nil
+}
+
+// updateRootHandleProfile overwrites just the screen name and profile fields of the given RootHandle
+// with those of the freshly fetched Twitter user, leaving the collected graph untouched.
+func updateRootHandleProfile(ctx context.Context, client *firestore.Client, rootHandle *RootHandle, user *twitter.User) error {
+	description := expandedDescription(user)
+	description = truncateUTF8(description, maxDescriptionLength)
+	ref := getRootHandleRef(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	updates := []firestore.Update{
+		{Path: "Node.ScreenName", Value: user.ScreenName},
+		{Path: "Node.ProfileURL", Value: user.URL},
+		{Path: "Node.Description", Value: description},
+		{Path: "Node.ProfileImageURL", Value: user.ProfileImageURLHttps},
+		{Path: "Node.ProfileBannerURL", Value: httpsURL(user.ProfileBannerURL)},
+		{Path: "Node.DefaultProfile", Value: user.DefaultProfile},
+		{Path: "Node.DefaultProfileImage", Value: user.DefaultProfileImage},
+		{Path: "Node.Verified", Value: user.Verified},
+		{Path: "Node.StatusesCount", Value: user.StatusesCount},
+	}
+	if err := throttleWrites(ctx, 1); err != nil {
 		return err
 	}
+	if _, err := ref.Update(ctx, updates); err != nil {
+		return err
+	}
+	return nil
+}
+
+// updateRootHandleShareNonce overwrites just the ShareNonce of the given RootHandle.
+func updateRootHandleShareNonce(ctx context.Context, client *firestore.Client, rootHandle *RootHandle, nonce string) error {
+	ref := getRootHandleRef(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	if err := throttleWrites(ctx, 1); err != nil {
+		return err
+	}
+	if _, err := ref.Update(ctx, []firestore.Update{{Path: "ShareNonce", Value: nonce}}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// updateRootHandleConfig transactionally applies the updates returned by change to an
+// unfinished RootHandle.  change sees the current document and may reject the edit, and only
+// the fields it names are written so cursors and counts saved by the worker are untouched.
+func updateRootHandleConfig(ctx context.Context, client *firestore.Client, rootHandle *RootHandle, change func(*RootHandle) ([]firestore.Update, error)) error {
+	ref := getRootHandleRef(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	return runTransactionWithRetry(ctx, client, func(ctx context.Context, tx *firestore.Transaction) error {
+		current, err := getRootHandleTransaction(ctx, client, tx, rootHandle)
+		if err != nil {
+			return wrapFirestoreError(err)
+		}
+		if current.Node.Done || current.PrepareGraph {
+			return fmt.Errorf("%w: the fetch has finished", ErrSettingLocked)
+		}
+		updates, err := change(current)
+		if err != nil || len(updates) == 0 {
+			return err
+		}
+		return tx.Update(ref, updates)
+	})
+}
+
+// CachedUser holds the profile of a Twitter account as hydrated for any job.  The cache is
+// shared by every user, so crawls of overlapping networks look each account up once per
+// userCacheTTL.  ID lists are not cached.
+type CachedUser struct {
+	ScreenName          string
+	FriendsCount        int
+	FollowersCount      int
+	URL                 string
+	Description         string
+	ProfileImageURL     string
+	ProfileBannerURL    string
+	CreatedAt           string
+	DefaultProfile      bool
+	DefaultProfileImage bool
+	Verified            bool
+	StatusesCount       int
+	Protected           bool
+	// CachedAt is when the profile was looked up.
+	CachedAt time.Time
+}
+
+// userCacheTTL is how long a cached profile stands in for a lookup.  Zero disables the cache.
+var userCacheTTL = time.Duration(envInt("USER_CACHE_TTL_HOURS", 168)) * time.Hour
+
+// getUserCacheCollection returns the collection of CachedUsers, keyed by TwitterID.
+func getUserCacheCollection(client *firestore.Client) *firestore.CollectionRef {
+	return client.Collection(collectionName("TwitterUserCache"))
+}
+
+// getCachedUsers returns the profiles of the given IDs cached within userCacheTTL, keyed by
+// TwitterID.  IDs without a fresh entry are left out.  The description is already expanded.
+func getCachedUsers(ctx context.Context, client *firestore.Client, ids []string) (map[string]*twitter.User, error) {
+	users := make(map[string]*twitter.User)
+	if userCacheTTL <= 0 || len(ids) == 0 {
+		return users, nil
+	}
+	refs := make([]*firestore.DocumentRef, 0, len(ids))
+	for _, id := range ids {
+		refs = append(refs, getUserCacheCollection(client).Doc(id))
+	}
+	docs, err := client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		var cached CachedUser
+		if err := doc.DataTo(&cached); err != nil {
+			return nil, err
+		}
+		if !cached.freshAt(now) {
+			continue
+		}
+		users[doc.Ref.ID] = cached.user(doc.Ref.ID)
+	}
+	return users, nil
+}
+
+// newCachedUser returns the cached form of user, looked up at now.
+func newCachedUser(user *twitter.User, now time.Time) *CachedUser {
+	return &CachedUser{
+		ScreenName:          user.ScreenName,
+		FriendsCount:        user.FriendsCount,
+		FollowersCount:      user.FollowersCount,
+		URL:                 user.URL,
+		Description:         expandedDescription(user),
+		ProfileImageURL:     user.ProfileImageURL,
+		ProfileBannerURL:    user.ProfileBannerURL,
+		CreatedAt:           user.CreatedAt,
+		DefaultProfile:      user.DefaultProfile,
+		DefaultProfileImage: user.DefaultProfileImage,
+		Verified:            user.Verified,
+		StatusesCount:       user.StatusesCount,
+		Protected:           user.Protected,
+		CachedAt:            now,
+	}
+}
+
+// freshAt reports whether cached may stand in for a lookup at now.
+func (cached *CachedUser) freshAt(now time.Time) bool {
+	return userCacheTTL > 0 && now.Sub(cached.CachedAt) < userCacheTTL
+}
+
+// user returns cached as the twitter.User of twitterID.
+func (cached *CachedUser) user(twitterID string) *twitter.User {
+	return &twitter.User{
+		IDStr:               twitterID,
+		ScreenName:          cached.ScreenName,
+		FriendsCount:        cached.FriendsCount,
+		FollowersCount:      cached.FollowersCount,
+		URL:                 cached.URL,
+		Description:         cached.Description,
+		ProfileImageURL:     cached.ProfileImageURL,
+		ProfileBannerURL:    cached.ProfileBannerURL,
+		CreatedAt:           cached.CreatedAt,
+		DefaultProfile:      cached.DefaultProfile,
+		DefaultProfileImage: cached.DefaultProfileImage,
+		Verified:            cached.Verified,
+		StatusesCount:       cached.StatusesCount,
+		Protected:           cached.Protected,
+	}
+}
+
+// uncachedIDs returns the ids missing from cached, in order.  Only they need a lookup.
+func uncachedIDs(ids []string, cached map[string]*twitter.User) []string {
+	var uncached []string
+	for _, id := range ids {
+		if cached[id] == nil {
+			uncached = append(uncached, id)
+		}
+	}
+	return uncached
+}
+
+// lookUpUncachedUsers looks up the profiles of the ids missing from usersByID, adding them to
+// it, and returns those it looked up for caching.  Cached profiles cost no call.
+func lookUpUncachedUsers(ctx context.Context, client *twitter.Client, ids []string, usersByID map[string]*twitter.User) ([]twitter.User, error) {
+	uncached := uncachedIDs(ids, usersByID)
+	if len(uncached) == 0 {
+		return nil, nil
+	}
+	lookedUp, err := getTwitterUsers(ctx, client, uncached)
+	if err != nil {
+		return nil, err
+	}
+	for i := range lookedUp {
+		usersByID[lookedUp[i].IDStr] = &lookedUp[i]
+	}
+	return lookedUp, nil
+}
+
+// putCachedUsers caches the profiles of the given users, stamped with the current time.
+func putCachedUsers(ctx context.Context, client *firestore.Client, users []twitter.User) error {
+	if userCacheTTL <= 0 {
+		return nil
+	}
+	now := time.Now()
+	// Firestore only handles writes up to 500 documents.
+	for start := 0; start < len(users); start += 500 {
+		end := start + 500
+		if end > len(users) {
+			end = len(users)
+		}
+		batch := client.Batch()
+		for i := range users[start:end] {
+			user := &users[start+i]
+			batch.Set(getUserCacheCollection(client).Doc(user.IDStr), newCachedUser(user, now))
+		}
+		if err := throttleWrites(ctx, end-start); err != nil {
+			return err
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return err
+		}
+	}
 	return nil
 }
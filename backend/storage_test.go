@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/dghubble/go-twitter/twitter"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCachedUserRoundTrip(t *testing.T) {
+	user := &twitter.User{
+		IDStr:          "42",
+		ScreenName:     "someone",
+		FollowersCount: 10,
+		FriendsCount:   20,
+		Description:    "hello",
+		CreatedAt:      "Mon Jan 02 15:04:05 +0000 2006",
+		Verified:       true,
+	}
+	got := newCachedUser(user, time.Now()).user("42")
+	if !reflect.DeepEqual(got, user) {
+		t.Errorf("newCachedUser().user() = %+v, want %+v", got, user)
+	}
+}
+
+func TestCachedUserFreshAt(t *testing.T) {
+	defer func(ttl time.Duration) { userCacheTTL = ttl }(userCacheTTL)
+	userCacheTTL = time.Hour
+	cachedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cached := newCachedUser(&twitter.User{IDStr: "42"}, cachedAt)
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"just cached", cachedAt, true},
+		{"within ttl", cachedAt.Add(59 * time.Minute), true},
+		{"expired", cachedAt.Add(time.Hour), false},
+	}
+	for _, tt := range tests {
+		if got := cached.freshAt(tt.now); got != tt.want {
+			t.Errorf("%v: freshAt() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	userCacheTTL = 0
+	if cached.freshAt(cachedAt) {
+		t.Errorf("freshAt() with the cache disabled = true, want false")
+	}
+}
+
+func TestUncachedIDs(t *testing.T) {
+	cached := map[string]*twitter.User{"2": {IDStr: "2"}}
+	if got, want := uncachedIDs([]string{"1", "2", "3"}, cached), []string{"1", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("uncachedIDs() = %v, want %v", got, want)
+	}
+	if got := uncachedIDs([]string{"2"}, cached); len(got) != 0 {
+		t.Errorf("uncachedIDs() of a cache hit = %v, want none to look up", got)
+	}
+}
+
+// withFastContentionRetries shortens the rerun delay, returning a func restoring it.
+func withFastContentionRetries() func() {
+	delay := contentionRetryDelay
+	contentionRetryDelay = time.Millisecond
+	return func() { contentionRetryDelay = delay }
+}
+
+func TestRetryAbortedRecoversFromContention(t *testing.T) {
+	defer withFastContentionRetries()()
+	calls := 0
+	err := retryAborted(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return status.Error(codes.Aborted, "too much contention on these documents")
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("retryAborted() = %v after %v calls, want success after 2", err, calls)
+	}
+}
+
+func TestRetryAbortedGivesUp(t *testing.T) {
+	defer withFastContentionRetries()()
+	calls := 0
+	err := retryAborted(context.Background(), func() error {
+		calls++
+		return status.Error(codes.Aborted, "too much contention on these documents")
+	})
+	if err == nil || calls != maxContentionRetries+1 {
+		t.Errorf("retryAborted() = %v after %v calls, want an error after %v", err, calls, maxContentionRetries+1)
+	}
+	calls = 0
+	notFound := status.Error(codes.NotFound, "no such document")
+	if err := retryAborted(context.Background(), func() error {
+		calls++
+		return notFound
+	}); err != notFound || calls != 1 {
+		t.Errorf("retryAborted() = %v after %v calls, want %v after 1", err, calls, notFound)
+	}
+}
+
+func TestHydrateHandleExpandsDescriptionLinks(t *testing.T) {
+	user := &twitter.User{
+		ScreenName:  "someone",
+		Description: "see https://t.co/abc",
+		Entities: &twitter.UserEntities{Description: twitter.Entities{Urls: []twitter.URLEntity{
+			{URL: "https://t.co/abc", ExpandedURL: "https://example.com/about"},
+		}}},
+	}
+	var handle FetchedHandle
+	hydrateHandle(user, &handle)
+	if want := "see https://example.com/about"; handle.Node.Description != want {
+		t.Errorf("hydrateHandle() description = %q, want %q", handle.Node.Description, want)
+	}
+}
+
+// newEmulatorClient connects to the Firestore emulator at FIRESTORE_EMULATOR_HOST, skipping
+// the test when none is running.
+func newEmulatorClient(t *testing.T) *firestore.Client {
+	host := os.Getenv("FIRESTORE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	client, err := firestore.NewClient(context.Background(), ProjectID,
+		option.WithEndpoint(host),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()))
+	if err != nil {
+		t.Fatalf("connecting to the emulator: %v", err)
+	}
+	return client
+}
+
+func TestCountFetchedHandlesMatchesGetAll(t *testing.T) {
+	client := newEmulatorClient(t)
+	defer client.Close()
+	ctx := context.Background()
+	rootHandle := &RootHandle{LoginID: "count-test", Node: GephiNode{TwitterID: "1"}}
+	collection := getFetchedHandleCollection(client, rootHandle.LoginID, rootHandle.Node.TwitterID)
+	batch := client.Batch()
+	for i := 0; i < 7; i++ {
+		handle := testHandle(strconv.Itoa(i+2), 10)
+		handle.Node.Done = i < 3
+		batch.Set(collection.Doc(handle.Node.TwitterID), handle)
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		t.Fatalf("saving handles: %v", err)
+	}
+	defer func() {
+		if err := deleteRootHandle(ctx, client, rootHandle); err != nil {
+			t.Errorf("deleting handles: %v", err)
+		}
+	}()
+	all, err := collection.Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notDone, err := collection.Where("Node.Done", "==", false).Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueued, remaining, err := countFetchedHandles(ctx, client, rootHandle)
+	if err != nil {
+		t.Fatalf("countFetchedHandles() error = %v", err)
+	}
+	if enqueued != len(all) || remaining != len(notDone) {
+		t.Errorf("countFetchedHandles() = %v, %v, want %v, %v", enqueued, remaining, len(all), len(notDone))
+	}
+	if enqueued != 7 || remaining != 4 {
+		t.Errorf("countFetchedHandles() = %v, %v, want 7, 4", enqueued, remaining)
+	}
+}
+
+// fakeUsersLookup serves users/lookup, answering every requested ID with a user, and records
+// the IDs of each call in lookups.  It returns a client calling it along with a func closing
+// the server.
+func fakeUsersLookup(lookups *[]string) (*twitter.Client, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids := r.FormValue("user_id")
+		*lookups = append(*lookups, ids)
+		var users []string
+		for _, id := range strings.Split(ids, ",") {
+			users = append(users, fmt.Sprintf(`{"id_str": %q, "screen_name": "user%v"}`, id, id))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "[%v]", strings.Join(users, ","))
+	}))
+	target, _ := url.Parse(server.URL)
+	return twitter.NewClient(&http.Client{Transport: rewriteTransport{target}}), server.Close
+}
+
+// seededUsers returns the profiles a cache holding ids fresh at now would yield.
+func seededUsers(now time.Time, ids ...string) map[string]*twitter.User {
+	usersByID := make(map[string]*twitter.User)
+	for _, id := range ids {
+		cached := newCachedUser(&twitter.User{IDStr: id, ScreenName: "cached" + id}, now)
+		if cached.freshAt(now) {
+			usersByID[id] = cached.user(id)
+		}
+	}
+	return usersByID
+}
+
+func TestLookUpUncachedUsersSkipsCacheHits(t *testing.T) {
+	var lookups []string
+	client, closeServer := fakeUsersLookup(&lookups)
+	defer closeServer()
+	usersByID := seededUsers(time.Now(), "2", "3")
+	lookedUp, err := lookUpUncachedUsers(context.Background(), client, []string{"2", "3"}, usersByID)
+	if err != nil {
+		t.Fatalf("lookUpUncachedUsers() error = %v", err)
+	}
+	if len(lookups) != 0 || len(lookedUp) != 0 {
+		t.Errorf("lookUpUncachedUsers() of cached users made lookups %q, want none", lookups)
+	}
+	if usersByID["2"].ScreenName != "cached2" {
+		t.Errorf("cached user 2 = %+v, want the cached profile", usersByID["2"])
+	}
+}
+
+func TestLookUpUncachedUsersLooksUpMisses(t *testing.T) {
+	var lookups []string
+	client, closeServer := fakeUsersLookup(&lookups)
+	defer closeServer()
+	usersByID := seededUsers(time.Now(), "2")
+	lookedUp, err := lookUpUncachedUsers(context.Background(), client, []string{"2", "3", "4"}, usersByID)
+	if err != nil {
+		t.Fatalf("lookUpUncachedUsers() error = %v", err)
+	}
+	if want := []string{"3,4"}; !reflect.DeepEqual(lookups, want) {
+		t.Errorf("lookUpUncachedUsers() made lookups %q, want %q", lookups, want)
+	}
+	if len(lookedUp) != 2 || usersByID["3"] == nil || usersByID["4"] == nil {
+		t.Errorf("lookUpUncachedUsers() = %v, want users 3 and 4 added", lookedUp)
+	}
+}
+
+func TestCachedUsersAvoidLookupsAgainstTheEmulator(t *testing.T) {
+	dataClient := newEmulatorClient(t)
+	defer dataClient.Close()
+	ctx := context.Background()
+	ids := []string{"900001", "900002"}
+	var users []twitter.User
+	for _, id := range ids {
+		users = append(users, twitter.User{IDStr: id, ScreenName: "cached" + id})
+	}
+	if err := putCachedUsers(ctx, dataClient, users); err != nil {
+		t.Fatalf("putCachedUsers() error = %v", err)
+	}
+	usersByID, err := getCachedUsers(ctx, dataClient, append(ids, "900003"))
+	if err != nil {
+		t.Fatalf("getCachedUsers() error = %v", err)
+	}
+	var lookups []string
+	client, closeServer := fakeUsersLookup(&lookups)
+	defer closeServer()
+	if _, err := lookUpUncachedUsers(ctx, client, append(ids, "900003"), usersByID); err != nil {
+		t.Fatalf("lookUpUncachedUsers() error = %v", err)
+	}
+	if want := []string{"900003"}; !reflect.DeepEqual(lookups, want) {
+		t.Errorf("lookUpUncachedUsers() made lookups %q, want only the uncached %q", lookups, want)
+	}
+}
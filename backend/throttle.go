@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// firestoreWritesPerSecond caps the document writes per second of this instance, so that one
+// aggressive job does not trip Firestore's write quota and fail its tick.  Zero disables it.
+var firestoreWritesPerSecond = envInt("FIRESTORE_WRITES_PER_SECOND", 500)
+
+// writeLimiter spaces out writes to firestoreWritesPerSecond.  A batch may be written at once
+// but delays the writes that follow it.
+var writeLimiter = struct {
+	sync.Mutex
+	next time.Time
+}{}
+
+// throttleDelayKey is the context key under which a tick accumulates time spent throttled.
+type throttleDelayKey struct{}
+
+// withThrottleTimer returns a context whose throttled writes add their delay to the returned
+// counter of nanoseconds.
+func withThrottleTimer(ctx context.Context) (context.Context, *int64) {
+	var delay int64
+	return context.WithValue(ctx, throttleDelayKey{}, &delay), &delay
+}
+
+// throttleWrites waits until n more documents may be written.
+func throttleWrites(ctx context.Context, n int) error {
+	if firestoreWritesPerSecond <= 0 || n <= 0 {
+		return nil
+	}
+	interval := time.Duration(n) * time.Second / time.Duration(firestoreWritesPerSecond)
+	writeLimiter.Lock()
+	now := time.Now()
+	start := writeLimiter.next
+	if start.Before(now) {
+		start = now
+	}
+	writeLimiter.next = start.Add(interval)
+	writeLimiter.Unlock()
+	wait := start.Sub(now)
+	if wait <= 0 {
+		return nil
+	}
+	if delay, ok := ctx.Value(throttleDelayKey{}).(*int64); ok {
+		atomic.AddInt64(delay, int64(wait))
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
@@ -2,24 +2,154 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"cloud.google.com/go/firestore"
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
 )
 
+// callCounter is an http.RoundTripper that counts the requests it forwards so that
+// credential use can be audited.  It also keeps the rate limit headers of the last response.
+type callCounter struct {
+	base  http.RoundTripper
+	calls int64
+
+	mu        sync.Mutex
+	rateLimit map[string]string
+}
+
+// RoundTrip forwards the request to the base RoundTripper and counts it.
+func (c *callCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&c.calls, 1)
+	resp, err := c.base.RoundTrip(req)
+	if resp != nil {
+		rateLimit := make(map[string]string)
+		for name := range resp.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-rate-limit-") {
+				rateLimit[name] = resp.Header.Get(name)
+			}
+		}
+		c.mu.Lock()
+		c.rateLimit = rateLimit
+		c.mu.Unlock()
+	}
+	return resp, err
+}
+
+// Calls returns the number of requests made so far.
+func (c *callCounter) Calls() int {
+	return int(atomic.LoadInt64(&c.calls))
+}
+
+// RateLimit returns the x-rate-limit-* headers of the last response, if any.
+func (c *callCounter) RateLimit() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rateLimit
+}
+
 // newUserTwitterClient connects a Twitter client with the passed in user's credentials.
-func newUserTwitterClient(ctx context.Context, dataClient *firestore.Client, userID string) (*twitter.Client, error) {
+// The returned callCounter tracks how many API calls the client makes.
+func newUserTwitterClient(ctx context.Context, dataClient *firestore.Client, userID string) (*twitter.Client, *callCounter, error) {
 	user, err := getApplicationUser(ctx, dataClient, userID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	if user == nil || user.AccessToken == "" || user.AccessSecret == "" {
+		return nil, nil, ErrNotConnected
+	}
+	client, counter := newTwitterClient(ctx, user.AccessToken, user.AccessSecret)
+	return client, counter, nil
+}
+
+// twitterTransport is shared by every Twitter client so that connections to the API are pooled
+// across calls, users and jobs.  Each client still signs its requests with its own token.
+var twitterTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   16,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}
+
+// newTwitterClient connects a Twitter client with the given user credentials.
+func newTwitterClient(ctx context.Context, accessToken string, accessSecret string) (*twitter.Client, *callCounter) {
+	counter := &callCounter{base: twitterTransport}
+	breaker := &breakerTransport{base: counter, breaker: breakerForApp(TwitterConsumerKey)}
+	ctx = context.WithValue(ctx, oauth1.HTTPClient, &http.Client{Transport: breaker})
 	config := oauth1.NewConfig(TwitterConsumerKey, TwitterConsumerSecret)
-	token := oauth1.NewToken(user.AccessToken, user.AccessSecret)
+	token := oauth1.NewToken(accessToken, accessSecret)
 	httpClient := config.Client(ctx, token)
-	client := twitter.NewClient(httpClient)
-	return client, nil
+	return twitter.NewClient(httpClient), counter
+}
+
+// verifyTwitterCredentials returns the Twitter user the given credentials were issued to.
+func verifyTwitterCredentials(ctx context.Context, accessToken string, accessSecret string) (*twitter.User, error) {
+	client, _ := newTwitterClient(ctx, accessToken, accessSecret)
+	var user *twitter.User
+	err := withRetry(ctx, func() error {
+		var resp *http.Response
+		var err error
+		user, resp, err = client.Accounts.VerifyCredentials(&twitter.AccountVerifyParams{
+			SkipStatus: twitter.Bool(true),
+		})
+		if err != nil {
+			return wrapTwitterError(resp, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// twitterRetries is how many times a call failing with a transient error is retried.
+var twitterRetries = envInt("TWITTER_RETRIES", 3)
+
+// twitterRetryDelay is the wait before the first retry, doubling with each one after.
+var twitterRetryDelay = 500 * time.Millisecond
+
+// withRetry runs fn, retrying it up to twitterRetries times with exponential backoff and
+// jitter while it fails with a transient error.  Permanent, rate limit and other errors are
+// returned at once; rate limits pause the job instead.  Once ctx is done no further attempt is
+// made, so a tick past its deadline stops rather than backing off.
+func withRetry(ctx context.Context, fn func() error) error {
+	delay := twitterRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= twitterRetries || !isTransientError(err) {
+			return err
+		}
+		if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		logDebugf("retrying transient Twitter failure in %v: %v", delay, err)
+		// The jitter keeps jobs that failed together from retrying together.
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay + time.Duration(rand.Int63n(int64(delay)))):
+		}
+		delay *= 2
+	}
 }
 
 // permanentErrorMessage returns a non-empty description of the error if it is permanent.
@@ -39,10 +169,8 @@ func permanentErrorMessage(err error) string {
 
 // getTwitterUserByName gets the user identified by handle.
 // On a "permanent" error, such as a suspended account, returns a placeholder user.
-func getTwitterUserByName(client *twitter.Client, handle string) (*twitter.User, error) {
-	user, _, err := client.Users.Show(&twitter.UserShowParams{
-		ScreenName: handle,
-	})
+func getTwitterUserByName(ctx context.Context, client *twitter.Client, handle string) (*twitter.User, error) {
+	user, err := showTwitterUserByName(ctx, client, handle)
 	if err != nil {
 		if permanentErrorMessage(err) != "" {
 			return &twitter.User{
@@ -56,15 +184,104 @@ func getTwitterUserByName(client *twitter.Client, handle string) (*twitter.User,
 	return user, nil
 }
 
-// getTwitterUser gets the user identified by the given ID.
-func getTwitterUser(client *twitter.Client, twitterID string) (*twitter.User, error) {
+// showTwitterUserByName gets the user identified by the given screen name, returning Twitter's
+// error as is.
+func showTwitterUserByName(ctx context.Context, client *twitter.Client, handle string) (*twitter.User, error) {
+	var user *twitter.User
+	err := withRetry(ctx, func() error {
+		var resp *http.Response
+		var err error
+		user, resp, err = client.Users.Show(&twitter.UserShowParams{
+			ScreenName: handle,
+		})
+		if err != nil {
+			return wrapTwitterError(resp, err)
+		}
+		return nil
+	})
+	return user, err
+}
+
+// maxScreenNameLength is the longest screen name Twitter allows.
+const maxScreenNameLength = 15
+
+// validateHandle normalizes a handle a person typed, trimming whitespace and a leading "@",
+// and returns ErrInvalidHandle if it cannot be a screen name or numeric ID, saving a call to
+// Twitter that could only fail.
+func validateHandle(s string) (string, error) {
+	handle := strings.TrimPrefix(strings.TrimSpace(s), "@")
+	if handle == "" {
+		return "", fmt.Errorf("%w: handle is empty", ErrInvalidHandle)
+	}
+	if isTwitterID(handle) {
+		// IDs are 64-bit integers, and showTwitterUser could not parse a larger one.
+		if _, err := strconv.ParseInt(handle, 10, 64); err != nil {
+			return "", fmt.Errorf("%w: %q is too large to be a TwitterID", ErrInvalidHandle, handle)
+		}
+		return handle, nil
+	}
+	if len(handle) > maxScreenNameLength {
+		return "", fmt.Errorf("%w: %q is longer than %v characters", ErrInvalidHandle, handle, maxScreenNameLength)
+	}
+	for _, c := range handle {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return "", fmt.Errorf("%w: %q may only hold letters, digits and underscores", ErrInvalidHandle, handle)
+		}
+	}
+	return handle, nil
+}
+
+// getTwitterUserByHandle gets the user a person typed into the app, either a screen name or,
+// when it is all digits, a numeric ID, which survives screen name changes.  The handle is
+// checked by validateHandle first.  Since a screen name may also be all digits, an ID short
+// enough to be a screen name that matches no account is tried as one before giving up with
+// ErrHandleNotFound.
+func getTwitterUserByHandle(ctx context.Context, client *twitter.Client, handle string) (*twitter.User, error) {
+	handle, err := validateHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+	if isTwitterID(handle) {
+		user, err := showTwitterUser(ctx, client, handle)
+		if err == nil || permanentErrorMessage(err) == "" {
+			return user, err
+		}
+		if len(handle) > maxScreenNameLength {
+			return nil, fmt.Errorf("%w: %v is %v", ErrHandleNotFound, handle, permanentErrorMessage(err))
+		}
+	}
+	user, err := showTwitterUserByName(ctx, client, handle)
+	if msg := permanentErrorMessage(err); msg != "" {
+		return nil, fmt.Errorf("%w: %v is %v", ErrHandleNotFound, handle, msg)
+	}
+	return user, err
+}
+
+// showTwitterUser gets the user identified by the given ID, returning Twitter's error as is.
+func showTwitterUser(ctx context.Context, client *twitter.Client, twitterID string) (*twitter.User, error) {
 	twitterIDNum, err := strconv.ParseInt(twitterID, 10, 64)
 	if err != nil {
 		return nil, err
 	}
-	user, _, err := client.Users.Show(&twitter.UserShowParams{
-		UserID: twitterIDNum,
+	var user *twitter.User
+	err = withRetry(ctx, func() error {
+		var resp *http.Response
+		var err error
+		user, resp, err = client.Users.Show(&twitter.UserShowParams{
+			UserID: twitterIDNum,
+		})
+		if err != nil {
+			return wrapTwitterError(resp, err)
+		}
+		return nil
 	})
+	return user, err
+}
+
+// getTwitterUser gets the user identified by the given ID.  Suspended and deleted accounts
+// are returned as a placeholder named after the reason.
+func getTwitterUser(ctx context.Context, client *twitter.Client, twitterID string) (*twitter.User, error) {
+	user, err := showTwitterUser(ctx, client, twitterID)
 	if err != nil {
 		if msg := permanentErrorMessage(err); msg != "" {
 			return &twitter.User{
@@ -79,17 +296,110 @@ func getTwitterUser(client *twitter.Client, twitterID string) (*twitter.User, er
 	return user, nil
 }
 
+// twitterNoUserMatchesCode is the Twitter API error code for a lookup matching no users.
+const twitterNoUserMatchesCode = 17
+
+// getTwitterUsers gets the users identified by the given IDs, at most lookupBatchSize of them,
+// in one users/lookup call.  Suspended and deleted accounts are left out of the lookup, so each
+// missing ID is fetched on its own to get the same placeholder getTwitterUser returns.
+func getTwitterUsers(ctx context.Context, client *twitter.Client, ids []string) ([]twitter.User, error) {
+	idNums := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		idNum, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		idNums = append(idNums, idNum)
+	}
+	var users []twitter.User
+	err := withRetry(ctx, func() error {
+		var resp *http.Response
+		var err error
+		users, resp, err = client.Users.Lookup(&twitter.UserLookupParams{
+			UserID:          idNums,
+			IncludeEntities: twitter.Bool(true),
+		})
+		if err != nil {
+			e, ok := err.(twitter.APIError)
+			if !ok || len(e.Errors) == 0 || e.Errors[0].Code != twitterNoUserMatchesCode {
+				return wrapTwitterError(resp, err)
+			}
+			users = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(users))
+	for _, user := range users {
+		found[user.IDStr] = true
+	}
+	for _, id := range ids {
+		if found[id] {
+			continue
+		}
+		user, err := getTwitterUser(ctx, client, id)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, nil
+}
+
+// searchTwitterUsers returns up to count public accounts matching query, best matches first.
+func searchTwitterUsers(ctx context.Context, client *twitter.Client, query string, count int) ([]twitter.User, error) {
+	var users []twitter.User
+	err := withRetry(ctx, func() error {
+		var resp *http.Response
+		var err error
+		users, resp, err = client.Users.Search(query, &twitter.UserSearchParams{
+			Count:           count,
+			IncludeEntities: twitter.Bool(false),
+		})
+		if err != nil {
+			return wrapTwitterError(resp, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// advanceCursor returns the cursor to continue paging from.  Twitter occasionally hands back
+// the cursor that was just requested, which would fetch the same page forever, so a cursor
+// that does not advance ends the collection of that direction.
+func advanceCursor(node *GephiNode, direction string, cursor int64, nextCursor int64) int64 {
+	if nextCursor != 0 && nextCursor == cursor {
+		logInfof("%v cursor of %v stuck at %v, treating %v as complete", direction, node.TwitterID, cursor, direction)
+		return 0
+	}
+	return nextCursor
+}
+
 // addFriendsPage retrieves one page of Friends from the given Node with an offset of cursor.
 // It is appended to the existing node.  The new cursor is returned.
-func addFriendsPage(client *twitter.Client, node *GephiNode, cursor int64) ([]string, int64, error) {
+func addFriendsPage(ctx context.Context, client *twitter.Client, node *GephiNode, cursor int64) ([]string, int64, error) {
 	twitterIDNum, err := strconv.ParseInt(node.TwitterID, 10, 64)
 	if err != nil {
 		return nil, 0, err
 	}
-	friends, _, err := client.Friends.IDs(&twitter.FriendIDParams{
-		UserID: twitterIDNum,
-		Cursor: cursor,
-		Count:  5000,
+	var friends *twitter.FriendIDs
+	err = withRetry(ctx, func() error {
+		var resp *http.Response
+		var err error
+		friends, resp, err = client.Friends.IDs(&twitter.FriendIDParams{
+			UserID: twitterIDNum,
+			Cursor: cursor,
+			Count:  5000,
+		})
+		if err != nil {
+			return wrapTwitterError(resp, err)
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, 0, err
@@ -98,21 +408,30 @@ func addFriendsPage(client *twitter.Client, node *GephiNode, cursor int64) ([]st
 	for _, friend := range friends.IDs {
 		addedIDs = append(addedIDs, strconv.FormatInt(friend, 10))
 	}
-	node.FriendIDs = append(node.FriendIDs, addedIDs...)
-	return addedIDs, friends.NextCursor, nil
+	node.FriendIDs, addedIDs = appendUniqueIDs(node.FriendIDs, addedIDs)
+	return addedIDs, advanceCursor(node, "friends", cursor, friends.NextCursor), nil
 }
 
 // addFollowersPage retrieves one page of Followers from the given Node with an offset of cursor.
 // It is appended to the existing node.  The new cursor is returned.
-func addFollowersPage(client *twitter.Client, node *GephiNode, cursor int64) ([]string, int64, error) {
+func addFollowersPage(ctx context.Context, client *twitter.Client, node *GephiNode, cursor int64) ([]string, int64, error) {
 	twitterIDNum, err := strconv.ParseInt(node.TwitterID, 10, 64)
 	if err != nil {
 		return nil, 0, err
 	}
-	followers, _, err := client.Followers.IDs(&twitter.FollowerIDParams{
-		UserID: twitterIDNum,
-		Cursor: cursor,
-		Count:  5000,
+	var followers *twitter.FollowerIDs
+	err = withRetry(ctx, func() error {
+		var resp *http.Response
+		var err error
+		followers, resp, err = client.Followers.IDs(&twitter.FollowerIDParams{
+			UserID: twitterIDNum,
+			Cursor: cursor,
+			Count:  5000,
+		})
+		if err != nil {
+			return wrapTwitterError(resp, err)
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, 0, err
@@ -121,6 +440,122 @@ func addFollowersPage(client *twitter.Client, node *GephiNode, cursor int64) ([]
 	for _, follower := range followers.IDs {
 		addedIDs = append(addedIDs, strconv.FormatInt(follower, 10))
 	}
-	node.FollowerIDs = append(node.FollowerIDs, addedIDs...)
-	return addedIDs, followers.NextCursor, nil
+	node.FollowerIDs, addedIDs = appendUniqueIDs(node.FollowerIDs, addedIDs)
+	return addedIDs, advanceCursor(node, "followers", cursor, followers.NextCursor), nil
+}
+
+// maxTweetLength bounds the number of characters kept from each sampled tweet.
+const maxTweetLength = 280
+
+// getRecentTweets returns the text of up to count of the most recent tweets of the given user,
+// each truncated to maxTweetLength characters.  Accounts whose timeline cannot be read, such as
+// suspended or deleted ones, yield no tweets rather than an error.
+func getRecentTweets(ctx context.Context, client *twitter.Client, twitterID string, count int) ([]string, error) {
+	twitterIDNum, err := strconv.ParseInt(twitterID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	var tweets []twitter.Tweet
+	err = withRetry(ctx, func() error {
+		var resp *http.Response
+		var err error
+		tweets, resp, err = client.Timelines.UserTimeline(&twitter.UserTimelineParams{
+			UserID:    twitterIDNum,
+			Count:     count,
+			TrimUser:  twitter.Bool(true),
+			TweetMode: "extended",
+		})
+		if err != nil {
+			return wrapTwitterError(resp, err)
+		}
+		return nil
+	})
+	if err != nil {
+		if permanentErrorMessage(err) != "" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var texts []string
+	for _, tweet := range tweets {
+		text := []rune(tweet.FullText)
+		if len(text) == 0 {
+			text = []rune(tweet.Text)
+		}
+		if len(text) > maxTweetLength {
+			text = text[:maxTweetLength]
+		}
+		texts = append(texts, string(text))
+	}
+	return texts, nil
+}
+
+// appendUniqueIDs appends the IDs of page that are not already in ids, returning the grown
+// slice and the IDs that were new.  Pages can overlap when the list changes between calls, and
+// a page may be fetched again after a failed save, so IDs are never appended twice.  Duplicates
+// already saved by older versions are dropped from ids as well.
+func appendUniqueIDs(ids []string, page []string) ([]string, []string) {
+	seen := make(map[string]bool, len(ids)+len(page))
+	unique := ids[:0]
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	var added []string
+	for _, id := range page {
+		if !seen[id] {
+			seen[id] = true
+			added = append(added, id)
+		}
+	}
+	return append(unique, added...), added
+}
+
+// expandedDescription returns the user's description with its t.co shortlinks replaced by the
+// URLs they expand to.  Users returned without entities keep their description as is.
+func expandedDescription(user *twitter.User) string {
+	description := user.Description
+	if user.Entities == nil {
+		return description
+	}
+	for _, u := range user.Entities.Description.Urls {
+		if u.URL == "" || u.ExpandedURL == "" {
+			continue
+		}
+		description = strings.Replace(description, u.URL, u.ExpandedURL, -1)
+	}
+	return description
+}
+
+// maxDescriptionLength bounds the bytes of description stored for each account.
+const maxDescriptionLength = 500
+
+// truncateUTF8 shortens s to at most n bytes without splitting a multi-byte character, which
+// would leave invalid UTF-8 in every export of the account.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// httpsURL upgrades an http URL to https, leaving other URLs as they are.
+func httpsURL(u string) string {
+	if strings.HasPrefix(u, "http://") {
+		return "https://" + strings.TrimPrefix(u, "http://")
+	}
+	return u
+}
+
+// twitterTimeLayout is the format of created_at timestamps in the Twitter API.
+const twitterTimeLayout = time.RubyDate
+
+// parseTwitterTime parses a Twitter created_at timestamp.
+func parseTwitterTime(createdAt string) (time.Time, error) {
+	return time.Parse(twitterTimeLayout, createdAt)
 }
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// withFastRetries shortens the retry delay, returning a func restoring it.
+func withFastRetries() func() {
+	delay := twitterRetryDelay
+	twitterRetryDelay = time.Millisecond
+	return func() { twitterRetryDelay = delay }
+}
+
+func TestWithRetryRecoversFromTransientFailures(t *testing.T) {
+	defer withFastRetries()()
+	calls := 0
+	err := withRetry(context.Background(), func() error {
+		calls++
+		if calls <= 2 {
+			return &transientError{err: errors.New("over capacity")}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withRetry() = %v, want success", err)
+	}
+	if calls != 3 {
+		t.Errorf("made %v calls, want 3", calls)
+	}
+}
+
+func TestWithRetryReturnsPermanentErrors(t *testing.T) {
+	defer withFastRetries()()
+	calls := 0
+	permanent := errors.New("not found")
+	err := withRetry(context.Background(), func() error {
+		calls++
+		return permanent
+	})
+	if err != permanent || calls != 1 {
+		t.Errorf("withRetry() = %v after %v calls, want %v after 1", err, calls, permanent)
+	}
+}
+
+func TestWithRetryStopsWhenContextIsDone(t *testing.T) {
+	defer withFastRetries()()
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := withRetry(ctx, func() error {
+		calls++
+		cancel()
+		return &transientError{err: errors.New("connection reset")}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("withRetry() = %v after %v calls, want the error after 1", err, calls)
+	}
+	calls = 0
+	err = withRetry(context.Background(), func() error {
+		calls++
+		return &transientError{err: context.DeadlineExceeded}
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || calls != 1 {
+		t.Errorf("withRetry() = %v after %v calls, want the deadline after 1", err, calls)
+	}
+}
+
+// rewriteTransport sends every request to target instead of Twitter.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// fakeUsersShow serves users/show for the given accounts, keyed by ID, answering Twitter's
+// not found error for any other.  It records the query of each call in shows, and returns a
+// client calling it along with a func closing the server.
+func fakeUsersShow(users map[string]string, shows *[]url.Values) (*twitter.Client, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		*shows = append(*shows, query)
+		w.Header().Set("Content-Type", "application/json")
+		for id, name := range users {
+			if query.Get("user_id") == id || query.Get("screen_name") == name {
+				fmt.Fprintf(w, `{"id_str": %q, "screen_name": %q}`, id, name)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors": [{"code": 50, "message": "User not found."}]}`)
+	}))
+	target, _ := url.Parse(server.URL)
+	return twitter.NewClient(&http.Client{Transport: rewriteTransport{target}}), server.Close
+}
+
+func TestValidateHandle(t *testing.T) {
+	tests := []struct {
+		handle  string
+		want    string
+		wantErr bool
+	}{
+		{handle: "jack", want: "jack"},
+		{handle: "  @jack ", want: "jack"},
+		{handle: "Under_Score9", want: "Under_Score9"},
+		{handle: "12345", want: "12345"},
+		{handle: "1234567890123456", want: "1234567890123456"},
+		{handle: "9223372036854775807", want: "9223372036854775807"},
+		{handle: "9223372036854775808", wantErr: true},
+		{handle: "9999999999999999999", wantErr: true},
+		{handle: "", wantErr: true},
+		{handle: " @ ", wantErr: true},
+		{handle: "sixteen_letters_", wantErr: true},
+		{handle: "bad-name", wantErr: true},
+		{handle: "@@jack", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := validateHandle(tt.handle)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateHandle(%q) error = %v, want error %v", tt.handle, err, tt.wantErr)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidHandle) {
+			t.Errorf("validateHandle(%q) error = %v, want ErrInvalidHandle", tt.handle, err)
+		}
+		if got != tt.want {
+			t.Errorf("validateHandle(%q) = %q, want %q", tt.handle, got, tt.want)
+		}
+	}
+}
+
+func TestGetTwitterUserByHandleSkipsScreenNamesForLongIDs(t *testing.T) {
+	var shows []url.Values
+	client, closeServer := fakeUsersShow(nil, &shows)
+	defer closeServer()
+	_, err := getTwitterUserByHandle(context.Background(), client, "1234567890123456")
+	if !errors.Is(err, ErrHandleNotFound) {
+		t.Errorf("getTwitterUserByHandle() error = %v, want ErrHandleNotFound", err)
+	}
+	if len(shows) != 1 || shows[0].Get("user_id") != "1234567890123456" {
+		t.Errorf("users/show calls = %v, want one by user_id", shows)
+	}
+}
+
+func TestGetTwitterUserByHandle(t *testing.T) {
+	users := map[string]string{"12345": "jack", "777": "2020"}
+	tests := []struct {
+		handle    string
+		wantID    string
+		wantShows []string
+		wantErr   error
+	}{
+		{handle: "12345", wantID: "12345", wantShows: []string{"user_id=12345"}},
+		{handle: "@12345", wantID: "12345", wantShows: []string{"user_id=12345"}},
+		{handle: "@jack", wantID: "12345", wantShows: []string{"screen_name=jack"}},
+		{handle: " jack ", wantID: "12345", wantShows: []string{"screen_name=jack"}},
+		{handle: "2020", wantID: "777", wantShows: []string{"user_id=2020", "screen_name=2020"}},
+		{handle: "404", wantShows: []string{"user_id=404", "screen_name=404"}, wantErr: ErrHandleNotFound},
+		{handle: "nobody", wantShows: []string{"screen_name=nobody"}, wantErr: ErrHandleNotFound},
+		{handle: "no-body", wantErr: ErrInvalidHandle},
+	}
+	for _, tt := range tests {
+		var shows []url.Values
+		client, closeServer := fakeUsersShow(users, &shows)
+		user, err := getTwitterUserByHandle(context.Background(), client, tt.handle)
+		closeServer()
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("getTwitterUserByHandle(%q) error = %v, want %v", tt.handle, err, tt.wantErr)
+			}
+		} else if err != nil || user.IDStr != tt.wantID {
+			t.Errorf("getTwitterUserByHandle(%q) = %v, %v, want ID %v", tt.handle, user, err, tt.wantID)
+		}
+		var got []string
+		for _, query := range shows {
+			for _, key := range []string{"user_id", "screen_name"} {
+				if v := query.Get(key); v != "" {
+					got = append(got, key+"="+v)
+				}
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.wantShows) {
+			t.Errorf("getTwitterUserByHandle(%q) called users/show with %v, want %v", tt.handle, got, tt.wantShows)
+		}
+	}
+}
+
+func TestAdvanceFollowersKeepsTheCursorWhenRateLimited(t *testing.T) {
+	defer withFastRetries()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("x-rate-limit-remaining", "0")
+		w.Header().Set("x-rate-limit-reset", strconv.FormatInt(time.Now().Add(15*time.Minute).Unix(), 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"errors": [{"code": 88, "message": "Rate limit exceeded"}]}`)
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	client := twitter.NewClient(&http.Client{Transport: rewriteTransport{target}})
+	rootHandle := &RootHandle{Node: GephiNode{TwitterID: "1"}, FollowersCursor: 12345}
+	// The data client is never reached, since nothing is saved for a rate limited page.
+	_, err := advanceFollowers(context.Background(), client, nil, "user", rootHandle)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("advanceFollowers() error = %v, want ErrRateLimited", err)
+	}
+	if rootHandle.FollowersCursor != 12345 || rootHandle.FollowerPages != 0 {
+		t.Errorf("advanceFollowers() moved the cursor to %v after %v pages, want 12345 after 0", rootHandle.FollowersCursor, rootHandle.FollowerPages)
+	}
+}
+
+func TestAddFriendsPageStopsAtAStuckCursor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every page answers the cursor it was asked for as the next one.
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"ids": [5, 6], "next_cursor": %v}`, r.URL.Query().Get("cursor"))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	client := twitter.NewClient(&http.Client{Transport: rewriteTransport{target}})
+	node := &GephiNode{TwitterID: "1"}
+	addedIDs, nextCursor, err := addFriendsPage(context.Background(), client, node, 777)
+	if err != nil {
+		t.Fatalf("addFriendsPage() error = %v", err)
+	}
+	if nextCursor != 0 {
+		t.Errorf("addFriendsPage() of a stuck cursor = %v, want 0 to end paging", nextCursor)
+	}
+	if len(addedIDs) != 2 {
+		t.Errorf("addFriendsPage() added %v, want the IDs of the page", addedIDs)
+	}
+}
+
+func TestAdvanceCursor(t *testing.T) {
+	node := &GephiNode{TwitterID: "1"}
+	tests := []struct {
+		cursor, next, want int64
+	}{
+		{cursor: -1, next: 100, want: 100},
+		{cursor: 100, next: 0, want: 0},
+		{cursor: 100, next: 100, want: 0},
+		{cursor: -1, next: -1, want: 0},
+	}
+	for _, tt := range tests {
+		if got := advanceCursor(node, "friends", tt.cursor, tt.next); got != tt.want {
+			t.Errorf("advanceCursor(%v, %v) = %v, want %v", tt.cursor, tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestAppendUniqueIDs(t *testing.T) {
+	tests := []struct {
+		ids, page, want, wantAdded []string
+	}{
+		{ids: nil, page: []string{"1", "2"}, want: []string{"1", "2"}, wantAdded: []string{"1", "2"}},
+		{ids: []string{"1", "2"}, page: []string{"2", "3"}, want: []string{"1", "2", "3"}, wantAdded: []string{"3"}},
+		{ids: []string{"1", "2"}, page: []string{"1", "2"}, want: []string{"1", "2"}},
+		{ids: []string{"1", "2", "1"}, page: []string{"3", "3"}, want: []string{"1", "2", "3"}, wantAdded: []string{"3"}},
+	}
+	for _, tt := range tests {
+		ids := append([]string(nil), tt.ids...)
+		got, added := appendUniqueIDs(ids, tt.page)
+		if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(added, tt.wantAdded) {
+			t.Errorf("appendUniqueIDs(%v, %v) = %v, %v, want %v, %v", tt.ids, tt.page, got, added, tt.want, tt.wantAdded)
+		}
+	}
+}
+
+func TestAddFriendsPageRetriedAppendsNoDuplicates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ids": [5, 6], "next_cursor": 200}`)
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	client := twitter.NewClient(&http.Client{Transport: rewriteTransport{target}})
+	node := &GephiNode{TwitterID: "1", FriendIDs: []string{"4"}}
+	if _, _, err := addFriendsPage(context.Background(), client, node, 100); err != nil {
+		t.Fatalf("addFriendsPage() error = %v", err)
+	}
+	// The save failed, so the tick fetches the same page again into the same node.
+	addedIDs, _, err := addFriendsPage(context.Background(), client, node, 100)
+	if err != nil {
+		t.Fatalf("addFriendsPage() retry error = %v", err)
+	}
+	if len(addedIDs) != 0 {
+		t.Errorf("addFriendsPage() retry added %v, want nothing new", addedIDs)
+	}
+	if want := []string{"4", "5", "6"}; !reflect.DeepEqual(node.FriendIDs, want) {
+		t.Errorf("FriendIDs = %v, want %v", node.FriendIDs, want)
+	}
+}
+
+func TestExpandedDescription(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{
+			name: "with entities",
+			json: `{"description": "blog https://t.co/abc and https://t.co/xyz", "entities": {"description": {"urls": [
+				{"url": "https://t.co/abc", "expanded_url": "https://example.com/blog"},
+				{"url": "https://t.co/xyz", "expanded_url": "https://example.org/"}]}}}`,
+			want: "blog https://example.com/blog and https://example.org/",
+		},
+		{
+			name: "without entities",
+			json: `{"description": "blog https://t.co/abc"}`,
+			want: "blog https://t.co/abc",
+		},
+		{
+			name: "entity without expansion",
+			json: `{"description": "blog https://t.co/abc", "entities": {"description": {"urls": [{"url": "https://t.co/abc"}]}}}`,
+			want: "blog https://t.co/abc",
+		},
+	}
+	for _, tt := range tests {
+		var user twitter.User
+		if err := json.Unmarshal([]byte(tt.json), &user); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if got := expandedDescription(&user); got != tt.want {
+			t.Errorf("%v: expandedDescription() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -4,4 +4,8 @@ class AppConfig {
   /// apiEndpoint holds the base URL of the backend service that handles
   /// fetching.
   String apiEndpoint;
+
+  /// collectionPrefix must match the COLLECTION_PREFIX of the backend
+  /// deployment so the app reads the same Firestore collections.
+  String collectionPrefix = "";
 }
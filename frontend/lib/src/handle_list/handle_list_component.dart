@@ -15,6 +15,7 @@ import 'handle_list_service.dart';
     MaterialDialogComponent,
     MaterialFabComponent,
     MaterialIconComponent,
+    MaterialProgressComponent,
     MaterialYesNoButtonsComponent,
     ModalComponent,
     materialInputDirectives,
@@ -33,14 +34,39 @@ class HandleListComponent implements OnInit, OnDestroy {
 
   /// sub manages the subscription to Firestore for updates to the list of
   /// handles.
-  StreamSubscription<List<Handle>> _sub;
+  StreamSubscription<HandlePage> _sub;
+
+  /// after is the screen name the displayed page starts after, read from the
+  /// after query parameter. It is empty on the first page.
+  final String after = Uri.base.queryParameters["after"] ?? "";
+
+  /// nextAfter is the screen name the next page starts after, or empty on the
+  /// last page.
+  String nextAfter = "";
 
   /// newHandle backs a text box to capture a new handle to save.
   String newHandle = "";
 
+  /// suggestions lists the accounts matching the handle being typed.
+  List<Suggestion> suggestions = [];
+
+  /// searchDelay is how long typing must pause before suggestions are
+  /// searched, so each keystroke does not spend a Twitter call.
+  static const searchDelay = Duration(milliseconds: 400);
+
+  /// searchTimer waits out searchDelay before searching.
+  Timer _searchTimer;
+
+  /// twoHops backs a checkbox that crawls two hops from the new handle.
+  bool twoHops = false;
+
   /// displayError backs a notification area that communicateserrors.
   String displayError = "";
 
+  /// dismissedErrors maps the ID of a handle to the time of the last error
+  /// dismissed on it, so a newer error is shown again.
+  final Map<String, DateTime> dismissedErrors = {};
+
   /// handleToDelete is a state variable that holds the ID of a handle to
   /// delete. The dialog is visible when this is nonempty.
   String handleToDelete = "";
@@ -49,21 +75,88 @@ class HandleListComponent implements OnInit, OnDestroy {
 
   @override
   void ngOnInit() {
-    _sub = _handleListService.getHandleList().listen((data) => handles = data);
+    _sub = _handleListService.getHandleList(after: after).listen((page) {
+      handles = page.handles;
+      nextAfter = page.nextAfter;
+    });
   }
 
   @override
   void ngOnDestroy() {
     _sub.cancel();
+    _searchTimer?.cancel();
+  }
+
+  /// onHandleChanged records the typed handle and searches for suggestions
+  /// once typing pauses.
+  void onHandleChanged(String value) {
+    newHandle = value;
+    _searchTimer?.cancel();
+    if (value.trim().isEmpty) {
+      suggestions = [];
+      return;
+    }
+    _searchTimer = Timer(searchDelay, () {
+      _handleListService.search(value).then((found) {
+        // A search overtaken by further typing is dropped.
+        if (value == newHandle) {
+          suggestions = found;
+        }
+      }).catchError((e) => suggestions = []);
+    });
+  }
+
+  /// pick fills in the handle of a suggested account.
+  void pick(Suggestion suggestion) {
+    _searchTimer?.cancel();
+    newHandle = suggestion.screenName;
+    suggestions = [];
+  }
+
+  /// nextPageURL links to the page following the displayed one.
+  String get nextPageURL =>
+      Uri.base.replace(queryParameters: {"after": nextAfter}).toString();
+
+  /// firstPageURL links to the first page of handles.
+  String get firstPageURL => Uri.base.path;
+
+  /// showError is true when the handle has a last error that was not
+  /// dismissed.
+  bool showError(Handle handle) =>
+      handle.lastError.isNotEmpty &&
+      (!dismissedErrors.containsKey(handle.id) ||
+          dismissedErrors[handle.id] != handle.lastErrorAt);
+
+  /// dismissError hides the current last error of the handle.
+  void dismissError(Handle handle) {
+    dismissedErrors[handle.id] = handle.lastErrorAt;
   }
 
   /// add adds a new handle to be fetched.
   void add() {
     _handleListService
-        .add(newHandle)
+        .add(newHandle, depth: twoHops ? 2 : 1)
         .then((r) => displayError = "")
         .catchError((e) => displayError = e.toString());
+    _searchTimer?.cancel();
     newHandle = '';
+    suggestions = [];
+  }
+
+  /// refresh updates the displayed name of a fetch task from Twitter.
+  void refresh(String id) {
+    _handleListService
+        .refresh(id)
+        .then((r) => displayError = "")
+        .catchError((e) => displayError = e.toString());
+  }
+
+  /// setPaused pauses or resumes a fetch task, keeping its progress.
+  void setPaused(String id, bool paused) {
+    _handleListService
+        .setPaused(id, paused)
+        .then((r) => displayError = "")
+        .catchError((e) => displayError = e.toString());
   }
 
   /// remove deletes a fetch task from the backend.
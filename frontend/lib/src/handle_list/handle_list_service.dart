@@ -1,4 +1,5 @@
 import 'dart:async';
+import 'dart:convert';
 
 import '../../app_config.dart';
 import 'package:angular/core.dart';
@@ -28,6 +29,51 @@ class Handle {
   /// remaining indicates how many fetches remain to be performed.
   int remaining;
 
+  /// paused is true while the fetch is paused and the worker leaves it alone.
+  bool paused;
+
+  /// percentComplete is the share of handles fetched, computed by the
+  /// backend, or -1 while IDs are still being collected.
+  int percentComplete;
+
+  /// prepareGraph is true while the backend builds the graph file.
+  bool prepareGraph;
+
+  /// startedAt is when the fetch was enqueued, or null for older fetches.
+  DateTime startedAt;
+
+  /// completedAt is when the graph was built, or null until then.
+  DateTime completedAt;
+
+  /// lastError is the failure of the most recent fetch step, kept apart from
+  /// status. It is empty once a later step succeeds.
+  String lastError;
+
+  /// lastErrorAt is when lastError happened, or null without one.
+  DateTime lastErrorAt;
+
+  /// elapsed describes how long the fetch has been running, or how long it
+  /// took once done. It is empty when the start time is unknown.
+  String get elapsed {
+    if (startedAt == null) {
+      return "";
+    }
+    if (done && completedAt != null) {
+      return "took " + _formatDuration(completedAt.difference(startedAt));
+    }
+    return "running for " +
+        _formatDuration(DateTime.now().difference(startedAt));
+  }
+
+  /// formatDuration writes d in whole minutes, as "45m" or "26h3m".
+  static String _formatDuration(Duration d) {
+    var minutes = d.inMinutes < 0 ? 0 : d.inMinutes;
+    if (minutes < 60) {
+      return "${minutes}m";
+    }
+    return "${minutes ~/ 60}h${minutes % 60}m";
+  }
+
   /// updateDownloadUrl asynchronously populates the downloadURL property if
   /// the task is done.
   updateDownloadUrl(fb.Storage storage, String uid) {
@@ -41,6 +87,25 @@ class Handle {
   }
 }
 
+/// Suggestion is an account offered while typing a handle to fetch.
+class Suggestion {
+  /// screenName is the handle of the suggested account.
+  String screenName;
+
+  /// name is the display name of the suggested account.
+  String name;
+}
+
+/// HandlePage is one page of the handle list, in screen name order.
+class HandlePage {
+  /// handles holds the handles of this page.
+  List<Handle> handles = [];
+
+  /// nextAfter is the screen name the next page starts after, or empty on the
+  /// last page.
+  String nextAfter = "";
+}
+
 /// HandleListService mediates most calls to the fetch backend.
 @Injectable()
 class HandleListService {
@@ -60,21 +125,29 @@ class HandleListService {
   /// config wraps various options required to connect to the backend.
   final AppConfig _config;
 
+  /// pageSize is the number of handles listed per page.
+  static const pageSize = 50;
+
   HandleListService(
       this._store, this._auth, this._client, this._storage, this._config);
 
-  /// getHandleList emits the complete list of handles when any of them are
-  /// updated on the backend.
-  Stream<List<Handle>> getHandleList() {
+  /// getHandleList emits a page of handles when any of them are updated on the
+  /// backend. The page holds up to pageSize handles whose screen names sort
+  /// after the given one, or the first handles when after is empty.
+  Stream<HandlePage> getHandleList({String after = ""}) {
     var user = _auth.currentUser;
-    return _store
-        .collection("User")
+    var query = _store
+        .collection(_config.collectionPrefix + "User")
         .doc(user.uid)
-        .collection("RootHandle")
-        .orderBy("Node.ScreenName")
-        .onSnapshot
-        .map((snap) {
-      List<Handle> handles = new List();
+        .collection(_config.collectionPrefix + "RootHandle")
+        .orderBy("Node.ScreenName");
+    if (after.isNotEmpty) {
+      query = query.startAfter(fieldValues: [after]);
+    }
+    // One extra handle is read to tell whether another page follows.
+    return query.limit(pageSize + 1).onSnapshot.map((snap) {
+      var page = new HandlePage();
+      var handles = page.handles;
       for (var doc in snap.docs) {
         var handle = new Handle()
           ..id = doc.data()["Node"]["TwitterID"] ?? ""
@@ -82,22 +155,113 @@ class HandleListService {
           ..status = doc.data()["Status"] ?? ""
           ..downloadURL = doc.data()["DownloadURL"] ?? ""
           ..remaining = doc.data()["Remaining"] ?? 0
+          ..paused = doc.data()["Paused"] ?? false
+          ..percentComplete = doc.data()["PercentComplete"] ?? -1
+          ..prepareGraph = doc.data()["PrepareGraph"] ?? false
+          ..startedAt = _timestamp(doc.data()["StartedAt"])
+          ..completedAt = _timestamp(doc.data()["CompletedAt"])
+          ..lastError = doc.data()["LastError"] ?? ""
+          ..lastErrorAt = _timestamp(doc.data()["LastErrorAt"])
           ..name = doc.data()["Node"]["ScreenName"] ?? ""
           ..updateDownloadUrl(_storage, _auth.currentUser.uid);
         handles.add(handle);
       }
-      return handles;
+      if (handles.length > pageSize) {
+        handles.removeLast();
+        page.nextAfter = handles.last.name;
+      }
+      return page;
+    });
+  }
+
+  /// timestamp reads a Firestore timestamp field, treating the zero time the
+  /// backend saves for unset fields as missing.
+  static DateTime _timestamp(dynamic value) {
+    if (value is! DateTime || value.year <= 1) {
+      return null;
+    }
+    return value;
+  }
+
+  /// validateHandle trims whitespace and a leading "@" from a typed handle,
+  /// returning null if it cannot be a screen name or numeric Twitter ID. The
+  /// backend applies the same rules.
+  static String validateHandle(String s) {
+    var handle = s.trim();
+    if (handle.startsWith("@")) {
+      handle = handle.substring(1);
+    }
+    if (RegExp(r"^[0-9]{1,19}$").hasMatch(handle) ||
+        RegExp(r"^[A-Za-z0-9_]{1,15}$").hasMatch(handle)) {
+      return handle;
+    }
+    return null;
+  }
+
+  /// search returns accounts matching a partly typed handle or name. An empty
+  /// query returns no suggestions without calling the backend.
+  Future<List<Suggestion>> search(String query) {
+    if (_auth.currentUser == null || query.trim().isEmpty) {
+      return Future.value([]);
+    }
+    return _auth.currentUser.getIdToken().then((token) {
+      return _client.post(_config.apiEndpoint + "/search/", body: {
+        "q": query.trim(),
+        "auth": token,
+      });
+    }).then((response) {
+      var suggestions = <Suggestion>[];
+      for (var result in jsonDecode(response.body)) {
+        suggestions.add(new Suggestion()
+          ..screenName = result["screen_name"] ?? ""
+          ..name = result["name"] ?? "");
+      }
+      return suggestions;
     });
   }
 
   /// add adds a new fetch task to the backend identified by Twitter handle.
-  Future<void> add(String newHandle) {
+  /// A depth of 2 also crawls the friends and followers of each account found.
+  Future<void> add(String newHandle, {int depth = 1}) {
     if (_auth.currentUser == null) {
       return Future.error("Not logged in");
     }
+    var handle = validateHandle(newHandle);
+    if (handle == null) {
+      return Future.error("Invalid handle: use up to 15 letters, digits or "
+          "underscores, or a numeric ID");
+    }
     return _auth.currentUser.getIdToken().then((token) {
       return _client.post(_config.apiEndpoint + "/addHandle", body: {
-        "handle": newHandle,
+        "handle": handle,
+        "depth": depth.toString(),
+        "auth": token,
+      });
+    });
+  }
+
+  /// refresh re-resolves the current screen name of the fetch task identified
+  /// by Twitter ID, in case the account was renamed.
+  Future<void> refresh(String id) {
+    if (_auth.currentUser == null) {
+      return Future.error("Not logged in");
+    }
+    return _auth.currentUser.getIdToken().then((token) {
+      return _client.post(_config.apiEndpoint + "/refreshHandle", body: {
+        "id": id,
+        "auth": token,
+      });
+    });
+  }
+
+  /// setPaused pauses or resumes the fetch task identified by Twitter ID.
+  Future<void> setPaused(String id, bool paused) {
+    if (_auth.currentUser == null) {
+      return Future.error("Not logged in");
+    }
+    return _auth.currentUser.getIdToken().then((token) {
+      return _client.post(_config.apiEndpoint + "/pause/" + id, body: {
+        "paused": paused.toString(),
         "auth": token,
       });
     });